@@ -0,0 +1,335 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipstore
+
+import (
+	"fmt"
+	"iter"
+	"maps"
+	"net/netip"
+	"reflect"
+	"slices"
+
+	"github.com/gaissmai/bart"
+)
+
+// Backend is the data structure holding the entries of a [Store]. The
+// [Store] guards access to it, so implementations don't need to be safe
+// for concurrent use.
+//
+// Implementations mask prefixes before storing them and ignore invalid
+// prefixes. LookupPrefixLPM returns the most specific entry containing
+// the prefix, together with the prefix it's stored by. Supernets returns
+// entries most specific first; AllSorted returns entries sorted by address
+// and prefix length.
+type Backend[T any] interface {
+	Insert(pfx netip.Prefix, val T)
+	Delete(pfx netip.Prefix) (T, bool)
+	Get(pfx netip.Prefix) (T, bool)
+	Lookup(ip netip.Addr) (T, bool)
+	LookupPrefix(pfx netip.Prefix) (T, bool)
+	LookupPrefixLPM(pfx netip.Prefix) (netip.Prefix, T, bool)
+	Supernets(pfx netip.Prefix) iter.Seq2[netip.Prefix, T]
+	Subnets(pfx netip.Prefix) iter.Seq2[netip.Prefix, T]
+	All() iter.Seq2[netip.Prefix, T]
+	AllSorted() iter.Seq2[netip.Prefix, T]
+	Size() int
+	Clone() Backend[T]
+}
+
+// BackendType selects one of the [Backend] implementations provided.
+type BackendType int
+
+const (
+	// TableBackend uses a [bart.Table], balancing memory use and lookup
+	// speed. It's the default.
+	TableBackend BackendType = iota
+	// FastBackend uses a [bart.Fast], trading memory for faster lookups.
+	FastBackend
+	// LiteBackend uses a [bart.Lite] for the prefixes, and a map for
+	// values other than the zero value. It uses the least memory for
+	// stores used as sets, such as a Store[struct{}].
+	LiteBackend
+	// ReferenceBackend uses a map and brute force lookups. It's slow, but
+	// simple enough to verify the other backends against.
+	ReferenceBackend
+)
+
+func (b BackendType) String() string {
+	switch b {
+	case TableBackend:
+		return "table"
+	case FastBackend:
+		return "fast"
+	case LiteBackend:
+		return "lite"
+	case ReferenceBackend:
+		return "reference"
+	default:
+		return fmt.Sprintf("BackendType(%d)", b)
+	}
+}
+
+// WithBackend sets the [Backend] used by a [Store]. It defaults to
+// [TableBackend].
+func WithBackend(b BackendType) Option {
+	return func(o *options) {
+		o.backend = b
+	}
+}
+
+// NewBackend returns a new, empty [Backend] of the type provided.
+func NewBackend[T any](b BackendType) Backend[T] {
+	switch b {
+	case FastBackend:
+		return fastBackend[T]{new(bart.Fast[T])}
+	case LiteBackend:
+		return &liteBackend[T]{lite: new(bart.Lite), values: make(map[netip.Prefix]T)}
+	case ReferenceBackend:
+		return referenceBackend[T]{}
+	default:
+		return tableBackend[T]{new(bart.Table[T])}
+	}
+}
+
+type tableBackend[T any] struct {
+	*bart.Table[T]
+}
+
+func (b tableBackend[T]) Delete(pfx netip.Prefix) (old T, found bool) {
+	b.Modify(pfx, func(v T, ok bool) (_ T, del bool) {
+		old, found = v, ok
+		return v, true
+	})
+
+	return old, found
+}
+
+func (b tableBackend[T]) Clone() Backend[T] {
+	return tableBackend[T]{b.Table.Clone()}
+}
+
+type fastBackend[T any] struct {
+	*bart.Fast[T]
+}
+
+func (b fastBackend[T]) Delete(pfx netip.Prefix) (old T, found bool) {
+	b.Modify(pfx, func(v T, ok bool) (_ T, del bool) {
+		old, found = v, ok
+		return v, true
+	})
+
+	return old, found
+}
+
+func (b fastBackend[T]) Clone() Backend[T] {
+	return fastBackend[T]{b.Fast.Clone()}
+}
+
+// liteBackend stores prefixes in a [bart.Lite], and only stores values
+// that aren't the zero value in a map.
+type liteBackend[T any] struct {
+	lite   *bart.Lite
+	values map[netip.Prefix]T
+}
+
+func (b *liteBackend[T]) Insert(pfx netip.Prefix, val T) {
+	if !pfx.IsValid() {
+		return
+	}
+	pfx = pfx.Masked()
+
+	b.lite.Insert(pfx)
+	if reflect.ValueOf(&val).Elem().IsZero() {
+		delete(b.values, pfx)
+	} else {
+		b.values[pfx] = val
+	}
+}
+
+func (b *liteBackend[T]) Delete(pfx netip.Prefix) (T, bool) {
+	if !pfx.IsValid() {
+		return zero[T](), false
+	}
+	pfx = pfx.Masked()
+
+	if !b.lite.Get(pfx) {
+		return zero[T](), false
+	}
+	b.lite.Delete(pfx)
+	v := b.values[pfx]
+	delete(b.values, pfx)
+
+	return v, true
+}
+
+func (b *liteBackend[T]) Get(pfx netip.Prefix) (T, bool) {
+	if !b.lite.Get(pfx) {
+		return zero[T](), false
+	}
+
+	return b.values[pfx.Masked()], true
+}
+
+func (b *liteBackend[T]) Lookup(ip netip.Addr) (T, bool) {
+	prf, err := ip.Prefix(ip.BitLen())
+	if err != nil {
+		return zero[T](), false
+	}
+
+	return b.LookupPrefix(prf)
+}
+
+func (b *liteBackend[T]) LookupPrefix(pfx netip.Prefix) (T, bool) {
+	_, v, ok := b.LookupPrefixLPM(pfx)
+	return v, ok
+}
+
+func (b *liteBackend[T]) LookupPrefixLPM(pfx netip.Prefix) (netip.Prefix, T, bool) {
+	lpm, ok := b.lite.LookupPrefixLPM(pfx)
+	if !ok {
+		return netip.Prefix{}, zero[T](), false
+	}
+
+	return lpm, b.values[lpm], true
+}
+
+func (b *liteBackend[T]) Supernets(pfx netip.Prefix) iter.Seq2[netip.Prefix, T] {
+	return b.withValues(b.lite.Supernets(pfx))
+}
+
+func (b *liteBackend[T]) Subnets(pfx netip.Prefix) iter.Seq2[netip.Prefix, T] {
+	return b.withValues(b.lite.Subnets(pfx))
+}
+
+func (b *liteBackend[T]) All() iter.Seq2[netip.Prefix, T] {
+	return b.withValues(b.lite.All())
+}
+
+func (b *liteBackend[T]) AllSorted() iter.Seq2[netip.Prefix, T] {
+	return b.withValues(b.lite.AllSorted())
+}
+
+func (b *liteBackend[T]) Size() int {
+	return b.lite.Size()
+}
+
+func (b *liteBackend[T]) Clone() Backend[T] {
+	return &liteBackend[T]{lite: b.lite.Clone(), values: maps.Clone(b.values)}
+}
+
+func (b *liteBackend[T]) withValues(seq iter.Seq[netip.Prefix]) iter.Seq2[netip.Prefix, T] {
+	return func(yield func(netip.Prefix, T) bool) {
+		for pfx := range seq {
+			if !yield(pfx, b.values[pfx]) {
+				return
+			}
+		}
+	}
+}
+
+// referenceBackend stores entries in a map, and finds matches by trying
+// every prefix length or by checking every entry.
+type referenceBackend[T any] map[netip.Prefix]T
+
+func (b referenceBackend[T]) Insert(pfx netip.Prefix, val T) {
+	if pfx.IsValid() {
+		b[pfx.Masked()] = val
+	}
+}
+
+func (b referenceBackend[T]) Delete(pfx netip.Prefix) (T, bool) {
+	v, ok := b[pfx.Masked()]
+	delete(b, pfx.Masked())
+
+	return v, ok
+}
+
+func (b referenceBackend[T]) Get(pfx netip.Prefix) (T, bool) {
+	v, ok := b[pfx.Masked()]
+	return v, ok
+}
+
+func (b referenceBackend[T]) Lookup(ip netip.Addr) (T, bool) {
+	prf, err := ip.Prefix(ip.BitLen())
+	if err != nil {
+		return zero[T](), false
+	}
+
+	return b.LookupPrefix(prf)
+}
+
+func (b referenceBackend[T]) LookupPrefix(pfx netip.Prefix) (T, bool) {
+	_, v, ok := b.LookupPrefixLPM(pfx)
+	return v, ok
+}
+
+func (b referenceBackend[T]) LookupPrefixLPM(pfx netip.Prefix) (netip.Prefix, T, bool) {
+	for p, v := range b.Supernets(pfx) {
+		return p, v, true
+	}
+
+	return netip.Prefix{}, zero[T](), false
+}
+
+func (b referenceBackend[T]) Supernets(pfx netip.Prefix) iter.Seq2[netip.Prefix, T] {
+	return func(yield func(netip.Prefix, T) bool) {
+		if !pfx.IsValid() {
+			return
+		}
+		for bits := pfx.Bits(); bits >= 0; bits-- {
+			p := netip.PrefixFrom(pfx.Addr(), bits).Masked()
+			if v, ok := b[p]; ok && !yield(p, v) {
+				return
+			}
+		}
+	}
+}
+
+func (b referenceBackend[T]) Subnets(pfx netip.Prefix) iter.Seq2[netip.Prefix, T] {
+	return func(yield func(netip.Prefix, T) bool) {
+		if !pfx.IsValid() {
+			return
+		}
+		pfx = pfx.Masked()
+		for p, v := range b.AllSorted() {
+			if p.Bits() >= pfx.Bits() && pfx.Contains(p.Addr()) && !yield(p, v) {
+				return
+			}
+		}
+	}
+}
+
+func (b referenceBackend[T]) All() iter.Seq2[netip.Prefix, T] {
+	return b.AllSorted()
+}
+
+func (b referenceBackend[T]) AllSorted() iter.Seq2[netip.Prefix, T] {
+	return func(yield func(netip.Prefix, T) bool) {
+		for _, p := range slices.SortedFunc(maps.Keys(b), comparePrefix) {
+			if !yield(p, b[p]) {
+				return
+			}
+		}
+	}
+}
+
+func (b referenceBackend[T]) Size() int {
+	return len(b)
+}
+
+func (b referenceBackend[T]) Clone() Backend[T] {
+	return maps.Clone(b)
+}
@@ -0,0 +1,246 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipstore_test
+
+import (
+	"bytes"
+	"math/rand/v2"
+	"net/netip"
+	"runtime"
+	"slices"
+	"testing"
+
+	"github.com/hslatman/ipstore"
+	"github.com/hslatman/ipstore/ipstoretest"
+)
+
+var backends = []ipstore.BackendType{
+	ipstore.TableBackend,
+	ipstore.FastBackend,
+	ipstore.LiteBackend,
+	ipstore.ReferenceBackend,
+}
+
+func TestBackendConformance(t *testing.T) {
+	for _, b := range backends {
+		t.Run(b.String(), func(t *testing.T) {
+			ipstoretest.RunReader(t, func(t *testing.T, entries []ipstoretest.Entry) ipstore.Reader[string] {
+				s := ipstore.New[string](ipstore.WithBackend(b))
+				for _, e := range entries {
+					if err := s.AddCIDR(e.Prefix, e.Value); err != nil {
+						t.Fatal(err)
+					}
+				}
+				return s
+			})
+			ipstoretest.RunWriter(t, func(t *testing.T) (ipstore.Writer[string], ipstore.Reader[string]) {
+				s := ipstore.New[string](ipstore.WithBackend(b))
+				return s, s
+			})
+		})
+	}
+}
+
+func TestBackendsMatchReference(t *testing.T) {
+	r := rand.New(rand.NewPCG(3, 4))
+	stores := make([]*ipstore.Store[string], len(backends))
+	for i, b := range backends {
+		stores[i] = ipstore.New[string](ipstore.WithBackend(b))
+	}
+	ref := stores[len(stores)-1]
+
+	for range 3000 {
+		prf := randomPrefix(r)
+		remove := r.IntN(5) == 0
+		// empty values are the zero value, which the lite backend doesn't
+		// store separately.
+		value := prf.String()[:r.IntN(3)]
+		for _, s := range stores {
+			if remove {
+				if _, err := s.RemoveCIDR(prf); err != nil {
+					t.Fatal(err)
+				}
+			} else if err := s.AddCIDR(prf, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for i, s := range stores[:len(stores)-1] {
+		name := backends[i].String()
+		if s.Len() != ref.Len() {
+			t.Fatalf("%s: expected %d entries; got %d", name, ref.Len(), s.Len())
+		}
+		if !slices.Equal(collect(s.All()), collect(ref.All())) {
+			t.Errorf("%s: expected All to return the same entries", name)
+		}
+
+		for range 1000 {
+			prf := randomPrefix(r)
+			addr := prf.Addr().Next()
+
+			ev, eok := ref.GetOne(addr)
+			gv, gok := s.GetOne(addr)
+			if ev != gv || eok != gok {
+				t.Errorf("%s: GetOne(%s): expected %q, %t; got %q, %t", name, addr, ev, eok, gv, gok)
+			}
+			ev, eok = ref.GetOneCIDR(prf)
+			gv, gok = s.GetOneCIDR(prf)
+			if ev != gv || eok != gok {
+				t.Errorf("%s: GetOneCIDR(%s): expected %q, %t; got %q, %t", name, prf, ev, eok, gv, gok)
+			}
+			expected, _ := ref.GetCIDR(prf)
+			got, _ := s.GetCIDR(prf)
+			if !slices.Equal(got, expected) {
+				t.Errorf("%s: GetCIDR(%s): expected %v; got %v", name, prf, expected, got)
+			}
+			if !slices.Equal(collect(s.Subnets(prf)), collect(ref.Subnets(prf))) {
+				t.Errorf("%s: Subnets(%s): expected the same entries", name, prf)
+			}
+		}
+	}
+}
+
+func TestBackendSnapshotAndClone(t *testing.T) {
+	for _, b := range backends {
+		s := ipstore.New[string](ipstore.WithBackend(b))
+		if err := s.AddIPOrCIDR("10.0.0.0/8", "private"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.AddIPOrCIDR("2001:db8::/32", ""); err != nil {
+			t.Fatal(err)
+		}
+
+		c := s.Clone()
+		if _, err := s.RemoveIPOrCIDR("10.0.0.0/8"); err != nil {
+			t.Fatal(err)
+		}
+		if v, _ := c.GetOneIPOrCIDR("10.1.2.3"); v != "private" {
+			t.Errorf("%s: expected %q in clone; got %q", b, "private", v)
+		}
+
+		var buf bytes.Buffer
+		if err := c.WriteSnapshot(&buf, ipstore.StringCodec{}); err != nil {
+			t.Fatal(err)
+		}
+		r := ipstore.New[string](ipstore.WithBackend(b))
+		if err := r.ReadSnapshot(&buf, ipstore.StringCodec{}); err != nil {
+			t.Fatal(err)
+		}
+		if r.Len() != 2 {
+			t.Errorf("%s: expected 2 entries; got %d", b, r.Len())
+		}
+		if ok, _ := r.Contains(netip.MustParseAddr("2001:db8::1")); !ok {
+			t.Errorf("%s: expected 2001:db8::1 to be contained", b)
+		}
+	}
+}
+
+func TestLiteBackendRemove(t *testing.T) {
+	s := ipstore.New[struct{}](ipstore.WithBackend(ipstore.LiteBackend))
+	if err := s.AddIPOrCIDR("192.0.2.0/24", struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := s.Contains(netip.MustParseAddr("192.0.2.1")); !ok {
+		t.Error("expected 192.0.2.1 to be contained")
+	}
+	if _, err := s.RemoveIPOrCIDR("192.0.2.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	if s.Len() != 0 {
+		t.Errorf("expected 0 entries; got %d", s.Len())
+	}
+}
+
+func TestNewWithBackend(t *testing.T) {
+	calls := 0
+	s := ipstore.NewWithBackend(func() ipstore.Backend[string] {
+		calls++
+		return ipstore.NewBackend[string](ipstore.ReferenceBackend)
+	})
+	if err := s.AddIPOrCIDR("10.0.0.0/8", "private"); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := s.WriteSnapshot(&buf, ipstore.StringCodec{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ReadSnapshot(&buf, ipstore.StringCodec{}); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("expected 2 calls; got %d", calls)
+	}
+	if v, _ := s.GetOneIPOrCIDR("10.1.2.3"); v != "private" {
+		t.Errorf("expected %q; got %q", "private", v)
+	}
+}
+
+// benchmarkStore returns a store with random entries, the addresses of
+// those entries, and the heap size of the store.
+func benchmarkStore(b *testing.B, backend ipstore.BackendType) (*ipstore.Store[string], []netip.Addr, float64) {
+	b.Helper()
+
+	r := rand.New(rand.NewPCG(5, 6))
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	s := ipstore.New[string](ipstore.WithBackend(backend))
+	addrs := make([]netip.Addr, 0, 10000)
+	for range 10000 {
+		prf := randomPrefix(r)
+		if err := s.AddCIDR(prf, "value"); err != nil {
+			b.Fatal(err)
+		}
+		addrs = append(addrs, prf.Addr().Next())
+	}
+
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+
+	return s, addrs, float64(after.HeapAlloc - min(before.HeapAlloc, after.HeapAlloc))
+}
+
+func BenchmarkBackendLookup(b *testing.B) {
+	for _, backend := range backends {
+		b.Run(backend.String(), func(b *testing.B) {
+			s, addrs, heap := benchmarkStore(b, backend)
+			for i := 0; b.Loop(); i++ {
+				s.GetOne(addrs[i%len(addrs)])
+			}
+			b.ReportMetric(heap, "heap-bytes")
+		})
+	}
+}
+
+func BenchmarkBackendLookupCIDR(b *testing.B) {
+	r := rand.New(rand.NewPCG(7, 8))
+	prefixes := make([]netip.Prefix, 1000)
+	for i := range prefixes {
+		prefixes[i] = randomPrefix(r)
+	}
+
+	for _, backend := range backends {
+		b.Run(backend.String(), func(b *testing.B) {
+			s, _, heap := benchmarkStore(b, backend)
+			for i := 0; b.Loop(); i++ {
+				s.GetOneCIDR(prefixes[i%len(prefixes)])
+			}
+			b.ReportMetric(heap, "heap-bytes")
+		})
+	}
+}
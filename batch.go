@@ -0,0 +1,160 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipstore
+
+import (
+	"net/netip"
+	"runtime"
+	"slices"
+	"sync"
+)
+
+// minBatchChunk is the minimum number of addresses looked up by a single
+// goroutine in [Store.LookupBatchParallel].
+const minBatchChunk = 4096
+
+// Result is the result of looking up a single address in a batch.
+type Result[T any] struct {
+	// Value is the value of the most specific entry containing the
+	// address.
+	Value T
+	// Found is true when an entry containing the address exists.
+	Found bool
+}
+
+// BatchOption configures the batch lookups, such as [Store.LookupBatch].
+type BatchOption func(*batchOptions)
+
+type batchOptions struct {
+	sort bool
+}
+
+// WithSort sorts the addresses before looking them up, which improves
+// cache locality for large batches, and looks up duplicate addresses only
+// once. Results are still returned in the order of the addresses.
+func WithSort() BatchOption {
+	return func(o *batchOptions) {
+		o.sort = true
+	}
+}
+
+// LookupBatch looks up the most specific entry containing each of the
+// addresses, like [Store.GetOne], storing the result for addrs[i] in
+// out[i]. The [Store] is read-locked once for the whole batch. It panics
+// when out is shorter than addrs.
+func (s *Store[T]) LookupBatch(addrs []netip.Addr, out []Result[T], opts ...BatchOption) {
+	s.LookupBatchParallel(addrs, out, 1, opts...)
+}
+
+// LookupBatchParallel looks up the addresses like [Store.LookupBatch],
+// splitting the batch across at most workers goroutines. When workers
+// is zero or less, runtime.GOMAXPROCS(0) goroutines are used.
+func (s *Store[T]) LookupBatchParallel(addrs []netip.Addr, out []Result[T], workers int, opts ...BatchOption) {
+	b := newBatch(addrs, out, workers, opts)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	b.run(s.lookup)
+}
+
+// batch holds the addresses of a batch lookup and where to store their
+// results.
+type batch[T any] struct {
+	addrs []netip.Addr
+	out   []Result[T]
+	// order holds the indexes of the addresses in the order they're looked
+	// up in; nil when they're looked up in the order provided.
+	order   []int
+	workers int
+}
+
+func newBatch[T any](addrs []netip.Addr, out []Result[T], workers int, opts []BatchOption) *batch[T] {
+	var o batchOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	var order []int
+	if o.sort {
+		order = make([]int, len(addrs))
+		for i := range order {
+			order[i] = i
+		}
+		slices.SortFunc(order, func(a, b int) int {
+			return addrs[a].Compare(addrs[b])
+		})
+	}
+
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	workers = min(workers, (len(addrs)+minBatchChunk-1)/minBatchChunk)
+
+	return &batch[T]{addrs: addrs, out: out[:len(addrs)], order: order, workers: workers}
+}
+
+// run looks up all addresses using lookup, splitting them across the
+// workers.
+func (b *batch[T]) run(lookup func(netip.Addr) Result[T]) {
+	if b.workers <= 1 {
+		b.lookup(lookup, 0, len(b.addrs))
+		return
+	}
+
+	var wg sync.WaitGroup
+	size := (len(b.addrs) + b.workers - 1) / b.workers
+	for lo := 0; lo < len(b.addrs); lo += size {
+		hi := min(lo+size, len(b.addrs))
+		wg.Go(func() {
+			b.lookup(lookup, lo, hi)
+		})
+	}
+	wg.Wait()
+}
+
+// lookup looks up the addresses at positions lo up to hi of order when
+// order isn't nil, or of addrs in the order provided when it is.
+func (b *batch[T]) lookup(lookup func(netip.Addr) Result[T], lo, hi int) {
+	if b.order == nil {
+		for i := lo; i < hi; i++ {
+			b.out[i] = lookup(b.addrs[i])
+		}
+		return
+	}
+
+	prev := -1
+	for _, i := range b.order[lo:hi] {
+		if prev >= 0 && b.addrs[i] == b.addrs[prev] {
+			b.out[i] = b.out[prev]
+			continue
+		}
+		b.out[i] = lookup(b.addrs[i])
+		prev = i
+	}
+}
+
+// lookup returns the most specific entry containing the address. The read
+// lock must be held.
+func (s *Store[T]) lookup(addr netip.Addr) Result[T] {
+	addr, err := s.opts.addr(addr)
+	if err != nil {
+		return Result[T]{}
+	}
+
+	v, ok := s.lookupOne(addr)
+
+	return Result[T]{Value: v, Found: ok}
+}
@@ -0,0 +1,162 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipstore_test
+
+import (
+	"math/rand/v2"
+	"net/netip"
+	"testing"
+
+	"github.com/hslatman/ipstore"
+)
+
+// batchStore returns a store with nested entries in 10.0.0.0/8, and a
+// batch of n random addresses in 10.0.0.0/16, including duplicates.
+func batchStore(tb testing.TB, n int, opts ...ipstore.Option) (*ipstore.Store[int], []netip.Addr) {
+	tb.Helper()
+
+	s := ipstore.New[int](opts...)
+	for i, cidr := range []string{"10.0.0.0/8", "10.0.0.0/16", "10.0.128.0/17", "10.0.1.0/24", "10.0.1.1"} {
+		if err := s.AddIPOrCIDR(cidr, i); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	r := rand.New(rand.NewPCG(1, 2))
+	addrs := make([]netip.Addr, n)
+	for i := range addrs {
+		addrs[i] = netip.AddrFrom4([4]byte{10, 0, byte(r.IntN(3)), byte(r.IntN(4))})
+		if i%3 == 0 {
+			addrs[i] = netip.AddrFrom4([4]byte{10, 0, byte(r.IntN(256)), byte(r.IntN(256))})
+		}
+	}
+	addrs = append(addrs, netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1"))
+
+	return s, addrs
+}
+
+func assertBatch(t *testing.T, s *ipstore.Store[int], addrs []netip.Addr, out []ipstore.Result[int]) {
+	t.Helper()
+
+	for i, addr := range addrs {
+		v, ok := s.GetOne(addr)
+		if out[i].Found != ok || out[i].Value != v {
+			t.Fatalf("expected %d, %t for %s; got %d, %t", v, ok, addr, out[i].Value, out[i].Found)
+		}
+	}
+}
+
+func TestLookupBatch(t *testing.T) {
+	for _, b := range backends {
+		t.Run(b.String(), func(t *testing.T) {
+			s, addrs := batchStore(t, 1000, ipstore.WithBackend(b))
+
+			out := make([]ipstore.Result[int], len(addrs))
+			s.LookupBatch(addrs, out)
+			assertBatch(t, s, addrs, out)
+
+			clear(out)
+			s.LookupBatch(addrs, out, ipstore.WithSort())
+			assertBatch(t, s, addrs, out)
+		})
+	}
+}
+
+func TestLookupBatchResult(t *testing.T) {
+	s, _ := batchStore(t, 0)
+	addrs := []netip.Addr{netip.MustParseAddr("10.0.1.2"), netip.MustParseAddr("192.0.2.1")}
+
+	out := make([]ipstore.Result[int], 3)
+	out[1] = ipstore.Result[int]{Value: 42, Found: true}
+	s.LookupBatch(addrs, out)
+
+	if out[0].Value != 3 || !out[0].Found {
+		t.Errorf("expected 3; got %v", out[0])
+	}
+	if out[1] != (ipstore.Result[int]{}) {
+		t.Errorf("expected no result; got %v", out[1])
+	}
+}
+
+func TestLookupBatchZones(t *testing.T) {
+	s := ipstore.New[int](ipstore.WithZonePolicy(ipstore.ZoneReject))
+	if err := s.AddIPOrCIDR("fe80::/64", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	addrs := []netip.Addr{netip.MustParseAddr("fe80::1"), netip.MustParseAddr("fe80::1%eth0")}
+	out := make([]ipstore.Result[int], len(addrs))
+	s.LookupBatch(addrs, out)
+	if !out[0].Found || out[1].Found {
+		t.Errorf("expected only the address without zone to be found; got %v", out)
+	}
+}
+
+func TestLookupBatchShortOutput(t *testing.T) {
+	s, addrs := batchStore(t, 10)
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected a panic")
+		}
+	}()
+	s.LookupBatch(addrs, make([]ipstore.Result[int], 1))
+}
+
+func TestLookupBatchParallel(t *testing.T) {
+	s, addrs := batchStore(t, 50000)
+
+	for _, workers := range []int{0, 1, 3, 64} {
+		out := make([]ipstore.Result[int], len(addrs))
+		s.LookupBatchParallel(addrs, out, workers)
+		assertBatch(t, s, addrs, out)
+
+		clear(out)
+		s.LookupBatchParallel(addrs, out, workers, ipstore.WithSort())
+		assertBatch(t, s, addrs, out)
+	}
+}
+
+func BenchmarkLookupBatch(b *testing.B) {
+	s, addrs := batchStore(b, 100000)
+	out := make([]ipstore.Result[int], len(addrs))
+
+	b.Run("GetOne", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			for i, addr := range addrs {
+				out[i].Value, out[i].Found = s.GetOne(addr)
+			}
+		}
+	})
+	b.Run("Batch", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			s.LookupBatch(addrs, out)
+		}
+	})
+	b.Run("BatchSorted", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			s.LookupBatch(addrs, out, ipstore.WithSort())
+		}
+	})
+	b.Run("Parallel", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			s.LookupBatchParallel(addrs, out, 0)
+		}
+	})
+}
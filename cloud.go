@@ -0,0 +1,212 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+)
+
+// CloudProvider identifies a cloud provider.
+type CloudProvider string
+
+const (
+	AWS        CloudProvider = "aws"
+	GCP        CloudProvider = "gcp"
+	Azure      CloudProvider = "azure"
+	Cloudflare CloudProvider = "cloudflare"
+	Fastly     CloudProvider = "fastly"
+)
+
+// CloudRange describes an IP range published by a cloud provider.
+type CloudRange struct {
+	Provider CloudProvider
+	Region   string
+	Service  string
+}
+
+// CloudLoader loads IP ranges published by a cloud provider from r into
+// the [Store].
+type CloudLoader func(s *Store[CloudRange], r io.Reader) error
+
+// LoadCloudFile loads the IP ranges in the file at path into the [Store]
+// using the [CloudLoader] provided, e.g. [LoadAWS].
+func LoadCloudFile(s *Store[CloudRange], path string, load CloudLoader) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return load(s, f)
+}
+
+// LoadAWS loads the ranges in the AWS ip-ranges.json format. AWS lists
+// prefixes once for the AMAZON service and again for the specific service
+// using them; the specific service is stored, regardless of the order.
+func LoadAWS(s *Store[CloudRange], r io.Reader) error {
+	var doc struct {
+		Prefixes []struct {
+			IPPrefix string `json:"ip_prefix"`
+			Region   string `json:"region"`
+			Service  string `json:"service"`
+		} `json:"prefixes"`
+		IPv6Prefixes []struct {
+			IPv6Prefix string `json:"ipv6_prefix"`
+			Region     string `json:"region"`
+			Service    string `json:"service"`
+		} `json:"ipv6_prefixes"`
+	}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return fmt.Errorf("failed decoding AWS ranges: %w", err)
+	}
+
+	for _, p := range doc.Prefixes {
+		if err := addAWSRange(s, p.IPPrefix, CloudRange{Provider: AWS, Region: p.Region, Service: p.Service}); err != nil {
+			return err
+		}
+	}
+	for _, p := range doc.IPv6Prefixes {
+		if err := addAWSRange(s, p.IPv6Prefix, CloudRange{Provider: AWS, Region: p.Region, Service: p.Service}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// LoadGCP loads the ranges in the Google Cloud cloud.json format.
+func LoadGCP(s *Store[CloudRange], r io.Reader) error {
+	var doc struct {
+		Prefixes []struct {
+			IPv4Prefix string `json:"ipv4Prefix"`
+			IPv6Prefix string `json:"ipv6Prefix"`
+			Service    string `json:"service"`
+			Scope      string `json:"scope"`
+		} `json:"prefixes"`
+	}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return fmt.Errorf("failed decoding GCP ranges: %w", err)
+	}
+
+	for _, p := range doc.Prefixes {
+		prf := p.IPv4Prefix
+		if prf == "" {
+			prf = p.IPv6Prefix
+		}
+		if err := addCloudRange(s, prf, CloudRange{Provider: GCP, Region: p.Scope, Service: p.Service}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// LoadAzure loads the ranges in the Azure Service Tags JSON format. The
+// service is taken from the system service of a tag, falling back to the
+// name of the tag for tags without one. Prefixes listed by a tag with a
+// system service and by one without, such as AzureCloud.westeurope, are
+// stored with the system service, regardless of the order.
+func LoadAzure(s *Store[CloudRange], r io.Reader) error {
+	var doc struct {
+		Values []struct {
+			Name       string `json:"name"`
+			Properties struct {
+				Region          string   `json:"region"`
+				SystemService   string   `json:"systemService"`
+				AddressPrefixes []string `json:"addressPrefixes"`
+			} `json:"properties"`
+		} `json:"values"`
+	}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return fmt.Errorf("failed decoding Azure service tags: %w", err)
+	}
+
+	// tags without a system service are added first, so that the tags
+	// with one replace them.
+	for _, system := range []bool{false, true} {
+		for _, v := range doc.Values {
+			if (v.Properties.SystemService != "") != system {
+				continue
+			}
+			service := v.Properties.SystemService
+			if service == "" {
+				service = v.Name
+			}
+			for _, prf := range v.Properties.AddressPrefixes {
+				if err := addCloudRange(s, prf, CloudRange{Provider: Azure, Region: v.Properties.Region, Service: service}); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// LoadCloudflare loads the ranges in the Cloudflare ips-v4 and ips-v6
+// text lists.
+func LoadCloudflare(s *Store[CloudRange], r io.Reader) error {
+	return LoadList(s, r, func(netip.Prefix, Annotation) CloudRange {
+		return CloudRange{Provider: Cloudflare}
+	})
+}
+
+// LoadFastly loads the ranges in the Fastly public-ip-list JSON format.
+func LoadFastly(s *Store[CloudRange], r io.Reader) error {
+	var doc struct {
+		Addresses     []string `json:"addresses"`
+		IPv6Addresses []string `json:"ipv6_addresses"`
+	}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return fmt.Errorf("failed decoding Fastly ranges: %w", err)
+	}
+
+	for _, prf := range append(doc.Addresses, doc.IPv6Addresses...) {
+		if err := addCloudRange(s, prf, CloudRange{Provider: Fastly}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addAWSRange adds the AWS range, keeping the specific service when the
+// prefix is listed for the AMAZON service as well.
+func addAWSRange(s *Store[CloudRange], ipOrCIDR string, value CloudRange) error {
+	prf, err := parsePrefix(ipOrCIDR)
+	if err != nil {
+		return fmt.Errorf("invalid %s range %q: %w", value.Provider, ipOrCIDR, err)
+	}
+
+	return s.AddMerge(prf, value, func(old, new CloudRange) CloudRange {
+		if new.Service == "AMAZON" {
+			return old
+		}
+		return new
+	})
+}
+
+func addCloudRange(s *Store[CloudRange], ipOrCIDR string, value CloudRange) error {
+	prf, err := parsePrefix(ipOrCIDR)
+	if err != nil {
+		return fmt.Errorf("invalid %s range %q: %w", value.Provider, ipOrCIDR, err)
+	}
+
+	return s.AddCIDR(prf, value)
+}
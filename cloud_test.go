@@ -0,0 +1,148 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipstore_test
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/hslatman/ipstore"
+)
+
+func loadCloud(t *testing.T, path string, load ipstore.CloudLoader) *ipstore.Store[ipstore.CloudRange] {
+	t.Helper()
+
+	s := ipstore.New[ipstore.CloudRange]()
+	if err := ipstore.LoadCloudFile(s, path, load); err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func expectCloudRange(t *testing.T, s *ipstore.Store[ipstore.CloudRange], ip string, expected ipstore.CloudRange) {
+	t.Helper()
+
+	v, ok := s.GetOne(netip.MustParseAddr(ip))
+	if !ok {
+		t.Errorf("expected %s to be in store", ip)
+		return
+	}
+	if v != expected {
+		t.Errorf("expected %#+v for %s; got %#+v", expected, ip, v)
+	}
+}
+
+func TestLoadAWS(t *testing.T) {
+	s := loadCloud(t, "testdata/cloud/aws-ip-ranges.json", ipstore.LoadAWS)
+	if s.Len() != 3 {
+		t.Errorf("expected 3 entries; got %d", s.Len())
+	}
+
+	expectCloudRange(t, s, "3.2.34.1", ipstore.CloudRange{Provider: ipstore.AWS, Region: "af-south-1", Service: "AMAZON"})
+	expectCloudRange(t, s, "3.5.141.1", ipstore.CloudRange{Provider: ipstore.AWS, Region: "ap-northeast-2", Service: "S3"})
+	expectCloudRange(t, s, "2600:1f14:fff:f800::1", ipstore.CloudRange{Provider: ipstore.AWS, Region: "us-west-2", Service: "ROUTE53_HEALTHCHECKS"})
+}
+
+func TestLoadAWSServiceOrder(t *testing.T) {
+	s := ipstore.New[ipstore.CloudRange]()
+	doc := `{
+		"prefixes": [
+			{"ip_prefix": "3.5.140.0/22", "region": "ap-northeast-2", "service": "S3"},
+			{"ip_prefix": "3.5.140.0/22", "region": "ap-northeast-2", "service": "AMAZON"}
+		],
+		"ipv6_prefixes": [
+			{"ipv6_prefix": "2600:1f14:fff:f800::/56", "region": "us-west-2", "service": "ROUTE53_HEALTHCHECKS"},
+			{"ipv6_prefix": "2600:1f14:fff:f800::/56", "region": "us-west-2", "service": "AMAZON"}
+		]
+	}`
+	if err := ipstore.LoadAWS(s, strings.NewReader(doc)); err != nil {
+		t.Fatal(err)
+	}
+
+	expectCloudRange(t, s, "3.5.141.1", ipstore.CloudRange{Provider: ipstore.AWS, Region: "ap-northeast-2", Service: "S3"})
+	expectCloudRange(t, s, "2600:1f14:fff:f800::1", ipstore.CloudRange{Provider: ipstore.AWS, Region: "us-west-2", Service: "ROUTE53_HEALTHCHECKS"})
+}
+
+func TestLoadAzureServiceOrder(t *testing.T) {
+	s := ipstore.New[ipstore.CloudRange]()
+	doc := `{
+		"values": [
+			{"name": "ActionGroup", "properties": {"systemService": "ActionGroup", "addressPrefixes": ["4.145.74.52/30"]}},
+			{"name": "AzureCloud.westeurope", "properties": {"region": "westeurope", "addressPrefixes": ["4.145.74.52/30", "13.69.0.0/17"]}}
+		]
+	}`
+	if err := ipstore.LoadAzure(s, strings.NewReader(doc)); err != nil {
+		t.Fatal(err)
+	}
+
+	expectCloudRange(t, s, "4.145.74.53", ipstore.CloudRange{Provider: ipstore.Azure, Service: "ActionGroup"})
+	expectCloudRange(t, s, "13.69.1.1", ipstore.CloudRange{Provider: ipstore.Azure, Region: "westeurope", Service: "AzureCloud.westeurope"})
+}
+
+func TestLoadGCP(t *testing.T) {
+	s := loadCloud(t, "testdata/cloud/gcp-cloud.json", ipstore.LoadGCP)
+	if s.Len() != 3 {
+		t.Errorf("expected 3 entries; got %d", s.Len())
+	}
+
+	expectCloudRange(t, s, "34.35.1.1", ipstore.CloudRange{Provider: ipstore.GCP, Region: "africa-south1", Service: "Google Cloud"})
+	expectCloudRange(t, s, "2600:1900:8000::1", ipstore.CloudRange{Provider: ipstore.GCP, Region: "us-central1", Service: "Google Cloud"})
+}
+
+func TestLoadAzure(t *testing.T) {
+	s := loadCloud(t, "testdata/cloud/azure-servicetags.json", ipstore.LoadAzure)
+	if s.Len() != 3 {
+		t.Errorf("expected 3 entries; got %d", s.Len())
+	}
+
+	expectCloudRange(t, s, "4.145.74.53", ipstore.CloudRange{Provider: ipstore.Azure, Service: "ActionGroup"})
+	expectCloudRange(t, s, "2603:1030:c06:400::979", ipstore.CloudRange{Provider: ipstore.Azure, Service: "ActionGroup"})
+	expectCloudRange(t, s, "13.69.1.1", ipstore.CloudRange{Provider: ipstore.Azure, Region: "westeurope", Service: "AzureCloud.westeurope"})
+}
+
+func TestLoadCloudflare(t *testing.T) {
+	s := loadCloud(t, "testdata/cloud/cloudflare-ips.txt", ipstore.LoadCloudflare)
+	if s.Len() != 3 {
+		t.Errorf("expected 3 entries; got %d", s.Len())
+	}
+
+	expectCloudRange(t, s, "173.245.48.1", ipstore.CloudRange{Provider: ipstore.Cloudflare})
+	expectCloudRange(t, s, "2400:cb00::1", ipstore.CloudRange{Provider: ipstore.Cloudflare})
+}
+
+func TestLoadFastly(t *testing.T) {
+	s := loadCloud(t, "testdata/cloud/fastly-public-ip-list.json", ipstore.LoadFastly)
+	if s.Len() != 3 {
+		t.Errorf("expected 3 entries; got %d", s.Len())
+	}
+
+	expectCloudRange(t, s, "43.249.72.1", ipstore.CloudRange{Provider: ipstore.Fastly})
+	expectCloudRange(t, s, "2a04:4e40::1", ipstore.CloudRange{Provider: ipstore.Fastly})
+}
+
+func TestLoadCloudErrors(t *testing.T) {
+	s := ipstore.New[ipstore.CloudRange]()
+	if err := ipstore.LoadAWS(s, strings.NewReader(`{"prefixes": [{"ip_prefix": "3.2.34.0/33"}]}`)); err == nil {
+		t.Error("expected error for invalid prefix")
+	}
+	if err := ipstore.LoadGCP(s, strings.NewReader(`{`)); err == nil {
+		t.Error("expected error for invalid JSON")
+	}
+	if err := ipstore.LoadCloudFile(s, "testdata/cloud/non-existing.json", ipstore.LoadFastly); err == nil {
+		t.Error("expected error for non-existing file")
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/hslatman/ipstore"
+)
+
+// format is a file format lists can be read from and written in.
+type format string
+
+const (
+	formatText     format = "text"
+	formatJSON     format = "json"
+	formatCSV      format = "csv"
+	formatSnapshot format = "snapshot"
+)
+
+func parseFormat(s string) (format, error) {
+	switch f := format(s); f {
+	case formatText, formatJSON, formatCSV, formatSnapshot:
+		return f, nil
+	default:
+		return "", fmt.Errorf("unknown format %q", s)
+	}
+}
+
+// detectFormat returns the format for the file at path based on its
+// extension, defaulting to the text format.
+func detectFormat(path string) format {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return formatJSON
+	case ".csv":
+		return formatCSV
+	case ".snap", ".snapshot", ".ipst":
+		return formatSnapshot
+	default:
+		return formatText
+	}
+}
+
+// entry is the representation of an entry in JSON output.
+type entry struct {
+	Prefix netip.Prefix `json:"prefix"`
+	Value  string       `json:"value,omitempty"`
+}
+
+// loadFile reads the list at path, or stdin when path is "-", in the
+// format provided. The format is detected from the file extension when
+// it's empty.
+func loadFile(path string, f format, stdin io.Reader) (*ipstore.Store[string], error) {
+	if f == "" {
+		f = detectFormat(path)
+	}
+
+	r := stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	s, err := readList(r, f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return s, nil
+}
+
+func readList(r io.Reader, f format) (*ipstore.Store[string], error) {
+	s := ipstore.New[string]()
+	switch f {
+	case formatText:
+		return s, ipstore.LoadList(s, r, func(_ netip.Prefix, a ipstore.Annotation) string {
+			return a.Comment
+		})
+	case formatJSON:
+		var entries []entry
+		if err := json.NewDecoder(r).Decode(&entries); err != nil {
+			return nil, err
+		}
+		for i, e := range entries {
+			if !e.Prefix.IsValid() {
+				return nil, fmt.Errorf("entry %d: missing or invalid prefix", i)
+			}
+			if err := s.AddCIDR(e.Prefix, e.Value); err != nil {
+				return nil, err
+			}
+		}
+		return s, nil
+	case formatCSV:
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = -1
+		for {
+			record, err := cr.Read()
+			if errors.Is(err, io.EOF) {
+				return s, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			if record[0] == "prefix" {
+				continue // header
+			}
+			value := ""
+			if len(record) > 1 {
+				value = record[1]
+			}
+			if err := s.AddIPOrCIDR(record[0], value); err != nil {
+				line, _ := cr.FieldPos(0)
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+		}
+	case formatSnapshot:
+		return s, s.ReadSnapshot(r, ipstore.StringCodec{})
+	default:
+		return nil, fmt.Errorf("unknown format %q", f)
+	}
+}
+
+func writeList(w io.Writer, s *ipstore.Store[string], f format) error {
+	entries := sortedEntries(s)
+	switch f {
+	case formatText:
+		// values can't be escaped in text lists, so the ones that wouldn't
+		// be read back as is are rejected.
+		for _, e := range entries {
+			if strings.ContainsAny(e.Value, "\r\n#;") || strings.TrimSpace(e.Value) != e.Value {
+				return fmt.Errorf("value %q for %s can't be written as text", e.Value, e.Prefix)
+			}
+		}
+		bw := bufio.NewWriter(w)
+		for _, e := range entries {
+			if e.Value != "" {
+				fmt.Fprintf(bw, "%s # %s\n", e.Prefix, e.Value)
+			} else {
+				fmt.Fprintln(bw, e.Prefix)
+			}
+		}
+		return bw.Flush()
+	case formatJSON:
+		return writeJSON(w, entries)
+	case formatCSV:
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"prefix", "value"})
+		for _, e := range entries {
+			cw.Write([]string{e.Prefix.String(), e.Value})
+		}
+		cw.Flush()
+		return cw.Error()
+	case formatSnapshot:
+		return s.WriteSnapshot(w, ipstore.StringCodec{})
+	default:
+		return fmt.Errorf("unknown format %q", f)
+	}
+}
+
+func sortedEntries(s *ipstore.Store[string]) []entry {
+	entries := make([]entry, 0, s.Len())
+	for prf, v := range s.All() {
+		entries = append(entries, entry{Prefix: prf, Value: v})
+	}
+	slices.SortFunc(entries, func(a, b entry) int {
+		if c := a.Prefix.Addr().Compare(b.Prefix.Addr()); c != 0 {
+			return c
+		}
+		return a.Prefix.Bits() - b.Prefix.Bits()
+	})
+
+	return entries
+}
+
+func writeJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
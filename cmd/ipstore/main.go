@@ -0,0 +1,541 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command ipstore queries, converts and compares lists of IPs and CIDRs
+// using the same matching semantics as the ipstore package.
+//
+// Usage:
+//
+//	ipstore lookup [-json] [-format f] <list> <ip-or-cidr>...
+//	ipstore convert [-from f] [-to f] [-o out] <list>
+//	ipstore diff [-json] [-format f] <old-list> <new-list>
+//	ipstore aggregate [-json] [-format f] <list>
+//	ipstore stats [-json] [-format f] <list>
+//	ipstore serve [-addr a] [-admin-token t] [-insecure-admin] [-format f] <list>
+//
+// Lists are read in the text, json, csv or snapshot format, detected from
+// the file extension unless provided explicitly. A list of "-" is read
+// from stdin. The load command is an alias for convert. Values printed by
+// diff are quoted as Go strings when they contain whitespace, quotes,
+// comment characters or unprintable characters.
+//
+// The exit status is 0 on success and 2 on errors. Lookups exit with 1
+// when a query doesn't match any entry, and diffs exit with 1 when the
+// lists differ.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"math/big"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode"
+
+	"github.com/hslatman/ipstore"
+	"github.com/hslatman/ipstore/server"
+)
+
+const usage = `usage: ipstore <command> [flags] [args]
+
+commands:
+  lookup     print the entries matching IPs or CIDRs
+  convert    convert a list to another format (alias: load)
+  diff       print the differences between two lists
+  aggregate  print the minimal set of CIDRs covering a list
+  stats      print statistics about a list
+  serve      serve lookups in a list over HTTP
+`
+
+// errMismatch signals a lookup without matches or a non-empty diff.
+var errMismatch = errors.New("mismatch")
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+
+	var cmd func(args []string, stdin io.Reader, stdout io.Writer) error
+	switch args[0] {
+	case "lookup":
+		cmd = lookup
+	case "convert", "load":
+		cmd = convert
+	case "diff":
+		cmd = diff
+	case "aggregate":
+		cmd = aggregate
+	case "stats":
+		cmd = stats
+	case "serve":
+		cmd = serve
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, usage)
+		return 0
+	default:
+		fmt.Fprintf(stderr, "ipstore: unknown command %q\n\n%s", args[0], usage)
+		return 2
+	}
+
+	err := cmd(args[1:], stdin, stdout)
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, errMismatch):
+		return 1
+	case errors.Is(err, flag.ErrHelp):
+		return 0
+	default:
+		fmt.Fprintf(stderr, "ipstore %s: %v\n", args[0], err)
+		return 2
+	}
+}
+
+func newFlagSet(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: ipstore %s %s\n", name, args)
+		fs.PrintDefaults()
+	}
+
+	return fs
+}
+
+// parseFlags parses the flags, printing usage information to stdout when
+// requested.
+func parseFlags(fs *flag.FlagSet, args []string, stdout io.Writer) error {
+	err := fs.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		fs.SetOutput(stdout)
+		fs.Usage()
+	}
+
+	return err
+}
+
+func formatFlag(fs *flag.FlagSet, name, usage string) *string {
+	return fs.String(name, "", usage+" (text, json, csv or snapshot; detected from extension by default)")
+}
+
+func optionalFormat(s string) (format, error) {
+	if s == "" {
+		return "", nil
+	}
+
+	return parseFormat(s)
+}
+
+type match struct {
+	Prefix netip.Prefix `json:"prefix"`
+	Value  string       `json:"value,omitempty"`
+}
+
+type lookupResult struct {
+	Query   string  `json:"query"`
+	Matches []match `json:"matches"`
+}
+
+func lookup(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := newFlagSet("lookup", "[-json] [-format f] <list> <ip-or-cidr>...")
+	asJSON := fs.Bool("json", false, "print results as JSON")
+	formatName := formatFlag(fs, "format", "format of the list")
+	if err := parseFlags(fs, args, stdout); err != nil {
+		return err
+	}
+	if fs.NArg() < 2 {
+		return errors.New("a list and at least one IP or CIDR are required")
+	}
+
+	f, err := optionalFormat(*formatName)
+	if err != nil {
+		return err
+	}
+	s, err := loadFile(fs.Arg(0), f, stdin)
+	if err != nil {
+		return err
+	}
+
+	results := make([]lookupResult, 0, fs.NArg()-1)
+	for _, q := range fs.Args()[1:] {
+		prf, err := parseQuery(q)
+		if err != nil {
+			return err
+		}
+		r := lookupResult{Query: q, Matches: []match{}}
+		for p, v := range s.Supernets(prf) {
+			r.Matches = append(r.Matches, match{Prefix: p, Value: v})
+		}
+		results = append(results, r)
+	}
+
+	if *asJSON {
+		if err := writeJSON(stdout, results); err != nil {
+			return err
+		}
+	} else {
+		for _, r := range results {
+			for _, m := range r.Matches {
+				fmt.Fprintf(stdout, "%s\t%s\t%s\n", r.Query, m.Prefix, m.Value)
+			}
+		}
+	}
+
+	for _, r := range results {
+		if len(r.Matches) == 0 {
+			return errMismatch
+		}
+	}
+
+	return nil
+}
+
+func parseQuery(q string) (netip.Prefix, error) {
+	if addr, err := netip.ParseAddr(q); err == nil {
+		return addr.Prefix(addr.BitLen())
+	}
+
+	prf, err := netip.ParsePrefix(q)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid IP or CIDR %q", q)
+	}
+
+	return prf, nil
+}
+
+func convert(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := newFlagSet("convert", "[-from f] [-to f] [-o out] <list>")
+	from := formatFlag(fs, "from", "format of the input list")
+	to := formatFlag(fs, "to", "format of the output list")
+	out := fs.String("o", "-", "file to write the output to")
+	if err := parseFlags(fs, args, stdout); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("a single list is required")
+	}
+
+	ff, err := optionalFormat(*from)
+	if err != nil {
+		return err
+	}
+	tf, err := optionalFormat(*to)
+	if err != nil {
+		return err
+	}
+	if tf == "" {
+		tf = formatText
+		if *out != "-" {
+			tf = detectFormat(*out)
+		}
+	}
+
+	s, err := loadFile(fs.Arg(0), ff, stdin)
+	if err != nil {
+		return err
+	}
+
+	if *out == "-" {
+		return writeList(stdout, s, tf)
+	}
+
+	file, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if err := writeList(file, s, tf); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+type change struct {
+	Change string       `json:"change"`
+	Prefix netip.Prefix `json:"prefix"`
+	Old    *string      `json:"old,omitempty"`
+	New    *string      `json:"new,omitempty"`
+}
+
+func diff(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := newFlagSet("diff", "[-json] [-format f] <old-list> <new-list>")
+	asJSON := fs.Bool("json", false, "print changes as JSON")
+	formatName := formatFlag(fs, "format", "format of the lists")
+	if err := parseFlags(fs, args, stdout); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return errors.New("two lists are required")
+	}
+	if fs.Arg(0) == "-" && fs.Arg(1) == "-" {
+		return errors.New("only one of the lists can be read from stdin")
+	}
+
+	f, err := optionalFormat(*formatName)
+	if err != nil {
+		return err
+	}
+	a, err := loadFile(fs.Arg(0), f, stdin)
+	if err != nil {
+		return err
+	}
+	b, err := loadFile(fs.Arg(1), f, stdin)
+	if err != nil {
+		return err
+	}
+
+	changes := ipstore.Diff(a, b, func(x, y string) bool { return x == y })
+	if *asJSON {
+		result := make([]change, 0, len(changes))
+		for _, c := range changes {
+			r := change{Change: c.Kind.String(), Prefix: c.Prefix}
+			if c.Kind != ipstore.Added {
+				r.Old = &c.Old
+			}
+			if c.Kind != ipstore.Removed {
+				r.New = &c.New
+			}
+			result = append(result, r)
+		}
+		if err := writeJSON(stdout, result); err != nil {
+			return err
+		}
+	} else {
+		for _, c := range changes {
+			switch c.Kind {
+			case ipstore.Added:
+				fmt.Fprintf(stdout, "+ %s\t%s\n", c.Prefix, quoteValue(c.New))
+			case ipstore.Removed:
+				fmt.Fprintf(stdout, "- %s\t%s\n", c.Prefix, quoteValue(c.Old))
+			case ipstore.Modified:
+				fmt.Fprintf(stdout, "~ %s\t%s -> %s\n", c.Prefix, quoteValue(c.Old), quoteValue(c.New))
+			}
+		}
+	}
+
+	if len(changes) > 0 {
+		return errMismatch
+	}
+
+	return nil
+}
+
+// quoteValue quotes v as a Go string when it can't be printed as is
+// without becoming ambiguous.
+func quoteValue(v string) string {
+	if strings.ContainsFunc(v, func(r rune) bool {
+		return unicode.IsSpace(r) || !unicode.IsPrint(r) || strings.ContainsRune(`"\#;`, r)
+	}) {
+		return strconv.Quote(v)
+	}
+
+	return v
+}
+
+func aggregate(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := newFlagSet("aggregate", "[-json] [-format f] <list>")
+	asJSON := fs.Bool("json", false, "print CIDRs as JSON")
+	formatName := formatFlag(fs, "format", "format of the list")
+	if err := parseFlags(fs, args, stdout); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("a single list is required")
+	}
+
+	f, err := optionalFormat(*formatName)
+	if err != nil {
+		return err
+	}
+	s, err := loadFile(fs.Arg(0), f, stdin)
+	if err != nil {
+		return err
+	}
+
+	var all []netip.Prefix
+	for prf := range s.All() {
+		all = append(all, prf)
+	}
+
+	prefixes := ipstore.Aggregate(slices.Values(all))
+
+	if *asJSON {
+		if prefixes == nil {
+			prefixes = []netip.Prefix{}
+		}
+		return writeJSON(stdout, prefixes)
+	}
+
+	for _, prf := range prefixes {
+		fmt.Fprintln(stdout, prf)
+	}
+
+	return nil
+}
+
+type statistics struct {
+	Entries       int         `json:"entries"`
+	IPv4Entries   int         `json:"ipv4_entries"`
+	IPv6Entries   int         `json:"ipv6_entries"`
+	Aggregated    int         `json:"aggregated"`
+	IPv4Addresses *big.Int    `json:"ipv4_addresses"`
+	IPv6Addresses *big.Int    `json:"ipv6_addresses"`
+	IPv4Lengths   map[int]int `json:"ipv4_prefix_lengths"`
+	IPv6Lengths   map[int]int `json:"ipv6_prefix_lengths"`
+}
+
+func stats(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := newFlagSet("stats", "[-json] [-format f] <list>")
+	asJSON := fs.Bool("json", false, "print statistics as JSON")
+	formatName := formatFlag(fs, "format", "format of the list")
+	if err := parseFlags(fs, args, stdout); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("a single list is required")
+	}
+
+	f, err := optionalFormat(*formatName)
+	if err != nil {
+		return err
+	}
+	s, err := loadFile(fs.Arg(0), f, stdin)
+	if err != nil {
+		return err
+	}
+
+	st := statistics{
+		IPv4Addresses: new(big.Int),
+		IPv6Addresses: new(big.Int),
+		IPv4Lengths:   make(map[int]int),
+		IPv6Lengths:   make(map[int]int),
+	}
+	var all []netip.Prefix
+	for prf := range s.All() {
+		st.Entries++
+		all = append(all, prf)
+		if prf.Addr().Is4() {
+			st.IPv4Entries++
+			st.IPv4Lengths[prf.Bits()]++
+		} else {
+			st.IPv6Entries++
+			st.IPv6Lengths[prf.Bits()]++
+		}
+	}
+
+	aggregated := ipstore.Aggregate(slices.Values(all))
+	st.Aggregated = len(aggregated)
+	for _, prf := range aggregated {
+		n := new(big.Int).Lsh(big.NewInt(1), uint(prf.Addr().BitLen()-prf.Bits()))
+		if prf.Addr().Is4() {
+			st.IPv4Addresses.Add(st.IPv4Addresses, n)
+		} else {
+			st.IPv6Addresses.Add(st.IPv6Addresses, n)
+		}
+	}
+
+	if *asJSON {
+		return writeJSON(stdout, st)
+	}
+
+	fmt.Fprintf(stdout, "entries:\t%d\n", st.Entries)
+	fmt.Fprintf(stdout, "ipv4 entries:\t%d\n", st.IPv4Entries)
+	fmt.Fprintf(stdout, "ipv6 entries:\t%d\n", st.IPv6Entries)
+	fmt.Fprintf(stdout, "aggregated:\t%d\n", st.Aggregated)
+	fmt.Fprintf(stdout, "ipv4 addresses:\t%s\n", st.IPv4Addresses)
+	fmt.Fprintf(stdout, "ipv6 addresses:\t%s\n", st.IPv6Addresses)
+	for _, family := range []struct {
+		name    string
+		lengths map[int]int
+	}{{"ipv4", st.IPv4Lengths}, {"ipv6", st.IPv6Lengths}} {
+		for _, l := range slices.Sorted(maps.Keys(family.lengths)) {
+			fmt.Fprintf(stdout, "%s /%d:\t%d\n", family.name, l, family.lengths[l])
+		}
+	}
+
+	return nil
+}
+
+func serve(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := newFlagSet("serve", "[-addr a] [-admin-token t] [-insecure-admin] [-format f] <list>")
+	addr := fs.String("addr", "localhost:8080", "address to listen on")
+	token := fs.String("admin-token", "", "bearer token required for adding and removing entries")
+	insecure := fs.Bool("insecure-admin", false, "allow adding and removing entries without an admin token")
+	formatName := formatFlag(fs, "format", "format of the list")
+	if err := parseFlags(fs, args, stdout); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("a single list is required")
+	}
+
+	f, err := optionalFormat(*formatName)
+	if err != nil {
+		return err
+	}
+	s, err := loadFile(fs.Arg(0), f, stdin)
+	if err != nil {
+		return err
+	}
+
+	var opts []server.Option
+	if *token != "" {
+		opts = append(opts, server.WithAdminToken(*token))
+	}
+	if *insecure {
+		opts = append(opts, server.WithUnauthenticatedAdmin())
+	}
+
+	// snapshots are served in the format the other commands read them in.
+	srv := &http.Server{
+		Addr:              *addr,
+		Handler:           server.NewWithCodecs(s, ipstore.JSONCodec[string]{}, ipstore.StringCodec{}, opts...),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.ListenAndServe()
+	}()
+	fmt.Fprintf(stdout, "serving %d entries on %s\n", s.Len(), *addr)
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return srv.Shutdown(shutdownCtx)
+	}
+}
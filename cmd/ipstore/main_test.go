@@ -0,0 +1,230 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func runCmd(t *testing.T, stdin string, args ...string) (string, int) {
+	t.Helper()
+
+	var stdout, stderr bytes.Buffer
+	code := run(args, strings.NewReader(stdin), &stdout, &stderr)
+	if code == 2 {
+		t.Logf("stderr: %s", stderr.String())
+	}
+
+	return stdout.String(), code
+}
+
+func TestLookup(t *testing.T) {
+	out, code := runCmd(t, "", "lookup", "testdata/drop.txt", "1.19.0.1")
+	if code != 0 {
+		t.Fatalf("expected exit code 0; got %d", code)
+	}
+	expected := "1.19.0.1\t1.19.0.0/24\tSBL434605\n1.19.0.1\t1.19.0.0/16\tSBL434604\n"
+	if out != expected {
+		t.Errorf("expected %q; got %q", expected, out)
+	}
+
+	out, code = runCmd(t, "", "lookup", "-json", "testdata/drop.txt", "2.56.193.0/24", "192.0.2.1")
+	if code != 1 {
+		t.Errorf("expected exit code 1 for query without matches; got %d", code)
+	}
+	var results []lookupResult
+	if err := json.Unmarshal([]byte(out), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results; got %d", len(results))
+	}
+	if len(results[0].Matches) != 1 || results[0].Matches[0].Value != "SBL459831" {
+		t.Errorf("unexpected matches %v", results[0].Matches)
+	}
+	if len(results[1].Matches) != 0 {
+		t.Errorf("expected no matches; got %v", results[1].Matches)
+	}
+
+	if _, code := runCmd(t, "", "lookup", "testdata/drop.txt", "not-an-ip"); code != 2 {
+		t.Errorf("expected exit code 2 for invalid query; got %d", code)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	dir := t.TempDir()
+	var expected string
+	for i, f := range []string{"text", "json", "csv", "snapshot"} {
+		out := filepath.Join(dir, "drop."+f)
+		if _, code := runCmd(t, "", "convert", "-to", f, "-o", out, "testdata/drop.txt"); code != 0 {
+			t.Fatalf("expected exit code 0 converting to %s; got %d", f, code)
+		}
+
+		text, code := runCmd(t, "", "load", "-from", f, out)
+		if code != 0 {
+			t.Fatalf("expected exit code 0 converting from %s; got %d", f, code)
+		}
+		if i == 0 {
+			expected = text
+		}
+		if text != expected {
+			t.Errorf("expected round trip through %s to result in %q; got %q", f, expected, text)
+		}
+	}
+
+	if !strings.HasPrefix(expected, "1.10.16.0/20 # SBL256894\n") {
+		t.Errorf("unexpected text output %q", expected)
+	}
+
+	out, code := runCmd(t, "1.1.1.1\n2.2.2.2/31\n", "convert", "-to", "json", "-")
+	if code != 0 {
+		t.Fatalf("expected exit code 0; got %d", code)
+	}
+	var entries []entry
+	if err := json.Unmarshal([]byte(out), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("expected 2 entries; got %d", len(entries))
+	}
+
+	if _, code := runCmd(t, "", "convert", "-to", "xml", "testdata/drop.txt"); code != 2 {
+		t.Errorf("expected exit code 2 for unknown format; got %d", code)
+	}
+
+	for _, v := range []string{"a\nb", "a # b", " a"} {
+		list, _ := json.Marshal([]entry{{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Value: v}})
+		if _, code := runCmd(t, string(list), "convert", "-from", "json", "-to", "text", "-"); code != 2 {
+			t.Errorf("expected exit code 2 for value %q; got %d", v, code)
+		}
+	}
+	if _, code := runCmd(t, `[{"value": "x"}]`, "convert", "-from", "json", "-to", "text", "-"); code != 2 {
+		t.Errorf("expected exit code 2 for a missing prefix; got %d", code)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	out, code := runCmd(t, "", "diff", "testdata/drop.txt", "testdata/drop-new.txt")
+	if code != 1 {
+		t.Errorf("expected exit code 1 for lists that differ; got %d", code)
+	}
+	expected := `~ 1.19.0.0/16	SBL434604 -> SBL434699
+- 1.19.0.0/24	SBL434605
++ 203.0.113.0/24	SBL000002
+- 2001:db8::/32	SBL000001
+`
+	if out != expected {
+		t.Errorf("expected %q; got %q", expected, out)
+	}
+
+	out, _ = runCmd(t, "", "diff", "-json", "testdata/drop.txt", "testdata/drop-new.txt")
+	var changes []change
+	if err := json.Unmarshal([]byte(out), &changes); err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 4 {
+		t.Fatalf("expected 4 changes; got %d", len(changes))
+	}
+	if changes[2].Change != "added" || changes[2].Old != nil || *changes[2].New != "SBL000002" {
+		t.Errorf("unexpected change %#+v", changes[2])
+	}
+
+	if _, code := runCmd(t, "", "diff", "testdata/drop.txt", "testdata/drop.txt"); code != 0 {
+		t.Errorf("expected exit code 0 for equal lists; got %d", code)
+	}
+
+	if _, code := runCmd(t, "", "diff", "-", "-"); code != 2 {
+		t.Errorf("expected exit code 2 for reading both lists from stdin; got %d", code)
+	}
+
+	dir := t.TempDir()
+	oldList, newList := filepath.Join(dir, "old"), filepath.Join(dir, "new")
+	if err := os.WriteFile(oldList, []byte(`[{"prefix": "10.0.0.0/8", "value": "a -> b"}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(newList, []byte(`[{"prefix": "10.0.0.0/8", "value": "c # d"}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	out, code = runCmd(t, "", "diff", "-format", "json", oldList, newList)
+	if code != 1 {
+		t.Errorf("expected exit code 1 for lists that differ; got %d", code)
+	}
+	if expected := "~ 10.0.0.0/8\t\"a -> b\" -> \"c # d\"\n"; out != expected {
+		t.Errorf("expected %q; got %q", expected, out)
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	out, code := runCmd(t, "", "aggregate", "testdata/drop.txt")
+	if code != 0 {
+		t.Fatalf("expected exit code 0; got %d", code)
+	}
+	expected := "1.10.16.0/20\n1.19.0.0/16\n2.56.192.0/21\n2001:db8::/32\n"
+	if out != expected {
+		t.Errorf("expected %q; got %q", expected, out)
+	}
+}
+
+func TestStats(t *testing.T) {
+	out, code := runCmd(t, "", "stats", "-json", "testdata/drop.txt")
+	if code != 0 {
+		t.Fatalf("expected exit code 0; got %d", code)
+	}
+
+	var st statistics
+	if err := json.Unmarshal([]byte(out), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Entries != 6 || st.IPv4Entries != 5 || st.IPv6Entries != 1 || st.Aggregated != 4 {
+		t.Errorf("unexpected statistics %#+v", st)
+	}
+	if st.IPv4Addresses.Int64() != 4096+65536+2048 {
+		t.Errorf("expected %d IPv4 addresses; got %s", 4096+65536+2048, st.IPv4Addresses)
+	}
+	if st.IPv4Lengths[22] != 2 {
+		t.Errorf("expected 2 /22 prefixes; got %d", st.IPv4Lengths[22])
+	}
+}
+
+func TestServe(t *testing.T) {
+	if _, code := runCmd(t, "", "serve"); code != 2 {
+		t.Errorf("expected exit code 2 without list; got %d", code)
+	}
+	if _, code := runCmd(t, "", "serve", "-addr", "invalid:address:1", "testdata/drop.txt"); code != 2 {
+		t.Errorf("expected exit code 2 for invalid address; got %d", code)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	if _, code := runCmd(t, ""); code != 2 {
+		t.Errorf("expected exit code 2 without command; got %d", code)
+	}
+	if _, code := runCmd(t, "", "unknown"); code != 2 {
+		t.Errorf("expected exit code 2 for unknown command; got %d", code)
+	}
+	out, code := runCmd(t, "", "lookup", "-h")
+	if code != 0 {
+		t.Errorf("expected exit code 0 for help; got %d", code)
+	}
+	if !strings.HasPrefix(out, "usage: ipstore lookup") {
+		t.Errorf("unexpected usage %q", out)
+	}
+}
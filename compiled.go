@@ -0,0 +1,479 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"iter"
+	"net/netip"
+	"os"
+)
+
+// The compiled format consists of a header, followed by the IPv4 entries,
+// the IPv6 entries and the values. All integers are little endian.
+//
+// The header holds the magic, the number of IPv4 and IPv6 entries, the
+// length of the values section, bitmaps of the prefix lengths in use for
+// IPv4 and IPv6, and a CRC32 checksum of everything after the header.
+//
+// Entries are sorted by address and prefix length, and consist of the
+// address, the prefix length and padding up to a multiple of 8 bytes,
+// followed by the offset and length of the encoded value. Entries with
+// equal encoded values share the value.
+const (
+	compiledHeaderSize = 80
+
+	compiledEntrySize4 = 24
+	compiledEntrySize6 = 40
+)
+
+var compiledMagic = [8]byte{'I', 'P', 'S', 'T', 'M', 'A', 'P', 1}
+
+// ErrInvalidCompiled is returned when opening a compiled store that is
+// malformed or corrupted.
+var ErrInvalidCompiled = errors.New("invalid compiled store")
+
+// Compile writes the entries in the [Store] to w in a read-only format
+// that can be queried in place using [OpenCompiled], encoding values
+// using the [Codec] provided.
+func (s *Store[T]) Compile(w io.Writer, c Codec[T]) error {
+	s.mu.RLock()
+	table := s.table.Clone()
+	s.mu.RUnlock()
+
+	return compile(w, c, table)
+}
+
+// compile writes the entries in the table in the compiled format.
+func compile[T any](w io.Writer, c Codec[T], table Backend[T]) error {
+	var entries4, entries6, values []byte
+	var lengths4 uint64
+	var lengths6 [3]uint64
+	offsets := make(map[string]uint64)
+	for prf, v := range table.AllSorted() {
+		b, err := c.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("failed encoding value for %s: %w", prf, err)
+		}
+		off, ok := offsets[string(b)]
+		if !ok {
+			off = uint64(len(values))
+			offsets[string(b)] = off
+			values = append(values, b...)
+		}
+
+		n := prf.Bits()
+		if prf.Addr().Is4() {
+			lengths4 |= 1 << n
+			entries4 = appendCompiledEntry(entries4, prf, off, len(b), compiledEntrySize4)
+		} else {
+			lengths6[n/64] |= 1 << (n % 64)
+			entries6 = appendCompiledEntry(entries6, prf, off, len(b), compiledEntrySize6)
+		}
+	}
+
+	h := crc32.NewIEEE()
+	h.Write(entries4)
+	h.Write(entries6)
+	h.Write(values)
+
+	hdr := make([]byte, 0, compiledHeaderSize)
+	hdr = append(hdr, compiledMagic[:]...)
+	hdr = binary.LittleEndian.AppendUint64(hdr, uint64(len(entries4)/compiledEntrySize4))
+	hdr = binary.LittleEndian.AppendUint64(hdr, uint64(len(entries6)/compiledEntrySize6))
+	hdr = binary.LittleEndian.AppendUint64(hdr, uint64(len(values)))
+	hdr = binary.LittleEndian.AppendUint64(hdr, lengths4)
+	for _, l := range lengths6 {
+		hdr = binary.LittleEndian.AppendUint64(hdr, l)
+	}
+	hdr = binary.LittleEndian.AppendUint32(hdr, h.Sum32())
+	hdr = hdr[:compiledHeaderSize]
+
+	for _, b := range [][]byte{hdr, entries4, entries6, values} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func appendCompiledEntry(b []byte, prf netip.Prefix, off uint64, n, size int) []byte {
+	rec := make([]byte, size)
+	addr := prf.Addr().AsSlice()
+	copy(rec, addr)
+	rec[len(addr)] = byte(prf.Bits())
+	binary.LittleEndian.PutUint64(rec[size-16:], off)
+	binary.LittleEndian.PutUint32(rec[size-8:], uint32(n))
+
+	return append(b, rec...)
+}
+
+// CompiledStore is a read-only store in the format written by
+// [Store.Compile]. It's queried in place, without decoding its entries
+// up front; values are decoded using a [Codec] when they're returned.
+// Its read methods mirror those of [Store].
+type CompiledStore[T any] struct {
+	data     []byte
+	entries4 []byte
+	entries6 []byte
+	values   []byte
+	lengths4 uint64
+	lengths6 [3]uint64
+	codec    Codec[T]
+	close    func() error
+	zero     T
+}
+
+// OpenCompiled opens the compiled store in the file at path. On most Unix
+// systems the file is memory mapped, so that opening is instant and the
+// pages holding the store are shared by all processes that open it. The
+// [CompiledStore] must not be used after it's closed.
+func OpenCompiled[T any](path string, c Codec[T]) (*CompiledStore[T], error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() < compiledHeaderSize || int64(int(fi.Size())) != fi.Size() {
+		return nil, fmt.Errorf("%w: unexpected size %d", ErrInvalidCompiled, fi.Size())
+	}
+
+	data, unmap, err := mapFile(f, int(fi.Size()))
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := NewCompiled(data, c)
+	if err != nil {
+		unmap()
+		return nil, err
+	}
+	s.close = unmap
+
+	return s, nil
+}
+
+// NewCompiled returns a [CompiledStore] querying the compiled store held
+// by data in place. The data must not be modified while it's in use.
+func NewCompiled[T any](data []byte, c Codec[T]) (*CompiledStore[T], error) {
+	if len(data) < compiledHeaderSize || [8]byte(data[:8]) != compiledMagic {
+		return nil, fmt.Errorf("%w: unknown format", ErrInvalidCompiled)
+	}
+
+	n4 := binary.LittleEndian.Uint64(data[8:])
+	n6 := binary.LittleEndian.Uint64(data[16:])
+	nv := binary.LittleEndian.Uint64(data[24:])
+	body := uint64(len(data) - compiledHeaderSize)
+	if n4 > body/compiledEntrySize4 || n6 > body/compiledEntrySize6 ||
+		n4*compiledEntrySize4+n6*compiledEntrySize6+nv != body {
+		return nil, fmt.Errorf("%w: unexpected size %d", ErrInvalidCompiled, len(data))
+	}
+
+	s := &CompiledStore[T]{
+		data:     data,
+		lengths4: binary.LittleEndian.Uint64(data[32:]),
+		codec:    c,
+		close:    func() error { return nil },
+	}
+	for i := range s.lengths6 {
+		s.lengths6[i] = binary.LittleEndian.Uint64(data[40+8*i:])
+	}
+	off := uint64(compiledHeaderSize)
+	s.entries4 = data[off : off+n4*compiledEntrySize4]
+	off += n4 * compiledEntrySize4
+	s.entries6 = data[off : off+n6*compiledEntrySize6]
+	off += n6 * compiledEntrySize6
+	s.values = data[off:]
+
+	return s, nil
+}
+
+// Verify checks the checksum of the compiled store. It reads all of the
+// store, so it's not done when opening it.
+func (s *CompiledStore[T]) Verify() error {
+	if crc32.ChecksumIEEE(s.data[compiledHeaderSize:]) != binary.LittleEndian.Uint32(s.data[64:]) {
+		return fmt.Errorf("%w: checksum mismatch", ErrInvalidCompiled)
+	}
+
+	return nil
+}
+
+// Close releases the memory holding the compiled store.
+func (s *CompiledStore[T]) Close() error {
+	return s.close()
+}
+
+// Contains returns whether an entry is available for the [netip.Addr].
+func (s *CompiledStore[T]) Contains(ip netip.Addr) (bool, error) {
+	prf, err := ip.Prefix(ip.BitLen())
+	if err != nil {
+		return false, nil
+	}
+	for range s.supernets(prf) {
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// Get returns the entries containing the [netip.Addr] key.
+func (s *CompiledStore[T]) Get(key netip.Addr) ([]T, error) {
+	prf, err := key.Prefix(key.BitLen())
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetCIDR(prf)
+}
+
+// GetOne returns the most specific entry containing the [netip.Addr]
+// key.
+func (s *CompiledStore[T]) GetOne(key netip.Addr) (T, bool) {
+	prf, err := key.Prefix(key.BitLen())
+	if err != nil {
+		return s.zero, false
+	}
+
+	return s.GetOneCIDR(prf)
+}
+
+// GetCIDR returns the entries containing the [netip.Prefix] key, most
+// specific first.
+func (s *CompiledStore[T]) GetCIDR(key netip.Prefix) ([]T, error) {
+	var result = make([]T, 0, 5)
+	for i, is4 := range s.supernets(key) {
+		v, err := s.value(i, is4)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, v)
+	}
+
+	return result, nil
+}
+
+// GetOneCIDR returns the most specific entry containing the
+// [netip.Prefix] key.
+func (s *CompiledStore[T]) GetOneCIDR(key netip.Prefix) (T, bool) {
+	for i, is4 := range s.supernets(key) {
+		v, err := s.value(i, is4)
+		if err != nil {
+			return s.zero, false
+		}
+		return v, true
+	}
+
+	return s.zero, false
+}
+
+// GetIPOrCIDR returns entries by IP or CIDR.
+func (s *CompiledStore[T]) GetIPOrCIDR(ipOrCIDR string) ([]T, error) {
+	prf, err := parsePrefix(ipOrCIDR)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetCIDR(prf)
+}
+
+// GetOneIPOrCIDR returns the most specific entry by IP or CIDR.
+func (s *CompiledStore[T]) GetOneIPOrCIDR(ipOrCIDR string) (T, bool) {
+	prf, err := parsePrefix(ipOrCIDR)
+	if err != nil {
+		return s.zero, false
+	}
+
+	return s.GetOneCIDR(prf)
+}
+
+// Len returns the number of entries.
+func (s *CompiledStore[T]) Len() int {
+	return len(s.entries4)/compiledEntrySize4 + len(s.entries6)/compiledEntrySize6
+}
+
+// All returns an iterator over all prefix–value pairs, in sorted order.
+// Entries with values that fail to decode are skipped.
+func (s *CompiledStore[T]) All() iter.Seq2[netip.Prefix, T] {
+	return func(yield func(netip.Prefix, T) bool) {
+		for _, is4 := range []bool{true, false} {
+			for i := range s.count(is4) {
+				if !s.yield(i, is4, yield) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Supernets returns an iterator over the entries containing the
+// [netip.Prefix] key, most specific first.
+func (s *CompiledStore[T]) Supernets(key netip.Prefix) iter.Seq2[netip.Prefix, T] {
+	return func(yield func(netip.Prefix, T) bool) {
+		for i, is4 := range s.supernets(key) {
+			if !s.yield(i, is4, yield) {
+				return
+			}
+		}
+	}
+}
+
+// Subnets returns an iterator over the entries contained in the
+// [netip.Prefix] key, including the entry for the key itself, in sorted
+// order.
+func (s *CompiledStore[T]) Subnets(key netip.Prefix) iter.Seq2[netip.Prefix, T] {
+	return func(yield func(netip.Prefix, T) bool) {
+		if !key.IsValid() {
+			return
+		}
+		key = key.Masked()
+		is4 := key.Addr().Is4()
+
+		// entries are sorted by address first, so the subnets of the key
+		// are the entries from the key up to its last address.
+		last := lastAddr(key).AsSlice()
+		for i := s.search(key); i < s.count(is4); i++ {
+			if bytes.Compare(s.addr(i, is4), last) > 0 {
+				return
+			}
+			if !s.yield(i, is4, yield) {
+				return
+			}
+		}
+	}
+}
+
+// supernets returns an iterator over the indexes of the entries
+// containing the key, most specific first.
+func (s *CompiledStore[T]) supernets(key netip.Prefix) iter.Seq2[int, bool] {
+	return func(yield func(int, bool) bool) {
+		if !key.IsValid() {
+			return
+		}
+		is4 := key.Addr().Is4()
+		for n := key.Bits(); n >= 0; n-- {
+			if !s.hasLength(n, is4) {
+				continue
+			}
+			prf := netip.PrefixFrom(key.Addr(), n).Masked()
+			i := s.search(prf)
+			if i < s.count(is4) && s.bits(i, is4) == n && bytes.Equal(s.addr(i, is4), prf.Addr().AsSlice()) {
+				if !yield(i, is4) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// search returns the index of the first entry not sorting before the
+// masked prefix.
+func (s *CompiledStore[T]) search(prf netip.Prefix) int {
+	is4 := prf.Addr().Is4()
+	addr := prf.Addr().AsSlice()
+
+	lo, hi := 0, s.count(is4)
+	for lo < hi {
+		m := int(uint(lo+hi) >> 1)
+		c := bytes.Compare(s.addr(m, is4), addr)
+		if c < 0 || (c == 0 && s.bits(m, is4) < prf.Bits()) {
+			lo = m + 1
+		} else {
+			hi = m
+		}
+	}
+
+	return lo
+}
+
+func (s *CompiledStore[T]) hasLength(n int, is4 bool) bool {
+	if is4 {
+		return s.lengths4&(1<<n) != 0
+	}
+
+	return s.lengths6[n/64]&(1<<(n%64)) != 0
+}
+
+func (s *CompiledStore[T]) count(is4 bool) int {
+	if is4 {
+		return len(s.entries4) / compiledEntrySize4
+	}
+
+	return len(s.entries6) / compiledEntrySize6
+}
+
+func (s *CompiledStore[T]) entry(i int, is4 bool) []byte {
+	if is4 {
+		return s.entries4[i*compiledEntrySize4 : (i+1)*compiledEntrySize4]
+	}
+
+	return s.entries6[i*compiledEntrySize6 : (i+1)*compiledEntrySize6]
+}
+
+func (s *CompiledStore[T]) addr(i int, is4 bool) []byte {
+	if is4 {
+		return s.entry(i, is4)[:4]
+	}
+
+	return s.entry(i, is4)[:16]
+}
+
+func (s *CompiledStore[T]) bits(i int, is4 bool) int {
+	if is4 {
+		return int(s.entry(i, is4)[4])
+	}
+
+	return int(s.entry(i, is4)[16])
+}
+
+func (s *CompiledStore[T]) prefix(i int, is4 bool) netip.Prefix {
+	addr, _ := netip.AddrFromSlice(s.addr(i, is4))
+	return netip.PrefixFrom(addr, s.bits(i, is4))
+}
+
+func (s *CompiledStore[T]) value(i int, is4 bool) (T, error) {
+	rec := s.entry(i, is4)
+	off := binary.LittleEndian.Uint64(rec[len(rec)-16:])
+	n := uint64(binary.LittleEndian.Uint32(rec[len(rec)-8:]))
+	if off > uint64(len(s.values)) || n > uint64(len(s.values))-off {
+		return s.zero, fmt.Errorf("%w: value for %s out of bounds", ErrInvalidCompiled, s.prefix(i, is4))
+	}
+
+	v, err := s.codec.Unmarshal(s.values[off : off+n])
+	if err != nil {
+		return s.zero, fmt.Errorf("failed decoding value for %s: %w", s.prefix(i, is4), err)
+	}
+
+	return v, nil
+}
+
+func (s *CompiledStore[T]) yield(i int, is4 bool, yield func(netip.Prefix, T) bool) bool {
+	v, err := s.value(i, is4)
+	if err != nil {
+		return true
+	}
+
+	return yield(s.prefix(i, is4), v)
+}
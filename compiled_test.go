@@ -0,0 +1,218 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipstore_test
+
+import (
+	"bytes"
+	"errors"
+	"math/rand/v2"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/hslatman/ipstore"
+)
+
+func randomPrefix(r *rand.Rand) netip.Prefix {
+	if r.IntN(4) == 0 {
+		var b [16]byte
+		b[0], b[1], b[2], b[3] = 0x20, 0x01, 0x0d, 0xb8
+		b[4] = byte(r.IntN(4))
+		b[5] = byte(r.IntN(256))
+		return netip.PrefixFrom(netip.AddrFrom16(b), 32+r.IntN(97)).Masked()
+	}
+
+	b := [4]byte{10, byte(r.IntN(4)), byte(r.IntN(256)), byte(r.IntN(256))}
+	return netip.PrefixFrom(netip.AddrFrom4(b), 8+r.IntN(25)).Masked()
+}
+
+func compile(t *testing.T, s *ipstore.Store[string]) *ipstore.CompiledStore[string] {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := s.Compile(&buf, ipstore.StringCodec{}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := ipstore.NewCompiled(buf.Bytes(), ipstore.StringCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+type pair struct {
+	prefix netip.Prefix
+	value  string
+}
+
+func collect(seq func(func(netip.Prefix, string) bool)) []pair {
+	var pairs []pair
+	for p, v := range seq {
+		pairs = append(pairs, pair{p, v})
+	}
+	slices.SortFunc(pairs, func(a, b pair) int {
+		if c := a.prefix.Addr().Compare(b.prefix.Addr()); c != 0 {
+			return c
+		}
+		return a.prefix.Bits() - b.prefix.Bits()
+	})
+
+	return pairs
+}
+
+func TestCompiledMatchesStore(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	s := ipstore.New[string]()
+	for range 2000 {
+		prf := randomPrefix(r)
+		if err := s.AddCIDR(prf, prf.String()[:r.IntN(4)]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := compile(t, s)
+
+	if c.Len() != s.Len() {
+		t.Fatalf("expected %d entries; got %d", s.Len(), c.Len())
+	}
+	if !slices.Equal(collect(c.All()), collect(s.All())) {
+		t.Error("expected All to return the same entries")
+	}
+
+	for range 2000 {
+		prf := randomPrefix(r)
+		addr := prf.Addr()
+		if r.IntN(2) == 0 {
+			addr = addr.Next()
+		}
+
+		expected, _ := s.Get(addr)
+		got, err := c.Get(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got, expected) {
+			t.Errorf("Get(%s): expected %v; got %v", addr, expected, got)
+		}
+
+		ev, eok := s.GetOne(addr)
+		gv, gok := c.GetOne(addr)
+		if ev != gv || eok != gok {
+			t.Errorf("GetOne(%s): expected %q, %t; got %q, %t", addr, ev, eok, gv, gok)
+		}
+		if ok, _ := c.Contains(addr); ok != eok {
+			t.Errorf("Contains(%s): expected %t; got %t", addr, eok, ok)
+		}
+
+		ev, eok = s.GetOneCIDR(prf)
+		gv, gok = c.GetOneCIDR(prf)
+		if ev != gv || eok != gok {
+			t.Errorf("GetOneCIDR(%s): expected %q, %t; got %q, %t", prf, ev, eok, gv, gok)
+		}
+
+		if !slices.Equal(collect(c.Supernets(prf)), collect(s.Supernets(prf))) {
+			t.Errorf("Supernets(%s): expected the same entries", prf)
+		}
+		if !slices.Equal(collect(c.Subnets(prf)), collect(s.Subnets(prf))) {
+			t.Errorf("Subnets(%s): expected the same entries", prf)
+		}
+	}
+}
+
+func TestOpenCompiled(t *testing.T) {
+	s := ipstore.New[string]()
+	for _, cidr := range []string{"10.0.0.0/8", "10.1.0.0/16", "192.0.2.1", "2001:db8::/32", "::/0"} {
+		if err := s.AddIPOrCIDR(cidr, cidr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := s.Compile(&buf, ipstore.StringCodec{}); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "store.ipsm")
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := ipstore.OpenCompiled(path, ipstore.StringCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if v, _ := c.GetOneIPOrCIDR("10.1.2.3"); v != "10.1.0.0/16" {
+		t.Errorf("expected %q; got %q", "10.1.0.0/16", v)
+	}
+	if v, _ := c.GetOneIPOrCIDR("2001:db9::1"); v != "::/0" {
+		t.Errorf("expected %q; got %q", "::/0", v)
+	}
+	vs, err := c.GetIPOrCIDR("192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vs) != 1 || vs[0] != "192.0.2.1" {
+		t.Errorf("unexpected values %v", vs)
+	}
+	if _, ok := c.GetOneIPOrCIDR("172.16.0.1"); ok {
+		t.Error("expected no match")
+	}
+	if _, err := c.GetIPOrCIDR("invalid"); err == nil {
+		t.Error("expected error for invalid IP")
+	}
+}
+
+func TestCompiledErrors(t *testing.T) {
+	s := ipstore.New[string]()
+	if err := s.AddIPOrCIDR("10.0.0.0/8", "private"); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := s.Compile(&buf, ipstore.StringCodec{}); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+
+	for name, data := range map[string][]byte{
+		"empty":     nil,
+		"magic":     append([]byte("IPSTMAP\x02"), b[8:]...),
+		"truncated": b[:len(b)-1],
+		"trailing":  append(slices.Clone(b), 0),
+	} {
+		if _, err := ipstore.NewCompiled(data, ipstore.StringCodec{}); !errors.Is(err, ipstore.ErrInvalidCompiled) {
+			t.Errorf("%s: expected ErrInvalidCompiled; got %v", name, err)
+		}
+	}
+
+	corrupt := slices.Clone(b)
+	corrupt[len(corrupt)-1] ^= 0xff
+	c, err := ipstore.NewCompiled(corrupt, ipstore.StringCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Verify(); !errors.Is(err, ipstore.ErrInvalidCompiled) {
+		t.Errorf("expected ErrInvalidCompiled; got %v", err)
+	}
+
+	if _, err := ipstore.OpenCompiled(filepath.Join(t.TempDir(), "missing"), ipstore.StringCodec{}); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected ErrNotExist; got %v", err)
+	}
+}
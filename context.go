@@ -0,0 +1,142 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipstore
+
+import (
+	"context"
+	"iter"
+	"net/netip"
+)
+
+// checkInterval is the number of items bulk operations process between
+// checking whether their context is done.
+const checkInterval = 1024
+
+// ContextOption configures the context-aware bulk operations, such as
+// [Store.LoadContext].
+type ContextOption func(*contextOptions)
+
+type contextOptions struct {
+	progress func(n int)
+}
+
+// WithProgress sets a function called with the number of items processed
+// so far, periodically and when the operation completes.
+func WithProgress(fn func(n int)) ContextOption {
+	return func(o *contextOptions) {
+		o.progress = fn
+	}
+}
+
+// progress counts the items processed by a bulk operation, checking its
+// context and reporting progress every checkInterval items.
+type progress struct {
+	ctx context.Context
+	fn  func(n int)
+	n   int
+}
+
+func newProgress(ctx context.Context, opts []ContextOption) *progress {
+	var o contextOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return &progress{ctx: ctx, fn: o.progress}
+}
+
+// step counts an item, returning the context's error when it's done.
+func (p *progress) step() error {
+	p.n++
+	if p.n%checkInterval != 0 {
+		return nil
+	}
+	if err := p.ctx.Err(); err != nil {
+		return err
+	}
+	if p.fn != nil {
+		p.fn(p.n)
+	}
+
+	return nil
+}
+
+// done reports the final number of items processed.
+func (p *progress) done() {
+	if p.fn != nil {
+		p.fn(p.n)
+	}
+}
+
+// LoadContext adds all entries in the sequence to the [Store], like
+// [Store.Load]. It returns the context's error when it's done before all
+// entries were read, in which case none of them are added.
+func (s *Store[T]) LoadContext(ctx context.Context, seq iter.Seq2[netip.Prefix, T], opts ...ContextOption) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// entries are staged in a separate table, so that the store doesn't
+	// have to be locked while reading them.
+	p := newProgress(ctx, opts)
+	staged := s.newBackend()
+	for prf, v := range seq {
+		prf, _, err := s.opts.canonical(prf)
+		if err != nil {
+			return err
+		}
+		staged.Insert(prf, v)
+		if err := p.step(); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	if s.table.Size() == 0 {
+		s.table = staged
+	} else {
+		for prf, v := range staged.All() {
+			s.table.Insert(prf, v)
+		}
+	}
+	s.mu.Unlock()
+
+	p.done()
+
+	return nil
+}
+
+// AllContext returns an iterator over all entries in the [Store], like
+// [Store.All]. It stops when the context is done; check ctx.Err() after
+// the loop to find out whether all entries were returned. The [Store] is
+// read-locked while iterating, so it must not be modified in the loop.
+func (s *Store[T]) AllContext(ctx context.Context, opts ...ContextOption) iter.Seq2[netip.Prefix, T] {
+	return func(yield func(netip.Prefix, T) bool) {
+		if ctx.Err() != nil {
+			return
+		}
+
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+
+		p := newProgress(ctx, opts)
+		for prf, v := range s.table.All() {
+			if !yield(prf, v) || p.step() != nil {
+				return
+			}
+		}
+		p.done()
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipstore_test
+
+import (
+	"context"
+	"errors"
+	"iter"
+	"net/netip"
+	"testing"
+
+	"github.com/hslatman/ipstore"
+)
+
+// entries returns a sequence of n distinct /32 entries in 10.0.0.0/8.
+func entries(n int) iter.Seq2[netip.Prefix, int] {
+	return func(yield func(netip.Prefix, int) bool) {
+		for i := range n {
+			addr := netip.AddrFrom4([4]byte{10, byte(i >> 16), byte(i >> 8), byte(i)})
+			if !yield(netip.PrefixFrom(addr, 32), i) {
+				return
+			}
+		}
+	}
+}
+
+func TestLoadContext(t *testing.T) {
+	s := ipstore.New[int]()
+	if err := s.AddIPOrCIDR("192.0.2.0/24", -1); err != nil {
+		t.Fatal(err)
+	}
+
+	var reports []int
+	if err := s.LoadContext(context.Background(), entries(5000), ipstore.WithProgress(func(n int) {
+		reports = append(reports, n)
+	})); err != nil {
+		t.Fatal(err)
+	}
+	if s.Len() != 5001 {
+		t.Errorf("expected 5001 entries; got %d", s.Len())
+	}
+	if len(reports) == 0 || reports[len(reports)-1] != 5000 {
+		t.Errorf("expected final progress of 5000; got %v", reports)
+	}
+	if len(reports) < 2 {
+		t.Errorf("expected periodic progress; got %v", reports)
+	}
+}
+
+func TestLoadContextEmpty(t *testing.T) {
+	s := ipstore.New[int](ipstore.WithBackend(ipstore.LiteBackend))
+	if err := s.LoadContext(context.Background(), entries(10)); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := s.GetOne(netip.MustParseAddr("10.0.0.9")); v != 9 {
+		t.Errorf("expected 9; got %d", v)
+	}
+}
+
+func TestLoadContextCancel(t *testing.T) {
+	s := ipstore.New[int]()
+	if err := s.AddIPOrCIDR("192.0.2.0/24", -1); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err := s.LoadContext(ctx, entries(10000), ipstore.WithProgress(func(n int) {
+		cancel()
+	}))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled; got %v", err)
+	}
+	if s.Len() != 1 {
+		t.Errorf("expected the store to be unchanged; got %d entries", s.Len())
+	}
+
+	if err := s.LoadContext(ctx, entries(1)); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled; got %v", err)
+	}
+}
+
+func TestLoadContextStrict(t *testing.T) {
+	s := ipstore.New[int](ipstore.WithPrefixPolicy(ipstore.PrefixStrict))
+	seq := func(yield func(netip.Prefix, int) bool) {
+		_ = yield(netip.MustParsePrefix("10.0.0.0/8"), 1) &&
+			yield(netip.MustParsePrefix("10.1.2.3/16"), 2)
+	}
+
+	var nce *ipstore.NonCanonicalError
+	if err := s.LoadContext(context.Background(), seq); !errors.As(err, &nce) {
+		t.Errorf("expected NonCanonicalError; got %v", err)
+	}
+	if s.Len() != 0 {
+		t.Errorf("expected no entries; got %d", s.Len())
+	}
+}
+
+func TestAllContext(t *testing.T) {
+	s := ipstore.New[int]()
+	if err := s.Load(entries(5000)); err != nil {
+		t.Fatal(err)
+	}
+
+	n := 0
+	for range s.AllContext(context.Background()) {
+		n++
+	}
+	if n != 5000 {
+		t.Errorf("expected 5000 entries; got %d", n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	n = 0
+	for range s.AllContext(ctx, ipstore.WithProgress(func(int) { cancel() })) {
+		n++
+	}
+	if ctx.Err() == nil || n >= 5000 {
+		t.Errorf("expected iteration to stop early; got %d entries", n)
+	}
+
+	n = 0
+	for range s.AllContext(ctx) {
+		n++
+	}
+	if n != 0 {
+		t.Errorf("expected no entries for a done context; got %d", n)
+	}
+}
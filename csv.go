@@ -0,0 +1,385 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipstore
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/netip"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// CSVImport configures how [ImportCSV] maps the rows in a CSV file to
+// entries in a [Store].
+type CSVImport struct {
+	// Header holds the column names for files without a header row,
+	// such as IP2Location LITE and DB-IP. When empty, the first row of
+	// the file is used as the header.
+	Header []string
+	// Network is the column holding the network of a row in CIDR
+	// notation, as used by GeoLite2. It takes precedence over Start and
+	// End.
+	Network string
+	// Start and End are the columns holding the (inclusive) boundaries
+	// of the range of addresses in a row. Boundaries can be IP addresses
+	// or addresses encoded as decimal integers, as used by IP2Location.
+	Start, End string
+	// IPv6 indicates that boundaries encoded as decimal integers are IPv6
+	// addresses, as in the IP2Location IPV6 files, instead of IPv4
+	// addresses. Ranges of IPv4-mapped IPv6 addresses are stored as IPv4
+	// ranges.
+	IPv6 bool
+	// Fields maps the names of fields in the value struct to the columns
+	// they're read from. Fields can be strings, booleans, integers or
+	// floating point numbers.
+	Fields map[string]string
+	// Join optionally joins a second table, such as the GeoLite2
+	// locations table, to each row.
+	Join *CSVJoin
+}
+
+// CSVJoin configures a table joined to the rows in the file imported by
+// [ImportCSV]. The joined table is read into memory fully before rows
+// are imported, keeping only the columns mapped in Fields.
+type CSVJoin struct {
+	// Reader is the joined table in CSV format.
+	Reader io.Reader
+	// Header holds the column names for tables without a header row.
+	Header []string
+	// Key is the column in the joined table identifying its rows.
+	Key string
+	// ForeignKey is the column in the imported file referring to Key.
+	ForeignKey string
+	// Fields maps the names of fields in the value struct to columns in
+	// the joined table.
+	Fields map[string]string
+}
+
+// ImportCSV imports the rows of a CSV file read from r into the [Store].
+// Rows are read one by one and mapped to a value of struct type T as
+// configured by cfg. Rows covering a range of addresses are stored as the
+// minimal set of CIDRs covering the range. Importing stops at the first
+// malformed row, in which case a [*ParseError] is returned.
+func ImportCSV[T any](s *Store[T], r io.Reader, cfg CSVImport) error {
+	typ := reflect.TypeFor[T]()
+	if typ.Kind() != reflect.Struct {
+		return fmt.Errorf("value type %s is not a struct", typ)
+	}
+	if cfg.Network == "" && (cfg.Start == "" || cfg.End == "") {
+		return errors.New("either a network or start and end columns are required")
+	}
+
+	var joined map[string][]string
+	var joinFields []csvField
+	if cfg.Join != nil {
+		var err error
+		if joined, joinFields, err = readCSVJoin(typ, cfg.Join); err != nil {
+			return err
+		}
+	}
+
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+
+	header := cfg.Header
+	if len(header) == 0 {
+		record, err := cr.Read()
+		if err != nil {
+			return fmt.Errorf("failed reading CSV header: %w", err)
+		}
+		header = slices.Clone(record)
+	}
+	columns := csvColumns(header)
+
+	fields, err := csvFields(typ, cfg.Fields, columns)
+	if err != nil {
+		return err
+	}
+
+	network, start, end, foreignKey := -1, -1, -1, -1
+	if cfg.Network != "" {
+		if network, err = csvColumn(columns, cfg.Network); err != nil {
+			return err
+		}
+	} else {
+		if start, err = csvColumn(columns, cfg.Start); err != nil {
+			return err
+		}
+		if end, err = csvColumn(columns, cfg.End); err != nil {
+			return err
+		}
+	}
+	if cfg.Join != nil {
+		if foreignKey, err = csvColumn(columns, cfg.Join.ForeignKey); err != nil {
+			return err
+		}
+	}
+
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed reading CSV: %w", err)
+		}
+
+		line, _ := cr.FieldPos(0)
+		perr := func(err error) error {
+			return &ParseError{Line: line, Text: strings.Join(record, ","), Err: err}
+		}
+
+		var prefixes []netip.Prefix
+		if network >= 0 {
+			prf, err := parsePrefix(csvValue(record, network))
+			if err != nil {
+				return perr(err)
+			}
+			prefixes = []netip.Prefix{prf}
+		} else {
+			from, to, err := parseCSVRange(csvValue(record, start), csvValue(record, end), cfg.IPv6)
+			if err != nil {
+				return perr(err)
+			}
+			if prefixes, err = rangePrefixes(from, to); err != nil {
+				return perr(err)
+			}
+		}
+
+		var value T
+		v := reflect.ValueOf(&value).Elem()
+		if err := setCSVFields(v, fields, record); err != nil {
+			return perr(err)
+		}
+		if foreignKey >= 0 {
+			if row, ok := joined[csvValue(record, foreignKey)]; ok {
+				if err := setCSVFields(v, joinFields, row); err != nil {
+					return perr(err)
+				}
+			}
+		}
+
+		for _, prf := range prefixes {
+			if err := s.AddCIDR(prf, value); err != nil {
+				return perr(err)
+			}
+		}
+	}
+}
+
+// csvField maps a column to the index of a field in a struct.
+type csvField struct {
+	field  []int
+	column int
+}
+
+func readCSVJoin(typ reflect.Type, join *CSVJoin) (map[string][]string, []csvField, error) {
+	cr := csv.NewReader(join.Reader)
+	cr.FieldsPerRecord = -1
+
+	header := join.Header
+	if len(header) == 0 {
+		record, err := cr.Read()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed reading joined CSV header: %w", err)
+		}
+		header = record
+	}
+	columns := csvColumns(header)
+
+	key, err := csvColumn(columns, join.Key)
+	if err != nil {
+		return nil, nil, err
+	}
+	fields, err := csvFields(typ, join.Fields, columns)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// only the mapped columns are kept; the fields are updated to refer
+	// to their position in the retained row.
+	retained := make([]csvField, len(fields))
+	for i, f := range fields {
+		retained[i] = csvField{field: f.field, column: i}
+	}
+
+	rows := make(map[string][]string)
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return rows, retained, nil
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed reading joined CSV: %w", err)
+		}
+
+		row := make([]string, len(fields))
+		for i, f := range fields {
+			row[i] = csvValue(record, f.column)
+		}
+		rows[csvValue(record, key)] = row
+	}
+}
+
+func csvColumns(header []string) map[string]int {
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+
+	return columns
+}
+
+func csvColumn(columns map[string]int, name string) (int, error) {
+	i, ok := columns[name]
+	if !ok {
+		return -1, fmt.Errorf("column %q not found", name)
+	}
+
+	return i, nil
+}
+
+func csvFields(typ reflect.Type, mapping map[string]string, columns map[string]int) ([]csvField, error) {
+	fields := make([]csvField, 0, len(mapping))
+	for name, column := range mapping {
+		f, ok := typ.FieldByName(name)
+		if !ok || !f.IsExported() {
+			return nil, fmt.Errorf("field %q not found in %s", name, typ)
+		}
+		switch f.Type.Kind() {
+		case reflect.String, reflect.Bool,
+			reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+		default:
+			return nil, fmt.Errorf("field %q has unsupported type %s", name, f.Type)
+		}
+
+		i, err := csvColumn(columns, column)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, csvField{field: f.Index, column: i})
+	}
+
+	return fields, nil
+}
+
+func setCSVFields(v reflect.Value, fields []csvField, record []string) error {
+	for _, f := range fields {
+		s := csvValue(record, f.column)
+		if s == "" {
+			continue
+		}
+
+		fv := v.FieldByIndex(f.field)
+		switch fv.Kind() {
+		case reflect.String:
+			fv.SetString(s)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return err
+			}
+			fv.SetBool(b)
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			i, err := strconv.ParseInt(s, 10, fv.Type().Bits())
+			if err != nil {
+				return err
+			}
+			fv.SetInt(i)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			u, err := strconv.ParseUint(s, 10, fv.Type().Bits())
+			if err != nil {
+				return err
+			}
+			fv.SetUint(u)
+		case reflect.Float32, reflect.Float64:
+			fl, err := strconv.ParseFloat(s, fv.Type().Bits())
+			if err != nil {
+				return err
+			}
+			fv.SetFloat(fl)
+		}
+	}
+
+	return nil
+}
+
+func csvValue(record []string, i int) string {
+	if i < 0 || i >= len(record) {
+		return ""
+	}
+
+	return strings.TrimSpace(record[i])
+}
+
+// parseCSVRange parses the boundaries of a range of addresses. When both
+// are IPv4-mapped IPv6 addresses encoded as decimal integers, they're
+// unmapped.
+func parseCSVRange(start, end string, ipv6 bool) (netip.Addr, netip.Addr, error) {
+	from, fromInt, err := parseCSVAddr(start, ipv6)
+	if err != nil {
+		return netip.Addr{}, netip.Addr{}, err
+	}
+	to, toInt, err := parseCSVAddr(end, ipv6)
+	if err != nil {
+		return netip.Addr{}, netip.Addr{}, err
+	}
+
+	if fromInt && toInt && from.Is4In6() && to.Is4In6() {
+		from, to = from.Unmap(), to.Unmap()
+	}
+
+	return from, to, nil
+}
+
+// parseCSVAddr parses an IP address, or an address encoded as a decimal
+// integer, in which case it returns true. Integers are IPv6 addresses
+// when ipv6 is true, and IPv4 addresses otherwise.
+func parseCSVAddr(s string, ipv6 bool) (netip.Addr, bool, error) {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return addr, false, nil
+	}
+
+	i, ok := new(big.Int).SetString(s, 10)
+	if !ok || i.Sign() < 0 {
+		return netip.Addr{}, false, fmt.Errorf("invalid address %q", s)
+	}
+
+	if !ipv6 {
+		if i.BitLen() > 32 {
+			return netip.Addr{}, false, fmt.Errorf("invalid IPv4 address %q", s)
+		}
+		var b [4]byte
+		i.FillBytes(b[:])
+		return netip.AddrFrom4(b), true, nil
+	}
+
+	if i.BitLen() > 128 {
+		return netip.Addr{}, false, fmt.Errorf("invalid IPv6 address %q", s)
+	}
+	var b [16]byte
+	i.FillBytes(b[:])
+
+	return netip.AddrFrom16(b), true, nil
+}
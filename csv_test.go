@@ -0,0 +1,213 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipstore_test
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hslatman/ipstore"
+)
+
+type location struct {
+	Country   string
+	City      string
+	Latitude  float64
+	Longitude float64
+	Radius    int
+	EU        bool
+}
+
+type country struct {
+	Code string
+	Name string
+}
+
+func open(t *testing.T, path string) *os.File {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+
+	return f
+}
+
+func TestImportCSVGeoLite2(t *testing.T) {
+	s := ipstore.New[location]()
+	err := ipstore.ImportCSV(s, open(t, "testdata/geoip/GeoLite2-City-Blocks.csv"), ipstore.CSVImport{
+		Network: "network",
+		Fields: map[string]string{
+			"Latitude":  "latitude",
+			"Longitude": "longitude",
+			"Radius":    "accuracy_radius",
+		},
+		Join: &ipstore.CSVJoin{
+			Reader:     open(t, "testdata/geoip/GeoLite2-City-Locations-en.csv"),
+			Key:        "geoname_id",
+			ForeignKey: "geoname_id",
+			Fields: map[string]string{
+				"Country": "country_iso_code",
+				"City":    "city_name",
+				"EU":      "is_in_european_union",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Len() != 3 {
+		t.Errorf("expected 3 entries; got %d", s.Len())
+	}
+
+	v, ok := s.GetOne(netip.MustParseAddr("81.2.69.143"))
+	if !ok {
+		t.Fatal("expected 81.2.69.143 to be in store")
+	}
+	expected := location{Country: "GB", City: "London", Latitude: 51.5142, Longitude: -0.0931, Radius: 5}
+	if v != expected {
+		t.Errorf("expected %#+v; got %#+v", expected, v)
+	}
+
+	v, ok = s.GetOne(netip.MustParseAddr("2001:db8::1"))
+	if !ok {
+		t.Fatal("expected 2001:db8::1 to be in store")
+	}
+	if v.Country != "NL" || !v.EU {
+		t.Errorf("unexpected location %#+v", v)
+	}
+}
+
+func TestImportCSVIP2Location(t *testing.T) {
+	cfg := ipstore.CSVImport{
+		Header: []string{"ip_from", "ip_to", "country_code", "country_name"},
+		Start:  "ip_from",
+		End:    "ip_to",
+		Fields: map[string]string{
+			"Code": "country_code",
+			"Name": "country_name",
+		},
+	}
+
+	s := ipstore.New[country]()
+	if err := ipstore.ImportCSV(s, open(t, "testdata/geoip/IP2LOCATION-LITE-DB1.CSV"), cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	// 0.0.0.0/8, 1.0.0.0/24, 1.0.1.0/24 and 1.0.2.0/23
+	if s.Len() != 4 {
+		t.Errorf("expected 4 entries; got %d", s.Len())
+	}
+
+	v, ok := s.GetOne(netip.MustParseAddr("1.0.3.1"))
+	if !ok {
+		t.Fatal("expected 1.0.3.1 to be in store")
+	}
+	if v != (country{Code: "CN", Name: "China"}) {
+		t.Errorf("unexpected country %#+v", v)
+	}
+
+	s = ipstore.New[country]()
+	var perr *ipstore.ParseError
+	if err := ipstore.ImportCSV(s, open(t, "testdata/geoip/IP2LOCATION-LITE-DB1.IPV6.CSV"), cfg); !errors.As(err, &perr) {
+		t.Errorf("expected *ParseError for IPv6 integers read as IPv4; got %v", err)
+	}
+
+	cfg.IPv6 = true
+	s = ipstore.New[country]()
+	if err := ipstore.ImportCSV(s, open(t, "testdata/geoip/IP2LOCATION-LITE-DB1.IPV6.CSV"), cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first row covers :: up to ::fffe:ffff:ffff, which must not be
+	// read as IPv4 because its start fits 32 bits.
+	for _, ip := range []string{"::", "::1", "::fffe:ffff:ffff"} {
+		if v, ok := s.GetOne(netip.MustParseAddr(ip)); !ok || v.Code != "-" {
+			t.Errorf("expected - for %s; got %#+v", ip, v)
+		}
+	}
+	if _, ok := s.GetOne(netip.MustParseAddr("0.0.0.1")); ok {
+		t.Errorf("expected no IPv4 entry for the first row")
+	}
+	if v, _ := s.GetOne(netip.MustParseAddr("1.0.0.1")); v.Code != "US" {
+		t.Errorf("expected IPv4-mapped range to be unmapped; got %#+v", v)
+	}
+	if v, _ := s.GetOne(netip.MustParseAddr("2001:db8::1")); v.Code != "NL" {
+		t.Errorf("expected NL; got %#+v", v)
+	}
+}
+
+func TestImportCSVDBIP(t *testing.T) {
+	s := ipstore.New[country]()
+	err := ipstore.ImportCSV(s, open(t, "testdata/geoip/dbip-country-lite.csv"), ipstore.CSVImport{
+		Header: []string{"start", "end", "country"},
+		Start:  "start",
+		End:    "end",
+		Fields: map[string]string{"Code": "country"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, _ := s.GetOne(netip.MustParseAddr("1.0.2.1")); v.Code != "CN" {
+		t.Errorf("expected CN; got %#+v", v)
+	}
+	if v, _ := s.GetOne(netip.MustParseAddr("2001:db8:1::1")); v.Code != "NL" {
+		t.Errorf("expected NL; got %#+v", v)
+	}
+}
+
+func TestImportCSVErrors(t *testing.T) {
+	s := ipstore.New[country]()
+	err := ipstore.ImportCSV(s, strings.NewReader("network,code\n1.0.0.0/24,AU\n1.0.0.0/33,AU\n"), ipstore.CSVImport{
+		Network: "network",
+		Fields:  map[string]string{"Code": "code"},
+	})
+	var perr *ipstore.ParseError
+	if !errors.As(err, &perr) {
+		t.Fatalf("expected *ParseError; got %v", err)
+	}
+	if perr.Line != 3 {
+		t.Errorf("expected error on line 3; got %d", perr.Line)
+	}
+
+	err = ipstore.ImportCSV(s, strings.NewReader("network,code\n"), ipstore.CSVImport{
+		Network: "network",
+		Fields:  map[string]string{"Unknown": "code"},
+	})
+	if err == nil {
+		t.Error("expected error for unknown field")
+	}
+
+	err = ipstore.ImportCSV(s, strings.NewReader("network,code\n"), ipstore.CSVImport{
+		Network: "cidr",
+	})
+	if err == nil {
+		t.Error("expected error for unknown column")
+	}
+
+	err = ipstore.ImportCSV(ipstore.New[string](), strings.NewReader("network\n"), ipstore.CSVImport{
+		Network: "network",
+	})
+	if err == nil {
+		t.Error("expected error for non-struct value type")
+	}
+}
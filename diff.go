@@ -0,0 +1,121 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipstore
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+)
+
+// ChangeKind describes how an entry differs between two stores.
+type ChangeKind int
+
+const (
+	// Added entries are only in the second [Store].
+	Added ChangeKind = iota + 1
+	// Removed entries are only in the first [Store].
+	Removed
+	// Modified entries are in both stores, with different values.
+	Modified
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case Added:
+		return "added"
+	case Removed:
+		return "removed"
+	case Modified:
+		return "modified"
+	default:
+		return "unknown"
+	}
+}
+
+// Change describes a difference between two stores for a single prefix.
+// Old holds the value in the first [Store], New the value in the second.
+type Change[T any] struct {
+	Kind   ChangeKind
+	Prefix netip.Prefix
+	Old    T
+	New    T
+}
+
+// Diff returns the changes needed to go from the entries in a to the
+// entries in b, sorted by prefix. Values stored by the same prefix in both
+// stores are compared using equal; when equal is nil, only added and
+// removed entries are reported.
+func Diff[T any](a, b *Store[T], equal func(T, T) bool) []Change[T] {
+	changes, _ := DiffContext(context.Background(), a, b, equal)
+	return changes
+}
+
+// DiffContext returns the changes needed to go from the entries in a to
+// the entries in b, like [Diff]. It returns the context's error when it's
+// done before the stores were compared.
+func DiffContext[T any](ctx context.Context, a, b *Store[T], equal func(T, T) bool, opts ...ContextOption) ([]Change[T], error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	a.mu.RLock()
+	at := a.table.Clone()
+	a.mu.RUnlock()
+
+	b.mu.RLock()
+	bt := b.table.Clone()
+	b.mu.RUnlock()
+
+	p := newProgress(ctx, opts)
+	var changes []Change[T]
+	for prf, old := range at.All() {
+		if err := p.step(); err != nil {
+			return nil, err
+		}
+		v, ok := bt.Get(prf)
+		switch {
+		case !ok:
+			changes = append(changes, Change[T]{Kind: Removed, Prefix: prf, Old: old})
+		case equal != nil && !equal(old, v):
+			changes = append(changes, Change[T]{Kind: Modified, Prefix: prf, Old: old, New: v})
+		}
+	}
+	for prf, v := range bt.All() {
+		if err := p.step(); err != nil {
+			return nil, err
+		}
+		if _, ok := at.Get(prf); !ok {
+			changes = append(changes, Change[T]{Kind: Added, Prefix: prf, New: v})
+		}
+	}
+
+	slices.SortFunc(changes, func(x, y Change[T]) int {
+		return comparePrefix(x.Prefix, y.Prefix)
+	})
+	p.done()
+
+	return changes, nil
+}
+
+// comparePrefix orders prefixes by address first, and by number of bits
+// for prefixes with the same address.
+func comparePrefix(a, b netip.Prefix) int {
+	if c := a.Addr().Compare(b.Addr()); c != 0 {
+		return c
+	}
+
+	return a.Bits() - b.Bits()
+}
@@ -0,0 +1,98 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipstore_test
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/hslatman/ipstore"
+)
+
+func TestDiff(t *testing.T) {
+	a := ipstore.New[string]()
+	b := ipstore.New[string]()
+	for ipOrCIDR, v := range map[string]string{
+		"10.0.0.0/8":    "unchanged",
+		"192.0.2.0/24":  "old",
+		"198.51.100.1":  "removed",
+		"2001:db8::/32": "removed",
+	} {
+		if err := a.AddIPOrCIDR(ipOrCIDR, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for ipOrCIDR, v := range map[string]string{
+		"10.0.0.0/8":   "unchanged",
+		"192.0.2.0/24": "new",
+		"10.0.0.0/16":  "added",
+	} {
+		if err := b.AddIPOrCIDR(ipOrCIDR, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	changes := ipstore.Diff(a, b, func(x, y string) bool { return x == y })
+	expected := []ipstore.Change[string]{
+		{Kind: ipstore.Added, Prefix: netip.MustParsePrefix("10.0.0.0/16"), New: "added"},
+		{Kind: ipstore.Modified, Prefix: netip.MustParsePrefix("192.0.2.0/24"), Old: "old", New: "new"},
+		{Kind: ipstore.Removed, Prefix: netip.MustParsePrefix("198.51.100.1/32"), Old: "removed"},
+		{Kind: ipstore.Removed, Prefix: netip.MustParsePrefix("2001:db8::/32"), Old: "removed"},
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("expected %d changes; got %d (%v)", len(expected), len(changes), changes)
+	}
+	for i, c := range changes {
+		if c != expected[i] {
+			t.Errorf("expected change %d to be %v; got %v", i, expected[i], c)
+		}
+	}
+
+	if changes := ipstore.Diff(a, b, nil); len(changes) != 3 {
+		t.Errorf("expected 3 changes without comparing values; got %d", len(changes))
+	}
+	if changes := ipstore.Diff(a, a, func(x, y string) bool { return x == y }); len(changes) != 0 {
+		t.Errorf("expected no changes; got %v", changes)
+	}
+	if ipstore.Removed.String() != "removed" {
+		t.Errorf("expected %q; got %q", "removed", ipstore.Removed)
+	}
+}
+
+func TestDiffContext(t *testing.T) {
+	a, b := ipstore.New[int](), ipstore.New[int]()
+	if err := a.Load(entries(3000)); err != nil {
+		t.Fatal(err)
+	}
+
+	var final int
+	changes, err := ipstore.DiffContext(context.Background(), a, b, nil, ipstore.WithProgress(func(n int) {
+		final = n
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 3000 || final != 3000 {
+		t.Errorf("expected 3000 changes and progress; got %d and %d", len(changes), final)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	changes, err = ipstore.DiffContext(ctx, a, b, nil, ipstore.WithProgress(func(int) { cancel() }))
+	if !errors.Is(err, context.Canceled) || changes != nil {
+		t.Errorf("expected context.Canceled and no changes; got %v and %d changes", err, len(changes))
+	}
+}
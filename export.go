@@ -0,0 +1,207 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipstore
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/netip"
+	"slices"
+)
+
+// ExportOptions configures the firewall exporters [WriteNftables] and
+// [WriteIpset].
+type ExportOptions[T any] struct {
+	// Filter selects the entries to export. All entries are exported
+	// when it's nil.
+	Filter func(T) bool
+	// SetName returns the name of the set an entry is exported to. All
+	// entries are exported to the set named Name when it's nil. Names,
+	// like Name and Table, must consist of ASCII letters, digits and
+	// underscores, and not start with a digit.
+	SetName func(T) string
+	// Name is the name of the set entries are exported to when SetName
+	// is nil. Defaults to "ipstore".
+	Name string
+	// Table is the name of the (inet) nftables table holding the sets.
+	// Defaults to "ipstore". It's not used for ipset.
+	Table string
+}
+
+// ErrInvalidName is returned by the exporters when the name of a set or
+// table isn't a valid identifier.
+var ErrInvalidName = errors.New("invalid name")
+
+// validName returns an error wrapping [ErrInvalidName] when the name
+// isn't a valid set or table name.
+func validName(name string) error {
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_':
+		case r >= '0' && r <= '9' && i > 0:
+		default:
+			return fmt.Errorf("%w %q", ErrInvalidName, name)
+		}
+	}
+	if name == "" {
+		return fmt.Errorf("%w: empty name", ErrInvalidName)
+	}
+
+	return nil
+}
+
+// exportSet holds the aggregated prefixes exported to a single set,
+// split by address family.
+type exportSet struct {
+	name   string
+	v4, v6 []netip.Prefix
+}
+
+type exportFamily struct {
+	suffix   string
+	prefixes []netip.Prefix
+}
+
+func (s exportSet) families() []exportFamily {
+	return []exportFamily{{"_v4", s.v4}, {"_v6", s.v6}}
+}
+
+func (o ExportOptions[T]) sets(s *Store[T]) ([]exportSet, error) {
+	name := o.Name
+	if name == "" {
+		name = "ipstore"
+	}
+	if err := validName(name); err != nil {
+		return nil, err
+	}
+
+	grouped := make(map[string][]netip.Prefix)
+	for prf, v := range s.All() {
+		if o.Filter != nil && !o.Filter(v) {
+			continue
+		}
+		n := name
+		if o.SetName != nil {
+			n = o.SetName(v)
+			if err := validName(n); err != nil {
+				return nil, fmt.Errorf("set name for %s: %w", prf, err)
+			}
+		}
+		grouped[n] = append(grouped[n], prf)
+	}
+
+	var sets []exportSet
+	for _, n := range slices.Sorted(maps.Keys(grouped)) {
+		set := exportSet{name: n}
+		for _, prf := range Aggregate(slices.Values(grouped[n])) {
+			if prf.Addr().Is4() {
+				set.v4 = append(set.v4, prf)
+			} else {
+				set.v6 = append(set.v6, prf)
+			}
+		}
+		sets = append(sets, set)
+	}
+
+	return sets, nil
+}
+
+// WriteNftables writes the entries in the [Store] as an nftables script,
+// to be loaded using "nft -f". Each set is split into an IPv4 and an IPv6
+// set with the interval flag, suffixed with "_v4" and "_v6" respectively.
+// The script flushes the sets before adding the aggregated prefixes, so
+// that it can be loaded repeatedly. Output is sorted, and thus stable for
+// the same set of entries.
+func WriteNftables[T any](w io.Writer, s *Store[T], opts ExportOptions[T]) error {
+	table := opts.Table
+	if table == "" {
+		table = "ipstore"
+	}
+	if err := validName(table); err != nil {
+		return err
+	}
+
+	sets, err := opts.sets(s)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintf(bw, "table inet %s {\n", table)
+	for _, set := range sets {
+		fmt.Fprintf(bw, "\tset %s_v4 {\n\t\ttype ipv4_addr\n\t\tflags interval\n\t}\n", set.name)
+		fmt.Fprintf(bw, "\tset %s_v6 {\n\t\ttype ipv6_addr\n\t\tflags interval\n\t}\n", set.name)
+	}
+	fmt.Fprintf(bw, "}\n")
+
+	for _, set := range sets {
+		for _, family := range set.families() {
+			fmt.Fprintf(bw, "flush set inet %s %s%s\n", table, set.name, family.suffix)
+			if len(family.prefixes) == 0 {
+				continue
+			}
+			fmt.Fprintf(bw, "add element inet %s %s%s {\n", table, set.name, family.suffix)
+			for i, prf := range family.prefixes {
+				sep := ","
+				if i == len(family.prefixes)-1 {
+					sep = ""
+				}
+				fmt.Fprintf(bw, "\t%s%s\n", prf, sep)
+			}
+			fmt.Fprintf(bw, "}\n")
+		}
+	}
+
+	return bw.Flush()
+}
+
+// WriteIpset writes the entries in the [Store] in the format read by
+// "ipset restore". Each set is split into an IPv4 and an IPv6 set of type
+// hash:net, suffixed with "_v4" and "_v6" respectively. Sets are created
+// if they don't exist, and flushed before the aggregated prefixes are
+// added. As hash:net sets can't hold zero-length prefixes, these are
+// split in two halves. Output is sorted, and thus stable for the same set
+// of entries.
+func WriteIpset[T any](w io.Writer, s *Store[T], opts ExportOptions[T]) error {
+	sets, err := opts.sets(s)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+
+	for _, set := range sets {
+		fmt.Fprintf(bw, "create %s_v4 hash:net family inet -exist\n", set.name)
+		fmt.Fprintf(bw, "create %s_v6 hash:net family inet6 -exist\n", set.name)
+	}
+
+	for _, set := range sets {
+		for _, family := range set.families() {
+			fmt.Fprintf(bw, "flush %s%s\n", set.name, family.suffix)
+			for _, prf := range family.prefixes {
+				if prf.Bits() == 0 {
+					fmt.Fprintf(bw, "add %s%s %s\n", set.name, family.suffix, netip.PrefixFrom(prf.Addr(), 1))
+					fmt.Fprintf(bw, "add %s%s %s\n", set.name, family.suffix, netip.PrefixFrom(lastAddr(prf), 1).Masked())
+					continue
+				}
+				fmt.Fprintf(bw, "add %s%s %s\n", set.name, family.suffix, prf)
+			}
+		}
+	}
+
+	return bw.Flush()
+}
@@ -0,0 +1,149 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipstore_test
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hslatman/ipstore"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+func golden(t *testing.T, name string, got []byte) {
+	t.Helper()
+
+	path := filepath.Join("testdata", "export", name)
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, expected) {
+		t.Errorf("output does not match %s:\n%s", path, got)
+	}
+}
+
+type rule struct {
+	list  string
+	block bool
+}
+
+func exportStore(t *testing.T) *ipstore.Store[rule] {
+	t.Helper()
+
+	s := ipstore.New[rule]()
+	for ipOrCIDR, r := range map[string]rule{
+		"10.0.0.0/25":     {list: "drop", block: true},
+		"10.0.0.128/25":   {list: "drop", block: true},
+		"10.0.0.5":        {list: "drop", block: true},
+		"192.0.2.1":       {list: "drop", block: true},
+		"198.51.100.0/24": {list: "scanners", block: true},
+		"2001:db8::/48":   {list: "drop", block: true},
+		"2001:db8:1::/48": {list: "drop", block: true},
+		"203.0.113.0/24":  {list: "allow", block: false},
+		"0.0.0.0/0":       {list: "everything", block: false},
+	} {
+		if err := s.AddIPOrCIDR(ipOrCIDR, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return s
+}
+
+func TestWriteNftables(t *testing.T) {
+	s := exportStore(t)
+
+	var buf bytes.Buffer
+	err := ipstore.WriteNftables(&buf, s, ipstore.ExportOptions[rule]{
+		Filter: func(r rule) bool { return r.block },
+		Name:   "blocklist",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden(t, "nftables.golden", buf.Bytes())
+
+	buf.Reset()
+	err = ipstore.WriteNftables(&buf, s, ipstore.ExportOptions[rule]{
+		Filter:  func(r rule) bool { return r.block },
+		SetName: func(r rule) string { return r.list },
+		Table:   "filter",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden(t, "nftables-sets.golden", buf.Bytes())
+}
+
+func TestWriteIpset(t *testing.T) {
+	s := exportStore(t)
+
+	var buf bytes.Buffer
+	err := ipstore.WriteIpset(&buf, s, ipstore.ExportOptions[rule]{
+		Filter: func(r rule) bool { return r.block },
+		Name:   "blocklist",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden(t, "ipset.golden", buf.Bytes())
+
+	buf.Reset()
+	err = ipstore.WriteIpset(&buf, s, ipstore.ExportOptions[rule]{
+		SetName: func(r rule) string { return r.list },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden(t, "ipset-sets.golden", buf.Bytes())
+}
+
+func TestExportInvalidNames(t *testing.T) {
+	s := exportStore(t)
+
+	for _, opts := range []ipstore.ExportOptions[rule]{
+		{Name: "drop; flush ruleset"},
+		{Name: "1drop"},
+		{Table: "filter }"},
+		{SetName: func(r rule) string { return r.list + " x" }},
+		{SetName: func(r rule) string { return "" }},
+	} {
+		var buf bytes.Buffer
+		if err := ipstore.WriteNftables(&buf, s, opts); !errors.Is(err, ipstore.ErrInvalidName) {
+			t.Errorf("expected ErrInvalidName; got %v", err)
+		}
+		if opts.Table != "" {
+			continue // not used for ipset
+		}
+		if err := ipstore.WriteIpset(&buf, s, opts); !errors.Is(err, ipstore.ErrInvalidName) {
+			t.Errorf("expected ErrInvalidName; got %v", err)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("expected no output; got %q", buf.String())
+		}
+	}
+}
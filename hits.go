@@ -0,0 +1,199 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipstore
+
+import (
+	"iter"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// hitClockResolution is the interval at which the time recorded for hits
+// is updated.
+const hitClockResolution = 100 * time.Millisecond
+
+var (
+	hitClockOnce sync.Once
+	// hitClock is the coarse time recorded for hits, in Unix nanoseconds,
+	// so that lookups don't need to read the clock.
+	hitClock atomic.Int64
+)
+
+// startHitClock starts updating hitClock, once per process.
+func startHitClock() {
+	hitClockOnce.Do(func() {
+		hitClock.Store(time.Now().UnixNano())
+		go func() {
+			for t := range time.Tick(hitClockResolution) {
+				hitClock.Store(t.UnixNano())
+			}
+		}()
+	})
+}
+
+// WithHitCounting enables counting how often each entry is returned by
+// lookups by address, such as [Store.GetOne], [Store.Get] and
+// [Store.Contains]. The counts are available from [Store.Stats]. Without
+// this option, lookups don't count hits, at no cost.
+func WithHitCounting() Option {
+	return func(o *options) {
+		o.hits = true
+	}
+}
+
+// HitStats are the statistics for an entry collected when using
+// [WithHitCounting].
+type HitStats struct {
+	// Hits is the number of times the entry was returned by a lookup.
+	Hits uint64
+	// LastHit is the time the entry was last returned by a lookup, or the
+	// zero time when it never was. It's recorded with a resolution of
+	// 100ms.
+	LastHit time.Time
+}
+
+// hitCounter holds the hit counters of the entries in a [Store]. Counters
+// are found without locking once created, and updated atomically, so that
+// lookups don't contend.
+type hitCounter struct {
+	m sync.Map // netip.Prefix -> *hitCount
+}
+
+type hitCount struct {
+	n    atomic.Uint64
+	last atomic.Int64
+}
+
+// newHitCounter returns a new hitCounter, or nil when hits aren't
+// counted.
+func (o options) newHitCounter() *hitCounter {
+	if !o.hits {
+		return nil
+	}
+
+	startHitClock()
+
+	return &hitCounter{}
+}
+
+// hit counts a hit of the entry for the prefix.
+func (c *hitCounter) hit(prf netip.Prefix) {
+	v, ok := c.m.Load(prf)
+	if !ok {
+		v, _ = c.m.LoadOrStore(prf, &hitCount{})
+	}
+
+	hc := v.(*hitCount)
+	hc.n.Add(1)
+	hc.last.Store(hitClock.Load())
+}
+
+// stats returns the statistics of the entry for the prefix.
+func (c *hitCounter) stats(prf netip.Prefix) HitStats {
+	v, ok := c.m.Load(prf)
+	if !ok {
+		return HitStats{}
+	}
+	hc := v.(*hitCount)
+
+	st := HitStats{Hits: hc.n.Load()}
+	// the time of a hit is stored after counting it, so it may still be
+	// missing.
+	if last := hc.last.Load(); last != 0 {
+		st.LastHit = time.Unix(0, last)
+	}
+
+	return st
+}
+
+// remove removes the counter of the entry for the prefix, so that it
+// starts from zero when the entry is added again.
+func (c *hitCounter) remove(prf netip.Prefix) {
+	c.m.Delete(prf)
+}
+
+// reset removes all counters.
+func (c *hitCounter) reset() {
+	c.m.Clear()
+}
+
+// lookupOne returns the most specific entry containing the address,
+// counting a hit when enabled. The read lock must be held.
+func (s *Store[T]) lookupOne(addr netip.Addr) (T, bool) {
+	// addresses with a zone don't match any entry, which a lookup by
+	// prefix wouldn't preserve.
+	if s.hits == nil || addr.Zone() != "" {
+		return s.table.Lookup(addr)
+	}
+
+	lpm, v, ok := s.table.LookupPrefixLPM(netip.PrefixFrom(addr, addr.BitLen()))
+	if ok {
+		s.hits.hit(lpm)
+	}
+
+	return v, ok
+}
+
+// counted returns yield, wrapped to count a hit for every entry yielded
+// when enabled.
+func (s *Store[T]) counted(yield func(netip.Prefix, T) bool) func(netip.Prefix, T) bool {
+	if s.hits == nil {
+		return yield
+	}
+
+	return func(prf netip.Prefix, v T) bool {
+		s.hits.hit(prf)
+		return yield(prf, v)
+	}
+}
+
+// forget removes the hit counter of the entry for the prefix when
+// enabled.
+func (s *Store[T]) forget(prf netip.Prefix) {
+	if s.hits != nil {
+		s.hits.remove(prf.Masked())
+	}
+}
+
+// Stats returns an iterator over the entries in the [Store] together with
+// their hit statistics, including entries that were never hit. It returns
+// no entries when the [Store] wasn't created using [WithHitCounting]. The
+// [Store] is read-locked while iterating, so it must not be modified in
+// the loop.
+func (s *Store[T]) Stats() iter.Seq2[netip.Prefix, HitStats] {
+	return func(yield func(netip.Prefix, HitStats) bool) {
+		if s.hits == nil {
+			return
+		}
+
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+
+		for prf := range s.table.All() {
+			if !yield(prf, s.hits.stats(prf)) {
+				return
+			}
+		}
+	}
+}
+
+// ResetStats resets the hit statistics of all entries in the [Store].
+func (s *Store[T]) ResetStats() {
+	if s.hits != nil {
+		s.hits.reset()
+	}
+}
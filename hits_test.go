@@ -0,0 +1,220 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipstore_test
+
+import (
+	"iter"
+	"maps"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hslatman/ipstore"
+)
+
+// hits returns the number of hits per prefix.
+func hits(seq iter.Seq2[netip.Prefix, ipstore.HitStats]) map[string]uint64 {
+	m := make(map[string]uint64)
+	for prf, st := range seq {
+		m[prf.String()] = st.Hits
+	}
+
+	return m
+}
+
+// counting is implemented by the stores supporting hit counting.
+type counting interface {
+	AddIPOrCIDR(ipOrCIDR string, value string) error
+	RemoveIPOrCIDR(ipOrCIDR string) (string, error)
+	Get(key netip.Addr) ([]string, error)
+	GetOne(key netip.Addr) (string, bool)
+	GetCIDR(key netip.Prefix) ([]string, error)
+	Contains(ip netip.Addr) (bool, error)
+	Stats() iter.Seq2[netip.Prefix, ipstore.HitStats]
+	ResetStats()
+}
+
+func TestHitCounting(t *testing.T) {
+	stores := map[string]func(opts ...ipstore.Option) counting{
+		"Store": func(opts ...ipstore.Option) counting {
+			return ipstore.New[string](opts...)
+		},
+		"ShardedStore": func(opts ...ipstore.Option) counting {
+			return ipstore.NewShardedStore[string](append(opts, ipstore.WithShardBits(16))...)
+		},
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			s := newStore(ipstore.WithHitCounting())
+			for _, cidr := range []string{"0.0.0.0/0", "10.0.0.0/8", "10.1.0.0/16", "192.0.2.0/24"} {
+				if err := s.AddIPOrCIDR(cidr, cidr); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// hits are recorded at a coarse time, which may lag behind.
+			before := time.Now().Add(-time.Second)
+			s.GetOne(netip.MustParseAddr("10.1.2.3"))
+			s.GetOne(netip.MustParseAddr("10.2.0.1"))
+			s.GetOne(netip.MustParseAddr("fe80::1"))
+			if _, err := s.Contains(netip.MustParseAddr("10.1.0.1")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.Get(netip.MustParseAddr("10.1.2.3")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.GetCIDR(netip.MustParsePrefix("10.1.0.0/16")); err != nil {
+				t.Fatal(err)
+			}
+			after := time.Now()
+
+			expected := map[string]uint64{
+				"0.0.0.0/0":    1,
+				"10.0.0.0/8":   2,
+				"10.1.0.0/16":  3,
+				"192.0.2.0/24": 0,
+			}
+			if got := hits(s.Stats()); !maps.Equal(got, expected) {
+				t.Errorf("expected %v; got %v", expected, got)
+			}
+			for prf, st := range s.Stats() {
+				if st.Hits == 0 && !st.LastHit.IsZero() {
+					t.Errorf("%s: expected no last hit; got %s", prf, st.LastHit)
+				}
+				if st.Hits > 0 && (st.LastHit.Before(before) || st.LastHit.After(after)) {
+					t.Errorf("%s: expected last hit between %s and %s; got %s", prf, before, after, st.LastHit)
+				}
+			}
+
+			if _, err := s.RemoveIPOrCIDR("10.0.0.0/8"); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.AddIPOrCIDR("10.0.0.0/8", "again"); err != nil {
+				t.Fatal(err)
+			}
+			if n := hits(s.Stats())["10.0.0.0/8"]; n != 0 {
+				t.Errorf("expected the hits of a removed entry to be reset; got %d", n)
+			}
+
+			s.ResetStats()
+			for prf, st := range s.Stats() {
+				if st != (ipstore.HitStats{}) {
+					t.Errorf("%s: expected no hits after reset; got %v", prf, st)
+				}
+			}
+
+			s = newStore()
+			if err := s.AddIPOrCIDR("10.0.0.0/8", "private"); err != nil {
+				t.Fatal(err)
+			}
+			s.GetOne(netip.MustParseAddr("10.1.2.3"))
+			if got := hits(s.Stats()); len(got) != 0 {
+				t.Errorf("expected no stats without hit counting; got %v", got)
+			}
+		})
+	}
+}
+
+func TestHitCountingMatches(t *testing.T) {
+	s := ipstore.New[string](ipstore.WithHitCounting())
+	for _, cidr := range []string{"10.0.0.0/8", "10.1.0.0/16"} {
+		if err := s.AddIPOrCIDR(cidr, cidr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ip := netip.MustParseAddr("10.1.2.3")
+	s.GetInto(ip, nil)
+	for range s.Matches(ip) {
+		break
+	}
+	out := make([]ipstore.Result[string], 1)
+	s.LookupBatch([]netip.Addr{ip}, out)
+
+	expected := map[string]uint64{"10.0.0.0/8": 1, "10.1.0.0/16": 3}
+	if got := hits(s.Stats()); !maps.Equal(got, expected) {
+		t.Errorf("expected %v; got %v", expected, got)
+	}
+}
+
+func TestHitCountingClone(t *testing.T) {
+	s := ipstore.New[string](ipstore.WithHitCounting())
+	if err := s.AddIPOrCIDR("10.0.0.0/8", "private"); err != nil {
+		t.Fatal(err)
+	}
+	s.GetOne(netip.MustParseAddr("10.1.2.3"))
+
+	c := s.Clone()
+	c.GetOne(netip.MustParseAddr("10.1.2.3"))
+	c.GetOne(netip.MustParseAddr("10.1.2.3"))
+
+	if n := hits(s.Stats())["10.0.0.0/8"]; n != 1 {
+		t.Errorf("expected 1 hit; got %d", n)
+	}
+	if n := hits(c.Stats())["10.0.0.0/8"]; n != 2 {
+		t.Errorf("expected 2 hits for the clone; got %d", n)
+	}
+}
+
+func TestHitCountingConcurrent(t *testing.T) {
+	s := ipstore.New[int](ipstore.WithHitCounting())
+	if err := s.AddIPOrCIDR("10.0.0.0/8", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for w := range 8 {
+		wg.Go(func() {
+			for i := range 1000 {
+				s.GetOne(netip.AddrFrom4([4]byte{10, byte(w), byte(i >> 8), byte(i)}))
+				if i%100 == 0 {
+					for range s.Stats() {
+					}
+				}
+			}
+		})
+	}
+	wg.Wait()
+
+	if n := hits(s.Stats())["10.0.0.0/8"]; n != 8000 {
+		t.Errorf("expected 8000 hits; got %d", n)
+	}
+}
+
+func BenchmarkHitCounting(b *testing.B) {
+	for name, opts := range map[string][]ipstore.Option{
+		"Disabled": nil,
+		"Enabled":  {ipstore.WithHitCounting()},
+	} {
+		b.Run(name, func(b *testing.B) {
+			s := ipstore.New[string](opts...)
+			ips, _ := hosts(b, "192.168.0.1/24")
+			for _, ip := range ips {
+				s.Add(ip, ip.String())
+			}
+
+			b.ReportAllocs()
+			for b.Loop() {
+				for _, ip := range ips {
+					s.GetOne(ip)
+				}
+			}
+
+			assertNoAllocs(b, func() { s.GetOne(ips[0]) })
+		})
+	}
+}
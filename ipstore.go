@@ -18,29 +18,65 @@ import (
 	"iter"
 	"net/netip"
 	"sync"
-
-	"github.com/gaissmai/bart"
 )
 
 // Store is a simple Key/Value store using IPs and CIDRs as keys.
 type Store[T any] struct {
-	mu    sync.RWMutex
-	table *bart.Table[T]
-	zero  T
+	mu         sync.RWMutex
+	table      Backend[T]
+	newBackend func() Backend[T]
+	opts       options
+	hits       *hitCounter
+	zero       T
+}
+
+// Option configures a [Store].
+type Option func(*options)
+
+type options struct {
+	backend  BackendType
+	unmap    bool
+	zones    ZonePolicy
+	prefixes PrefixPolicy
+	hits     bool
+	// shardBits is only used by [ShardedStore].
+	shardBits int
 }
 
 // New returns a new instance of [Store].
-func New[T any]() *Store[T] {
+func New[T any](opts ...Option) *Store[T] {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return NewWithBackend(func() Backend[T] {
+		return NewBackend[T](o.backend)
+	}, opts...)
+}
+
+// NewWithBackend returns a new instance of [Store] using a custom
+// [Backend]. The function provided is called whenever the [Store] needs a
+// new, empty [Backend]. The [WithBackend] option is ignored.
+func NewWithBackend[T any](newBackend func() Backend[T], opts ...Option) *Store[T] {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	return &Store[T]{
-		mu:    sync.RWMutex{},
-		table: new(bart.Table[T]),
-		zero:  zero[T](),
+		mu:         sync.RWMutex{},
+		table:      newBackend(),
+		newBackend: newBackend,
+		opts:       o,
+		hits:       o.newHitCounter(),
+		zero:       zero[T](),
 	}
 }
 
 // Add adds a new entry to the store mapped by [netip.Addr].
 func (s *Store[T]) Add(key netip.Addr, value T) error {
-	prf, err := key.Prefix(key.BitLen())
+	prf, err := s.opts.addrPrefix(key)
 	if err != nil {
 		return err
 	}
@@ -50,6 +86,11 @@ func (s *Store[T]) Add(key netip.Addr, value T) error {
 
 // AddCIDR adds a new entry to the store mapped by [netip.Prefix].
 func (s *Store[T]) AddCIDR(key netip.Prefix, value T) error {
+	key, _, err := s.opts.canonical(key)
+	if err != nil {
+		return err
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -58,9 +99,37 @@ func (s *Store[T]) AddCIDR(key netip.Prefix, value T) error {
 	return nil
 }
 
+// AddReport describes the entry added by [Store.AddCIDRReport].
+type AddReport struct {
+	// Prefix is the prefix the entry is stored by.
+	Prefix netip.Prefix
+	// Masked is true when the prefix provided had host bits set, which
+	// were cleared.
+	Masked bool
+	// Replaced is true when the entry replaced an existing entry.
+	Replaced bool
+}
+
+// AddCIDRReport adds a new entry to the store mapped by [netip.Prefix],
+// like [Store.AddCIDR], and reports how it was stored.
+func (s *Store[T]) AddCIDRReport(key netip.Prefix, value T) (AddReport, error) {
+	key, masked, err := s.opts.canonical(key)
+	if err != nil {
+		return AddReport{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, replaced := s.table.Get(key)
+	s.table.Insert(key, value)
+
+	return AddReport{Prefix: key, Masked: masked, Replaced: replaced}, nil
+}
+
 // AddIPOrCIDR adds a new entry to the [Store] mapped by an IP or CIDR.
 func (s *Store[T]) AddIPOrCIDR(ipOrCIDR string, value T) error {
-	prf, err := parsePrefix(ipOrCIDR)
+	prf, err := s.opts.parsePrefix(ipOrCIDR)
 	if err != nil {
 		return err
 	}
@@ -68,9 +137,48 @@ func (s *Store[T]) AddIPOrCIDR(ipOrCIDR string, value T) error {
 	return s.AddCIDR(prf, value)
 }
 
+// AddMerge adds a new entry to the store mapped by [netip.Prefix]. When
+// an entry for the prefix exists, the value stored is the result of
+// calling merge with the existing and the new value instead.
+func (s *Store[T]) AddMerge(key netip.Prefix, value T, merge func(old, new T) T) error {
+	key, _, err := s.opts.canonical(key)
+	if err != nil {
+		return err
+	}
+
+	s.modify(key, func(old T, ok bool) (T, bool) {
+		if ok {
+			return merge(old, value), false
+		}
+		return value, false
+	})
+
+	return nil
+}
+
+// modify calls fn with the value of the entry for the prefix, and whether
+// it exists, while holding the write lock. The entry is set to the value
+// fn returns, or removed when fn returns true.
+func (s *Store[T]) modify(key netip.Prefix, fn func(old T, ok bool) (_ T, del bool)) {
+	key = s.opts.prefix(key)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok := s.table.Get(key)
+	v, del := fn(old, ok)
+	switch {
+	case del && ok:
+		s.table.Delete(key)
+		s.forget(key)
+	case !del:
+		s.table.Insert(key, v)
+	}
+}
+
 // Remove removes the entry associated with [netip.Addr] from [Store].
 func (s *Store[T]) Remove(key netip.Addr) (T, error) {
-	prf, err := key.Prefix(key.BitLen())
+	prf, err := s.opts.addrPrefix(key)
 	if err != nil {
 		return s.zero, err
 	}
@@ -80,28 +188,26 @@ func (s *Store[T]) Remove(key netip.Addr) (T, error) {
 
 // RemoveCIDR removes the entry associated with [netip.Prefix] from [Store].
 func (s *Store[T]) RemoveCIDR(key netip.Prefix) (T, error) {
+	key, _, err := s.opts.canonical(key)
+	if err != nil {
+		return s.zero, err
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	var oldVal T
-	var ok bool
-
-	s.table.Modify(key, func(v T, found bool) (_ T, del bool) {
-		oldVal = v
-		ok = found
-		return s.zero, true
-	})
-
+	oldVal, ok := s.table.Delete(key)
 	if !ok {
 		return s.zero, nil
 	}
+	s.forget(key)
 
 	return oldVal, nil
 }
 
 // RemoveIPOrCIDR removes the entry associated with an IP or CIDR from [Store].
 func (s *Store[T]) RemoveIPOrCIDR(ipOrCIDR string) (T, error) {
-	prf, err := parsePrefix(ipOrCIDR)
+	prf, err := s.opts.parsePrefix(ipOrCIDR)
 	if err != nil {
 		return s.zero, err
 	}
@@ -111,14 +217,30 @@ func (s *Store[T]) RemoveIPOrCIDR(ipOrCIDR string) (T, error) {
 
 // Contains returns whether an entry is available for the [netip.Addr].
 func (s *Store[T]) Contains(ip netip.Addr) (bool, error) {
+	ip, err := s.opts.addr(ip)
+	if err != nil {
+		return false, err
+	}
+
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	_, ok := s.table.Lookup(ip)
+	_, ok := s.lookupOne(ip)
 
 	return ok, nil
 }
 
+// Load adds all entries in the sequence to the [Store].
+func (s *Store[T]) Load(seq iter.Seq2[netip.Prefix, T]) error {
+	for prf, v := range seq {
+		if err := s.AddCIDR(prf, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // All returns an iterator over all prefix–value pairs in the table.
 func (s *Store[T]) All() iter.Seq2[netip.Prefix, T] {
 	s.mu.RLock()
@@ -134,32 +256,102 @@ func (s *Store[T]) Get(key netip.Addr) ([]T, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	prf, err := key.Prefix(key.BitLen())
+	prf, ok, err := s.opts.lookupPrefix(key)
 	if err != nil {
 		return nil, err
 	}
 
 	var result = make([]T, 0, 5)
+	if !ok {
+		return result, nil
+	}
 	supernets := s.table.Supernets(prf)
-	supernets(func(p netip.Prefix, t T) bool {
+	supernets(s.counted(func(p netip.Prefix, t T) bool {
 		result = append(result, t)
 		return true
-	})
+	}))
 
 	return result, nil
 }
 
+// GetInto returns entries from the [Store] based on the [netip.Addr] key,
+// like [Store.Get], reusing the storage of dst for the result. It doesn't
+// allocate when dst has enough capacity for all entries.
+func (s *Store[T]) GetInto(key netip.Addr, dst []T) []T {
+	dst = dst[:0]
+	for _, v := range s.Matches(key) {
+		dst = append(dst, v)
+	}
+
+	return dst
+}
+
+// Matches returns an iterator over the entries in the [Store] containing
+// the [netip.Addr] key, together with the prefixes they're stored by.
+// Entries are returned most specific first. Unlike [Store.Supernets], it
+// doesn't allocate. The [Store] is read-locked while iterating, so it must
+// not be modified in the loop.
+func (s *Store[T]) Matches(key netip.Addr) iter.Seq2[netip.Prefix, T] {
+	return func(yield func(netip.Prefix, T) bool) {
+		s.matches(key, yield)
+	}
+}
+
+// matches yields the entries containing the key, most specific first.
+func (s *Store[T]) matches(key netip.Addr, yield func(netip.Prefix, T) bool) {
+	prf, ok, _ := s.opts.lookupPrefix(key)
+	if !ok {
+		return
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	walkMatches(s.table, prf, s.hits, yield)
+}
+
+// walkMatches yields the entries in the table containing the prefix, most
+// specific first, by repeatedly looking up the most specific entry
+// containing the prefix one bit shorter than the previous entry found. A
+// hit is counted for every entry yielded when hits isn't nil. It returns
+// false when yield returned false.
+func walkMatches[T any](table Backend[T], prf netip.Prefix, hits *hitCounter, yield func(netip.Prefix, T) bool) bool {
+	for {
+		lpm, v, ok := table.LookupPrefixLPM(prf)
+		if !ok {
+			return true
+		}
+		if hits != nil {
+			hits.hit(lpm)
+		}
+		if !yield(lpm, v) {
+			return false
+		}
+		if lpm.Bits() == 0 {
+			return true
+		}
+		prf = netip.PrefixFrom(lpm.Addr(), lpm.Bits()-1)
+	}
+}
+
 // GetOne returns a single entry from the [Store] based on the
 // [netip.Addr] key.
 func (s *Store[T]) GetOne(key netip.Addr) (T, bool) {
+	key, err := s.opts.addr(key)
+	if err != nil {
+		return s.zero, false
+	}
+
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	return s.table.Lookup(key)
+	return s.lookupOne(key)
 }
 
 // GetCIDR returns entries from the [Store] by [netip.Prefix].
 func (s *Store[T]) GetCIDR(key netip.Prefix) ([]T, error) {
+	key = s.opts.prefix(key)
+
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
@@ -173,8 +365,51 @@ func (s *Store[T]) GetCIDR(key netip.Prefix) ([]T, error) {
 	return result, nil
 }
 
+// Supernets returns an iterator over the entries in the [Store]
+// containing the [netip.Prefix] key, together with the prefixes they're
+// stored by. Entries are returned most specific first. The [Store] is
+// read-locked while iterating, so it must not be modified in the loop.
+func (s *Store[T]) Supernets(key netip.Prefix) iter.Seq2[netip.Prefix, T] {
+	key = s.opts.prefix(key)
+
+	return func(yield func(netip.Prefix, T) bool) {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+
+		s.table.Supernets(key)(yield)
+	}
+}
+
+// Subnets returns an iterator over the entries in the [Store] contained
+// in the [netip.Prefix] key, including the entry for the key itself,
+// together with the prefixes they're stored by. The [Store] is
+// read-locked while iterating, so it must not be modified in the loop.
+func (s *Store[T]) Subnets(key netip.Prefix) iter.Seq2[netip.Prefix, T] {
+	key = s.opts.prefix(key)
+
+	return func(yield func(netip.Prefix, T) bool) {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+
+		s.table.Subnets(key)(yield)
+	}
+}
+
+// GetExactCIDR returns the entry stored by exactly the [netip.Prefix]
+// key, without falling back to entries containing it.
+func (s *Store[T]) GetExactCIDR(key netip.Prefix) (T, bool) {
+	key = s.opts.prefix(key).Masked()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.table.Get(key)
+}
+
 // GetOneCIDR returns a single entry from the [Store] by [netip.Prefix].
 func (s *Store[T]) GetOneCIDR(key netip.Prefix) (T, bool) {
+	key = s.opts.prefix(key)
+
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
@@ -183,18 +418,21 @@ func (s *Store[T]) GetOneCIDR(key netip.Prefix) (T, bool) {
 
 // GetIPOrCIDR returns entries from the [Store] by IP or CIDR.
 func (s *Store[T]) GetIPOrCIDR(ipOrCIDR string) ([]T, error) {
-	prf, err := parsePrefix(ipOrCIDR)
+	prf, ok, err := s.opts.parseLookup(ipOrCIDR)
 	if err != nil {
 		return nil, err
 	}
+	if !ok {
+		return make([]T, 0), nil
+	}
 
 	return s.GetCIDR(prf)
 }
 
 // GetIPOrCIDR returns entries from the [Store] by IP or CIDR.
 func (s *Store[T]) GetOneIPOrCIDR(ipOrCIDR string) (T, bool) {
-	prf, err := parsePrefix(ipOrCIDR)
-	if err != nil {
+	prf, ok, _ := s.opts.parseLookup(ipOrCIDR)
+	if !ok {
 		return s.zero, false
 	}
 
@@ -19,6 +19,7 @@ import (
 	"math/rand"
 	"net"
 	"net/netip"
+	"slices"
 	"sync"
 	"testing"
 
@@ -518,6 +519,92 @@ func TestDuplicateInsertion(t *testing.T) {
 	}
 }
 
+func TestAddMerge(t *testing.T) {
+	s := ipstore.New[int]()
+	prf := netip.MustParsePrefix("10.0.0.0/8")
+	sum := func(old, new int) int { return old + new }
+
+	for _, v := range []int{1, 2, 3} {
+		if err := s.AddMerge(prf, v, sum); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if v, _ := s.GetOneCIDR(prf); v != 6 {
+		t.Errorf("expected 6; got %d", v)
+	}
+}
+
+func TestGetInto(t *testing.T) {
+	s := ipstore.New[string]()
+	for _, cidr := range []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "0.0.0.0/0", "192.0.2.0/24"} {
+		if err := s.AddIPOrCIDR(cidr, cidr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ip := netip.MustParseAddr("10.1.2.3")
+
+	expected, err := s.Get(ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := []string{"stale", "values", "to", "overwrite", "here"}
+	got := s.GetInto(ip, dst)
+	if !slices.Equal(got, expected) {
+		t.Errorf("expected %v; got %v", expected, got)
+	}
+	if &got[0] != &dst[0] {
+		t.Error("expected the storage of dst to be reused")
+	}
+
+	var prefixes []string
+	for p, v := range s.Matches(ip) {
+		if p.String() != v {
+			t.Errorf("expected prefix %s for value %s", p, v)
+		}
+		prefixes = append(prefixes, v)
+		if len(prefixes) == 2 {
+			break
+		}
+	}
+	if !slices.Equal(prefixes, expected[:2]) {
+		t.Errorf("expected %v; got %v", expected[:2], prefixes)
+	}
+
+	if got := s.GetInto(netip.MustParseAddr("2001:db8::1"), nil); len(got) != 0 {
+		t.Errorf("expected no values; got %v", got)
+	}
+}
+
+func TestLookupAllocs(t *testing.T) {
+	for _, b := range backends {
+		s := ipstore.New[string](ipstore.WithBackend(b))
+		for _, cidr := range []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24"} {
+			if err := s.AddIPOrCIDR(cidr, cidr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ip := netip.MustParseAddr("10.1.2.3")
+		prf := netip.MustParsePrefix("10.1.2.0/28")
+		dst := make([]string, 0, 3)
+
+		for name, fn := range map[string]func(){
+			"GetOne":     func() { s.GetOne(ip) },
+			"GetOneCIDR": func() { s.GetOneCIDR(prf) },
+			"Contains":   func() { s.Contains(ip) },
+			"GetInto":    func() { dst = s.GetInto(ip, dst) },
+			"Matches": func() {
+				for range s.Matches(ip) {
+				}
+			},
+		} {
+			if allocs := testing.AllocsPerRun(100, fn); allocs != 0 {
+				t.Errorf("%s: %s: expected 0 allocs/op; got %v", b, name, allocs)
+			}
+		}
+	}
+}
+
 func TestIPOrCIDR(t *testing.T) {
 	s := ipstore.New[string]()
 	ip1 := "127.0.0.1"
@@ -740,6 +827,120 @@ func TestAll(t *testing.T) {
 	}
 }
 
+func TestLoad(t *testing.T) {
+	n := ipstore.New[string]()
+	entries := map[netip.Prefix]string{
+		netip.MustParsePrefix("127.0.0.1/32"): "127.0.0.1",
+		netip.MustParsePrefix("10.0.0.0/8"):   "10.0.0.0/8",
+	}
+
+	err := n.Load(maps.All(entries))
+	if err != nil {
+		t.Error(err)
+	}
+
+	if n.Len() != 2 {
+		t.Errorf("expected 2 entries; got %d entries", n.Len())
+	}
+
+	v, ok := n.GetOne(netip.MustParseAddr("10.1.1.1"))
+	if !ok {
+		t.Error("expected 10.1.1.1 to be in store")
+	}
+	if v != "10.0.0.0/8" {
+		t.Errorf("expected %q; got %q", "10.0.0.0/8", v)
+	}
+}
+
+func TestGetExactCIDR(t *testing.T) {
+	stores := map[string]interface {
+		AddIPOrCIDR(ipOrCIDR string, value string) error
+		GetExactCIDR(key netip.Prefix) (string, bool)
+	}{
+		"Store":        ipstore.New[string](),
+		"ShardedStore": ipstore.NewShardedStore[string](ipstore.WithShardBits(16)),
+	}
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			for _, cidr := range []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24"} {
+				if err := s.AddIPOrCIDR(cidr, cidr); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			tests := []struct {
+				prefix   string
+				expected string
+				ok       bool
+			}{
+				{"10.0.0.0/8", "10.0.0.0/8", true},
+				{"10.1.2.0/24", "10.1.2.0/24", true},
+				{"10.1.2.3/24", "10.1.2.0/24", true},
+				{"10.1.2.0/25", "", false},
+				{"10.2.0.0/16", "", false},
+				{"0.0.0.0/0", "", false},
+			}
+			for _, tc := range tests {
+				v, ok := s.GetExactCIDR(netip.MustParsePrefix(tc.prefix))
+				if v != tc.expected || ok != tc.ok {
+					t.Errorf("GetExactCIDR(%s): expected %q, %t; got %q, %t", tc.prefix, tc.expected, tc.ok, v, ok)
+				}
+			}
+		})
+	}
+}
+
+func TestSupernets(t *testing.T) {
+	n := ipstore.New[string]()
+	for _, cidr := range []string{"127.0.0.1/32", "127.0.0.0/24", "127.0.0.0/8", "10.0.0.0/8"} {
+		err := n.AddIPOrCIDR(cidr, cidr)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	var prefixes []netip.Prefix
+	for p, v := range n.Supernets(netip.MustParsePrefix("127.0.0.1/32")) {
+		if p.String() != v {
+			t.Errorf("expected prefix %s to match value %q", p, v)
+		}
+		prefixes = append(prefixes, p)
+	}
+
+	if len(prefixes) != 3 {
+		t.Fatalf("expected 3 results; got %d", len(prefixes))
+	}
+	if prefixes[0] != netip.MustParsePrefix("127.0.0.1/32") {
+		t.Errorf("expected most specific prefix first; got %s", prefixes[0])
+	}
+	if prefixes[2] != netip.MustParsePrefix("127.0.0.0/8") {
+		t.Errorf("expected least specific prefix last; got %s", prefixes[2])
+	}
+}
+
+func TestSubnets(t *testing.T) {
+	n := ipstore.New[string]()
+	for _, cidr := range []string{"127.0.0.1/32", "127.0.0.0/24", "127.0.0.0/8", "10.0.0.0/8"} {
+		err := n.AddIPOrCIDR(cidr, cidr)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	m := maps.Collect(n.Subnets(netip.MustParsePrefix("127.0.0.0/16")))
+	if len(m) != 2 {
+		t.Fatalf("expected 2 results; got %d", len(m))
+	}
+	if _, ok := m[netip.MustParsePrefix("127.0.0.0/24")]; !ok {
+		t.Error("expected 127.0.0.0/24 to be returned")
+	}
+
+	m = maps.Collect(n.Subnets(netip.MustParsePrefix("127.0.0.0/8")))
+	if len(m) != 3 {
+		t.Errorf("expected 3 results; got %d", len(m))
+	}
+}
+
 func BenchmarkInsertions24Bits(b *testing.B) {
 	s := ipstore.New[string]()
 	ips, _ := hosts(b, "192.168.0.1/24")
@@ -794,6 +995,79 @@ func BenchmarkRetrievals16Bits(b *testing.B) {
 	}
 }
 
+func BenchmarkRetrievalsGetInto24Bits(b *testing.B) {
+	s := ipstore.New[string]()
+	ips, _ := hosts(b, "192.168.0.1/24")
+
+	for _, ip := range ips {
+		s.Add(ip, ip.String())
+	}
+	s.AddIPOrCIDR("192.168.0.0/16", "network")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	dst := make([]string, 0, 5)
+	for n := 0; n < b.N; n++ {
+		for _, ip := range ips {
+			dst = s.GetInto(ip, dst)
+		}
+	}
+
+	assertNoAllocs(b, func() { dst = s.GetInto(ips[0], dst) })
+}
+
+func BenchmarkRetrievalsMatches24Bits(b *testing.B) {
+	s := ipstore.New[string]()
+	ips, _ := hosts(b, "192.168.0.1/24")
+
+	for _, ip := range ips {
+		s.Add(ip, ip.String())
+	}
+	s.AddIPOrCIDR("192.168.0.0/16", "network")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, ip := range ips {
+			for range s.Matches(ip) {
+			}
+		}
+	}
+
+	assertNoAllocs(b, func() {
+		for range s.Matches(ips[0]) {
+		}
+	})
+}
+
+func BenchmarkRetrievalsGetOne24Bits(b *testing.B) {
+	s := ipstore.New[string]()
+	ips, _ := hosts(b, "192.168.0.1/24")
+
+	for _, ip := range ips {
+		s.Add(ip, ip.String())
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, ip := range ips {
+			s.GetOne(ip)
+		}
+	}
+
+	assertNoAllocs(b, func() { s.GetOne(ips[0]) })
+}
+
+// assertNoAllocs fails when fn allocates.
+func assertNoAllocs(tb testing.TB, fn func()) {
+	tb.Helper()
+
+	if allocs := testing.AllocsPerRun(100, fn); allocs != 0 {
+		tb.Errorf("expected 0 allocs/op; got %v", allocs)
+	}
+}
+
 func BenchmarkDeletes24Bits(b *testing.B) {
 	s := ipstore.New[string]()
 	ips, _ := hosts(b, "192.168.0.0/24")
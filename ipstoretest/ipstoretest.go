@@ -0,0 +1,387 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ipstoretest provides conformance tests for implementations of
+// [ipstore.Reader] and [ipstore.Writer], verifying they behave like
+// [ipstore.Store].
+//
+// Implementations run the tests from their own tests:
+//
+//	func TestConformance(t *testing.T) {
+//		ipstoretest.RunReader(t, func(t *testing.T, entries []ipstoretest.Entry) ipstore.Reader[string] {
+//			return newReader(entries)
+//		})
+//	}
+package ipstoretest
+
+import (
+	"cmp"
+	"errors"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/hslatman/ipstore"
+)
+
+// Entry is an entry to add to the store under test.
+type Entry struct {
+	Prefix netip.Prefix
+	Value  string
+}
+
+// NewReaderFunc returns a new [ipstore.Reader] holding the entries.
+type NewReaderFunc func(t *testing.T, entries []Entry) ipstore.Reader[string]
+
+// NewWriterFunc returns a new, empty [ipstore.Writer], together with an
+// [ipstore.Reader] observing the entries written to it.
+type NewWriterFunc func(t *testing.T) (ipstore.Writer[string], ipstore.Reader[string])
+
+// Entries are the entries the [ipstore.Reader] is tested with: nested
+// IPv4 and IPv6 prefixes, single addresses and default routes.
+var Entries = []Entry{
+	{netip.MustParsePrefix("0.0.0.0/0"), "default4"},
+	{netip.MustParsePrefix("10.0.0.0/8"), "10/8"},
+	{netip.MustParsePrefix("10.1.0.0/16"), "10.1/16"},
+	{netip.MustParsePrefix("10.1.2.0/24"), "10.1.2/24"},
+	{netip.MustParsePrefix("10.1.2.3/32"), "10.1.2.3"},
+	{netip.MustParsePrefix("10.2.0.0/16"), "10.2/16"},
+	{netip.MustParsePrefix("192.0.2.0/24"), "doc4"},
+	{netip.MustParsePrefix("192.0.2.128/25"), "doc4-high"},
+	{netip.MustParsePrefix("2001:db8::/32"), "doc6"},
+	{netip.MustParsePrefix("2001:db8:1::/48"), "doc6-1"},
+	{netip.MustParsePrefix("2001:db8:1::1/128"), "doc6-1-host"},
+	{netip.MustParsePrefix("fe80::/10"), "link-local"},
+}
+
+// RunReader runs the conformance tests for an [ipstore.Reader].
+func RunReader(t *testing.T, newReader NewReaderFunc) {
+	t.Run("Len", func(t *testing.T) {
+		if n := newReader(t, nil).Len(); n != 0 {
+			t.Errorf("expected 0 entries; got %d", n)
+		}
+		if n := newReader(t, Entries).Len(); n != len(Entries) {
+			t.Errorf("expected %d entries; got %d", len(Entries), n)
+		}
+	})
+
+	t.Run("GetOne", func(t *testing.T) {
+		r := newReader(t, Entries)
+		for _, tc := range []struct {
+			ip       string
+			expected string
+			ok       bool
+		}{
+			{"10.1.2.3", "10.1.2.3", true},
+			{"10.1.2.4", "10.1.2/24", true},
+			{"10.1.3.1", "10.1/16", true},
+			{"10.3.0.1", "10/8", true},
+			{"10.255.255.255", "10/8", true},
+			{"11.0.0.0", "default4", true},
+			{"192.0.2.127", "doc4", true},
+			{"192.0.2.128", "doc4-high", true},
+			{"2001:db8:1::1", "doc6-1-host", true},
+			{"2001:db8:1::2", "doc6-1", true},
+			{"2001:db8:2::1", "doc6", true},
+			{"fe80::1", "link-local", true},
+			{"2001:db9::1", "", false},
+			{"::ffff:10.1.2.3", "", false},
+		} {
+			ip := netip.MustParseAddr(tc.ip)
+			v, ok := r.GetOne(ip)
+			if v != tc.expected || ok != tc.ok {
+				t.Errorf("GetOne(%s): expected %q, %t; got %q, %t", ip, tc.expected, tc.ok, v, ok)
+			}
+			contains, err := r.Contains(ip)
+			if err != nil {
+				t.Errorf("Contains(%s): %v", ip, err)
+			}
+			if contains != tc.ok {
+				t.Errorf("Contains(%s): expected %t; got %t", ip, tc.ok, contains)
+			}
+			v, ok = r.GetOneIPOrCIDR(tc.ip)
+			if v != tc.expected || ok != tc.ok {
+				t.Errorf("GetOneIPOrCIDR(%s): expected %q, %t; got %q, %t", ip, tc.expected, tc.ok, v, ok)
+			}
+		}
+
+		if _, ok := newReader(t, nil).GetOne(netip.MustParseAddr("10.0.0.1")); ok {
+			t.Error("expected no match in empty store")
+		}
+	})
+
+	t.Run("Get", func(t *testing.T) {
+		r := newReader(t, Entries)
+		for _, tc := range []struct {
+			ip       string
+			expected []string
+		}{
+			{"10.1.2.3", []string{"10.1.2.3", "10.1.2/24", "10.1/16", "10/8", "default4"}},
+			{"10.2.0.1", []string{"10.2/16", "10/8", "default4"}},
+			{"2001:db8:1::1", []string{"doc6-1-host", "doc6-1", "doc6"}},
+			{"2001:db9::1", []string{}},
+		} {
+			ip := netip.MustParseAddr(tc.ip)
+			vs, err := r.Get(ip)
+			if err != nil {
+				t.Errorf("Get(%s): %v", ip, err)
+			}
+			if !slices.Equal(vs, tc.expected) {
+				t.Errorf("Get(%s): expected %q; got %q", ip, tc.expected, vs)
+			}
+			vs, err = r.GetIPOrCIDR(tc.ip)
+			if err != nil {
+				t.Errorf("GetIPOrCIDR(%s): %v", ip, err)
+			}
+			if !slices.Equal(vs, tc.expected) {
+				t.Errorf("GetIPOrCIDR(%s): expected %q; got %q", ip, tc.expected, vs)
+			}
+		}
+	})
+
+	t.Run("GetCIDR", func(t *testing.T) {
+		r := newReader(t, Entries)
+		for _, tc := range []struct {
+			cidr     string
+			expected []string
+		}{
+			{"10.1.2.0/24", []string{"10.1.2/24", "10.1/16", "10/8", "default4"}},
+			{"10.1.2.0/23", []string{"10.1/16", "10/8", "default4"}},
+			{"10.1.2.3/8", []string{"10/8", "default4"}},
+			{"0.0.0.0/0", []string{"default4"}},
+			{"2001:db8::/31", []string{}},
+			{"2001:db8:1::/64", []string{"doc6-1", "doc6"}},
+		} {
+			prf := netip.MustParsePrefix(tc.cidr)
+			vs, err := r.GetCIDR(prf)
+			if err != nil {
+				t.Errorf("GetCIDR(%s): %v", prf, err)
+			}
+			if !slices.Equal(vs, tc.expected) {
+				t.Errorf("GetCIDR(%s): expected %q; got %q", prf, tc.expected, vs)
+			}
+
+			v, ok := r.GetOneCIDR(prf)
+			if len(tc.expected) == 0 {
+				if ok {
+					t.Errorf("GetOneCIDR(%s): expected no match; got %q", prf, v)
+				}
+			} else if !ok || v != tc.expected[0] {
+				t.Errorf("GetOneCIDR(%s): expected %q; got %q, %t", prf, tc.expected[0], v, ok)
+			}
+		}
+	})
+
+	t.Run("InvalidIPOrCIDR", func(t *testing.T) {
+		r := newReader(t, Entries)
+		for _, s := range []string{"", "invalid", "10.0.0.0/33", "10.0.0.256"} {
+			if _, err := r.GetIPOrCIDR(s); err == nil {
+				t.Errorf("GetIPOrCIDR(%q): expected error", s)
+			}
+			if _, ok := r.GetOneIPOrCIDR(s); ok {
+				t.Errorf("GetOneIPOrCIDR(%q): expected no match", s)
+			}
+		}
+	})
+
+	t.Run("Supernets", func(t *testing.T) {
+		r := newReader(t, Entries)
+		got := collect(r.Supernets(netip.MustParsePrefix("10.1.2.0/24")))
+		expected := []Entry{Entries[3], Entries[2], Entries[1], Entries[0]}
+		if !slices.Equal(got, expected) {
+			t.Errorf("expected supernets %v, most specific first; got %v", expected, got)
+		}
+	})
+
+	t.Run("Subnets", func(t *testing.T) {
+		r := newReader(t, Entries)
+		for _, tc := range []struct {
+			cidr     string
+			expected []Entry
+		}{
+			{"10.0.0.0/8", Entries[1:6]},
+			{"10.1.0.0/15", Entries[2:5]},
+			{"192.0.2.0/24", Entries[6:8]},
+			{"2001:db8::/16", Entries[8:11]},
+			{"172.16.0.0/12", nil},
+		} {
+			prf := netip.MustParsePrefix(tc.cidr)
+			got := sorted(collect(r.Subnets(prf)))
+			if !slices.Equal(got, tc.expected) {
+				t.Errorf("Subnets(%s): expected %v; got %v", prf, tc.expected, got)
+			}
+		}
+	})
+
+	t.Run("All", func(t *testing.T) {
+		got := sorted(collect(newReader(t, Entries).All()))
+		if !slices.Equal(got, Entries) {
+			t.Errorf("expected %v; got %v", Entries, got)
+		}
+		if got := collect(newReader(t, nil).All()); len(got) != 0 {
+			t.Errorf("expected no entries; got %v", got)
+		}
+	})
+
+	t.Run("Break", func(t *testing.T) {
+		r := newReader(t, Entries)
+		for name, seq := range map[string]func(func(netip.Prefix, string) bool){
+			"All":       r.All(),
+			"Supernets": r.Supernets(netip.MustParsePrefix("10.1.2.3/32")),
+			"Subnets":   r.Subnets(netip.MustParsePrefix("0.0.0.0/0")),
+		} {
+			n := 0
+			for range seq {
+				n++
+				break
+			}
+			if n != 1 {
+				t.Errorf("%s: expected iteration to stop after break; got %d iterations", name, n)
+			}
+		}
+	})
+}
+
+// RunWriter runs the conformance tests for an [ipstore.Writer].
+func RunWriter(t *testing.T, newWriter NewWriterFunc) {
+	t.Run("AddCIDR", func(t *testing.T) {
+		w, r := newWriter(t)
+		for _, e := range Entries {
+			if err := w.AddCIDR(e.Prefix, e.Value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := sorted(collect(r.All())); !slices.Equal(got, Entries) {
+			t.Errorf("expected %v; got %v", Entries, got)
+		}
+
+		// adding an entry for an existing prefix replaces its value.
+		if err := w.AddCIDR(netip.MustParsePrefix("10.0.0.0/8"), "replaced"); err != nil {
+			t.Fatal(err)
+		}
+		if r.Len() != len(Entries) {
+			t.Errorf("expected %d entries; got %d", len(Entries), r.Len())
+		}
+		if v, _ := r.GetOneIPOrCIDR("10.3.0.1"); v != "replaced" {
+			t.Errorf("expected %q; got %q", "replaced", v)
+		}
+
+		// prefixes are masked.
+		if err := w.AddCIDR(netip.MustParsePrefix("172.16.1.2/12"), "masked"); err != nil {
+			t.Fatal(err)
+		}
+		for p := range r.Supernets(netip.MustParsePrefix("172.16.0.0/12")) {
+			if p != netip.MustParsePrefix("172.16.0.0/12") {
+				t.Errorf("expected prefix to be masked; got %s", p)
+			}
+			break
+		}
+	})
+
+	t.Run("RemoveCIDR", func(t *testing.T) {
+		w, r := newWriter(t)
+		for _, e := range Entries {
+			if err := w.AddCIDR(e.Prefix, e.Value); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		v, err := w.RemoveCIDR(netip.MustParsePrefix("10.1.0.0/16"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != "10.1/16" {
+			t.Errorf("expected removed value %q; got %q", "10.1/16", v)
+		}
+		if r.Len() != len(Entries)-1 {
+			t.Errorf("expected %d entries; got %d", len(Entries)-1, r.Len())
+		}
+		if v, _ := r.GetOneIPOrCIDR("10.1.3.1"); v != "10/8" {
+			t.Errorf("expected %q; got %q", "10/8", v)
+		}
+
+		// removing a prefix without an entry leaves its supernets.
+		v, err = w.RemoveCIDR(netip.MustParsePrefix("10.3.0.0/16"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != "" {
+			t.Errorf("expected zero value; got %q", v)
+		}
+		if r.Len() != len(Entries)-1 {
+			t.Errorf("expected %d entries; got %d", len(Entries)-1, r.Len())
+		}
+
+		// prefixes are masked.
+		if v, _ := w.RemoveCIDR(netip.MustParsePrefix("192.0.2.255/25")); v != "doc4-high" {
+			t.Errorf("expected removed value %q; got %q", "doc4-high", v)
+		}
+	})
+
+	t.Run("Apply", func(t *testing.T) {
+		w, r := newWriter(t)
+		if err := w.Apply(); err != nil {
+			t.Errorf("expected no error applying no mutations; got %v", err)
+		}
+
+		err := w.Apply(
+			ipstore.Mutation[string]{Op: ipstore.OpAdd, Prefix: netip.MustParsePrefix("10.0.0.0/8"), Value: "a"},
+			ipstore.Mutation[string]{Op: ipstore.OpAdd, Prefix: netip.MustParsePrefix("10.1.0.0/16"), Value: "b"},
+			ipstore.Mutation[string]{Op: ipstore.OpRemove, Prefix: netip.MustParsePrefix("10.0.0.0/8")},
+			ipstore.Mutation[string]{Op: ipstore.OpAdd, Prefix: netip.MustParsePrefix("2001:db8::/32"), Value: "c"},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []Entry{
+			{netip.MustParsePrefix("10.1.0.0/16"), "b"},
+			{netip.MustParsePrefix("2001:db8::/32"), "c"},
+		}
+		if got := sorted(collect(r.All())); !slices.Equal(got, expected) {
+			t.Errorf("expected %v; got %v", expected, got)
+		}
+
+		// batches holding an invalid mutation are rejected as a whole.
+		err = w.Apply(
+			ipstore.Mutation[string]{Op: ipstore.OpAdd, Prefix: netip.MustParsePrefix("192.0.2.0/24"), Value: "d"},
+			ipstore.Mutation[string]{Op: ipstore.OpAdd, Value: "invalid"},
+		)
+		if !errors.Is(err, ipstore.ErrInvalidMutation) {
+			t.Errorf("expected ErrInvalidMutation; got %v", err)
+		}
+		if r.Len() != 2 {
+			t.Errorf("expected no mutations to be applied; got %d entries", r.Len())
+		}
+	})
+}
+
+func collect(seq func(func(netip.Prefix, string) bool)) []Entry {
+	var entries []Entry
+	for p, v := range seq {
+		entries = append(entries, Entry{p, v})
+	}
+
+	return entries
+}
+
+func sorted(entries []Entry) []Entry {
+	slices.SortFunc(entries, func(a, b Entry) int {
+		if c := a.Prefix.Addr().Compare(b.Prefix.Addr()); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Prefix.Bits(), b.Prefix.Bits())
+	})
+
+	return entries
+}
@@ -0,0 +1,194 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipstore
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"iter"
+	"net/netip"
+	"strings"
+)
+
+// Annotation holds the metadata that accompanies an entry in a
+// text based list.
+type Annotation struct {
+	// Comment is the inline annotation found on the line, such as
+	// the SBL reference in a Spamhaus DROP list.
+	Comment string
+	// Line is the (1-based) line number the entry was read from. It
+	// is only set when [ListOptions.TrackLines] is enabled.
+	Line int
+}
+
+// ListOptions configures how [ParseList] reads a list.
+type ListOptions struct {
+	// Strict stops parsing at the first malformed line, which is
+	// reported to OnError. It requires OnError to be set. By default
+	// malformed lines are skipped.
+	Strict bool
+	// Dedupe skips entries that have been seen before in the list.
+	Dedupe bool
+	// TrackLines records the line number of each entry in its
+	// [Annotation].
+	TrackLines bool
+	// OnError is called for every malformed line, as well as for
+	// errors reading from the underlying [io.Reader].
+	OnError func(err error)
+}
+
+// ParseError is returned when a line in a list can't be parsed.
+type ParseError struct {
+	Line int
+	Text string
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d: invalid entry %q: %v", e.Line, e.Text, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// ParseList returns an iterator over the entries in a text based list,
+// such as the Spamhaus DROP list, FireHOL netsets or the Emerging Threats
+// block lists. Each line holds an IP, a CIDR or a range of the form
+// "from-to"; empty lines and lines starting with '#' or ';' are skipped.
+// Text following an entry, optionally introduced by '#' or ';', is
+// returned as the [Annotation] of the entry. Ranges are yielded as the
+// minimal set of CIDRs covering them, each with the same [Annotation].
+// ParseList panics when [ListOptions.Strict] is set without
+// [ListOptions.OnError], as a list cut short would look complete.
+func ParseList(r io.Reader, opts ListOptions) iter.Seq2[netip.Prefix, Annotation] {
+	if opts.Strict && opts.OnError == nil {
+		panic("ipstore: ParseList with Strict requires OnError")
+	}
+
+	return func(yield func(netip.Prefix, Annotation) bool) {
+		var seen map[netip.Prefix]struct{}
+		if opts.Dedupe {
+			seen = make(map[netip.Prefix]struct{})
+		}
+
+		report := func(err error) {
+			if opts.OnError != nil {
+				opts.OnError(err)
+			}
+		}
+
+		scanner := bufio.NewScanner(r)
+		line := 0
+		for scanner.Scan() {
+			line++
+			prefixes, comment, err := parseListLine(scanner.Text())
+			if err != nil {
+				report(&ParseError{Line: line, Text: strings.TrimSpace(scanner.Text()), Err: err})
+				if opts.Strict {
+					return
+				}
+				continue
+			}
+
+			a := Annotation{Comment: comment}
+			if opts.TrackLines {
+				a.Line = line
+			}
+
+			for _, prf := range prefixes {
+				if seen != nil {
+					k := prf.Masked()
+					if _, ok := seen[k]; ok {
+						continue
+					}
+					seen[k] = struct{}{}
+				}
+				if !yield(prf, a) {
+					return
+				}
+			}
+		}
+
+		if err := scanner.Err(); err != nil {
+			report(fmt.Errorf("failed reading list: %w", err))
+		}
+	}
+}
+
+// LoadList adds all entries in the list read from r to the [Store]. The
+// value stored for each entry is returned by valueFn. Loading stops at the
+// first malformed line, in which case a [*ParseError] is returned.
+func LoadList[T any](s *Store[T], r io.Reader, valueFn func(netip.Prefix, Annotation) T) error {
+	var err error
+	opts := ListOptions{
+		Strict:     true,
+		TrackLines: true,
+		OnError: func(e error) {
+			err = e
+		},
+	}
+
+	for prf, a := range ParseList(r, opts) {
+		if err := s.AddCIDR(prf, valueFn(prf, a)); err != nil {
+			return fmt.Errorf("line %d: %w", a.Line, err)
+		}
+	}
+
+	return err
+}
+
+// parseListLine parses a single line from a list. It returns no prefixes
+// for empty and comment-only lines.
+func parseListLine(line string) ([]netip.Prefix, string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' || line[0] == ';' {
+		return nil, "", nil
+	}
+
+	entry, comment := line, ""
+	if i := strings.IndexAny(line, "#;"); i >= 0 {
+		entry, comment = strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+	}
+
+	// a dash only separates a range when both sides are addresses, as
+	// annotations such as SBL-123 can contain dashes too.
+	if from, to, ok := strings.Cut(entry, "-"); ok {
+		start, err := netip.ParseAddr(strings.TrimSpace(from))
+		fields := strings.Fields(to)
+		if err == nil && len(fields) > 0 {
+			if end, err := netip.ParseAddr(fields[0]); err == nil {
+				if comment == "" {
+					comment = strings.Join(fields[1:], " ")
+				}
+				prefixes, err := rangePrefixes(start, end)
+				return prefixes, comment, err
+			}
+		}
+	}
+
+	fields := strings.Fields(entry)
+	if comment == "" && len(fields) > 1 {
+		comment = strings.Join(fields[1:], " ")
+	}
+
+	prf, err := parsePrefix(fields[0])
+	if err != nil {
+		return nil, "", err
+	}
+
+	return []netip.Prefix{prf}, comment, nil
+}
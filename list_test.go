@@ -0,0 +1,259 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipstore_test
+
+import (
+	"errors"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/hslatman/ipstore"
+)
+
+const spamhausDrop = `; Spamhaus DROP List 2024/01/01 - (c) 2024 The Spamhaus Project SLU
+; Last-Modified: Mon, 01 Jan 2024 00:00:00 GMT
+; Expires: Mon, 01 Jan 2024 01:00:00 GMT
+1.10.16.0/20 ; SBL256894
+1.19.0.0/16 ; SBL434604
+2.56.192.0/22 ; SBL459831
+`
+
+const fireholNetset = `#
+# firehol_level1
+#
+# Maintainer      : FireHOL
+#
+0.0.0.0/8
+1.10.16.0/20
+5.134.128.0/19
+`
+
+const emergingThreats = `# Emerging Threats compromised IPs
+1.1.1.1
+2.2.2.2
+1.1.1.1
+`
+
+func TestParseListSpamhaus(t *testing.T) {
+	var prefixes []netip.Prefix
+	var comments []string
+	for prf, a := range ipstore.ParseList(strings.NewReader(spamhausDrop), ipstore.ListOptions{TrackLines: true}) {
+		prefixes = append(prefixes, prf)
+		comments = append(comments, a.Comment)
+		if a.Line < 4 {
+			t.Errorf("expected line to be at least 4; got %d", a.Line)
+		}
+	}
+
+	if len(prefixes) != 3 {
+		t.Fatalf("expected 3 entries; got %d", len(prefixes))
+	}
+	if prefixes[0] != netip.MustParsePrefix("1.10.16.0/20") {
+		t.Errorf("expected 1.10.16.0/20; got %s", prefixes[0])
+	}
+	if comments[0] != "SBL256894" {
+		t.Errorf("expected SBL256894; got %q", comments[0])
+	}
+	if comments[2] != "SBL459831" {
+		t.Errorf("expected SBL459831; got %q", comments[2])
+	}
+}
+
+func TestParseListFireHOL(t *testing.T) {
+	var prefixes []netip.Prefix
+	for prf := range ipstore.ParseList(strings.NewReader(fireholNetset), ipstore.ListOptions{}) {
+		prefixes = append(prefixes, prf)
+	}
+
+	if len(prefixes) != 3 {
+		t.Fatalf("expected 3 entries; got %d", len(prefixes))
+	}
+	if prefixes[0] != netip.MustParsePrefix("0.0.0.0/8") {
+		t.Errorf("expected 0.0.0.0/8; got %s", prefixes[0])
+	}
+}
+
+func TestParseListDedupe(t *testing.T) {
+	n := 0
+	for range ipstore.ParseList(strings.NewReader(emergingThreats), ipstore.ListOptions{}) {
+		n++
+	}
+	if n != 3 {
+		t.Errorf("expected 3 entries; got %d", n)
+	}
+
+	n = 0
+	for prf, a := range ipstore.ParseList(strings.NewReader(emergingThreats), ipstore.ListOptions{Dedupe: true}) {
+		n++
+		if a.Line != 0 {
+			t.Errorf("expected line not to be tracked; got %d for %s", a.Line, prf)
+		}
+	}
+	if n != 2 {
+		t.Errorf("expected 2 entries; got %d", n)
+	}
+}
+
+func TestParseListRangesAndAnnotations(t *testing.T) {
+	list := `10.0.0.0-10.0.0.255 # some range
+192.168.1.1 - 192.168.1.6
+2001:db8::1 inline annotation
+`
+	var prefixes []netip.Prefix
+	var comments []string
+	for prf, a := range ipstore.ParseList(strings.NewReader(list), ipstore.ListOptions{}) {
+		prefixes = append(prefixes, prf)
+		comments = append(comments, a.Comment)
+	}
+
+	expected := []string{
+		"10.0.0.0/24",
+		"192.168.1.1/32",
+		"192.168.1.2/31",
+		"192.168.1.4/31",
+		"192.168.1.6/32",
+		"2001:db8::1/128",
+	}
+	if len(prefixes) != len(expected) {
+		t.Fatalf("expected %d entries; got %d (%v)", len(expected), len(prefixes), prefixes)
+	}
+	for i, e := range expected {
+		if prefixes[i] != netip.MustParsePrefix(e) {
+			t.Errorf("expected entry %d to be %s; got %s", i, e, prefixes[i])
+		}
+	}
+
+	if comments[0] != "some range" {
+		t.Errorf("expected %q; got %q", "some range", comments[0])
+	}
+	if comments[5] != "inline annotation" {
+		t.Errorf("expected %q; got %q", "inline annotation", comments[5])
+	}
+}
+
+func TestParseListDashInAnnotation(t *testing.T) {
+	list := `203.0.113.0/24 SBL-123
+198.51.100.1 - 198.51.100.2 AS-EXAMPLE
+`
+	var prefixes []netip.Prefix
+	var comments []string
+	for prf, a := range ipstore.ParseList(strings.NewReader(list), ipstore.ListOptions{Strict: true, OnError: func(err error) {
+		t.Error(err)
+	}}) {
+		prefixes = append(prefixes, prf)
+		comments = append(comments, a.Comment)
+	}
+
+	expected := []string{"203.0.113.0/24", "198.51.100.1/32", "198.51.100.2/32"}
+	if len(prefixes) != len(expected) {
+		t.Fatalf("expected %d entries; got %d (%v)", len(expected), len(prefixes), prefixes)
+	}
+	for i, e := range expected {
+		if prefixes[i] != netip.MustParsePrefix(e) {
+			t.Errorf("expected entry %d to be %s; got %s", i, e, prefixes[i])
+		}
+	}
+	if comments[0] != "SBL-123" {
+		t.Errorf("expected %q; got %q", "SBL-123", comments[0])
+	}
+	if comments[1] != "AS-EXAMPLE" {
+		t.Errorf("expected %q; got %q", "AS-EXAMPLE", comments[1])
+	}
+}
+
+func TestParseListErrors(t *testing.T) {
+	list := `1.1.1.1
+not-an-ip
+2.2.2.2
+10.0.0.10-10.0.0.1
+3.3.3.3
+`
+	var errs []error
+	n := 0
+	for range ipstore.ParseList(strings.NewReader(list), ipstore.ListOptions{OnError: func(err error) { errs = append(errs, err) }}) {
+		n++
+	}
+	if n != 3 {
+		t.Errorf("expected 3 entries in lenient mode; got %d", n)
+	}
+	if len(errs) != 2 {
+		t.Fatalf("expected 2 errors; got %d", len(errs))
+	}
+
+	var perr *ipstore.ParseError
+	if !errors.As(errs[0], &perr) {
+		t.Fatalf("expected *ParseError; got %T", errs[0])
+	}
+	if perr.Line != 2 {
+		t.Errorf("expected error on line 2; got %d", perr.Line)
+	}
+	if !errors.As(errs[1], &perr) || perr.Line != 4 {
+		t.Errorf("expected error on line 4; got %v", errs[1])
+	}
+
+	errs = nil
+	n = 0
+	for range ipstore.ParseList(strings.NewReader(list), ipstore.ListOptions{Strict: true, OnError: func(err error) { errs = append(errs, err) }}) {
+		n++
+	}
+	if n != 1 {
+		t.Errorf("expected 1 entry in strict mode; got %d", n)
+	}
+	if len(errs) != 1 {
+		t.Errorf("expected 1 error; got %d", len(errs))
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic for strict mode without OnError")
+		}
+	}()
+	ipstore.ParseList(strings.NewReader(list), ipstore.ListOptions{Strict: true})
+}
+
+func TestLoadList(t *testing.T) {
+	s := ipstore.New[string]()
+	err := ipstore.LoadList(s, strings.NewReader(spamhausDrop), func(_ netip.Prefix, a ipstore.Annotation) string {
+		return a.Comment
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if s.Len() != 3 {
+		t.Errorf("expected 3 entries; got %d", s.Len())
+	}
+
+	v, ok := s.GetOne(netip.MustParseAddr("1.19.1.1"))
+	if !ok {
+		t.Error("expected 1.19.1.1 to be in store")
+	}
+	if v != "SBL434604" {
+		t.Errorf("expected %q; got %q", "SBL434604", v)
+	}
+
+	s = ipstore.New[string]()
+	err = ipstore.LoadList(s, strings.NewReader("1.1.1.1\n1.1.1.1/33\n"), func(_ netip.Prefix, a ipstore.Annotation) string {
+		return a.Comment
+	})
+	var perr *ipstore.ParseError
+	if !errors.As(err, &perr) {
+		t.Fatalf("expected *ParseError; got %v", err)
+	}
+	if perr.Line != 2 {
+		t.Errorf("expected error on line 2; got %d", perr.Line)
+	}
+}
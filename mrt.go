@@ -0,0 +1,384 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipstore
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+)
+
+const (
+	mrtTableDumpV2 = 13
+
+	mrtPeerIndexTable = 1
+	mrtRIBIPv4Unicast = 2
+	mrtRIBIPv6Unicast = 4
+
+	bgpAttrASPath      = 2
+	bgpAttrNextHop     = 3
+	bgpAttrMPReachNLRI = 14
+
+	bgpASSet      = 1
+	bgpASSequence = 2
+
+	// maxMRTRecord limits the size of a single MRT record, so that a
+	// corrupt length doesn't allocate arbitrary amounts of memory.
+	maxMRTRecord = 16 << 20
+)
+
+// Route describes a route to a prefix as announced by a BGP peer.
+type Route struct {
+	// OriginAS is the AS originating the prefix, i.e. the last AS in
+	// the AS path.
+	OriginAS uint32
+	// ASPath is the (flattened) AS path of the route.
+	ASPath []uint32
+	// NextHop is the next hop announced for the route.
+	NextHop netip.Addr
+	// PeerAS is the AS of the peer the route was learned from.
+	PeerAS uint32
+	// PeerAddr is the address of the peer the route was learned from.
+	PeerAddr netip.Addr
+}
+
+// RoutePolicy selects the [Route] to store for a prefix when it's
+// announced by multiple peers. The routes are provided in the order in
+// which they're listed in the RIB entry, and there's at least one.
+type RoutePolicy func(routes []Route) Route
+
+// FirstPeer selects the route announced by the first peer.
+func FirstPeer(routes []Route) Route {
+	return routes[0]
+}
+
+// ShortestASPath selects the route with the shortest AS path, preferring
+// the peer listed first when multiple routes are equally short.
+func ShortestASPath(routes []Route) Route {
+	best := routes[0]
+	for _, r := range routes[1:] {
+		if len(r.ASPath) < len(best.ASPath) {
+			best = r
+		}
+	}
+
+	return best
+}
+
+// MostCommonOrigin selects the route announced by the first peer with
+// the origin AS announced by most peers.
+func MostCommonOrigin(routes []Route) Route {
+	counts := make(map[uint32]int, len(routes))
+	most := 0
+	for _, r := range routes {
+		counts[r.OriginAS]++
+		most = max(most, counts[r.OriginAS])
+	}
+
+	for _, r := range routes {
+		if counts[r.OriginAS] == most {
+			return r
+		}
+	}
+
+	return routes[0]
+}
+
+// ImportMRTFile imports the MRT RIB dump in the file at path into the
+// [Store]. See [ImportMRT] for details.
+func ImportMRTFile(s *Store[Route], path string, policy RoutePolicy) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return ImportMRT(s, f, policy)
+}
+
+// ImportMRT imports the IPv4 and IPv6 unicast RIB entries from an MRT
+// (RFC 6396) TABLE_DUMP_V2 dump read from r into the [Store]. Input
+// compressed using gzip or bzip2 is decompressed transparently. When a
+// prefix is announced by multiple peers, the policy selects the [Route]
+// to store; [FirstPeer] is used when policy is nil. Records of other
+// types and subtypes are skipped.
+func ImportMRT(s *Store[Route], r io.Reader, policy RoutePolicy) error {
+	if policy == nil {
+		policy = FirstPeer
+	}
+
+	r, err := decompress(r)
+	if err != nil {
+		return err
+	}
+
+	var (
+		peers  []mrtPeer
+		header [12]byte
+		offset int64
+	)
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("failed reading MRT header at offset %d: %w", offset, err)
+		}
+
+		typ := binary.BigEndian.Uint16(header[4:6])
+		subtype := binary.BigEndian.Uint16(header[6:8])
+		length := binary.BigEndian.Uint32(header[8:12])
+		if length > maxMRTRecord {
+			return fmt.Errorf("MRT record of %d bytes at offset %d exceeds the maximum of %d", length, offset, maxMRTRecord)
+		}
+
+		body := make([]byte, length)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return fmt.Errorf("failed reading MRT record at offset %d: %w", offset, err)
+		}
+
+		if typ == mrtTableDumpV2 {
+			switch subtype {
+			case mrtPeerIndexTable:
+				if peers, err = parsePeerIndexTable(body); err != nil {
+					return fmt.Errorf("invalid peer index table at offset %d: %w", offset, err)
+				}
+			case mrtRIBIPv4Unicast, mrtRIBIPv6Unicast:
+				prf, routes, err := parseRIBEntries(body, subtype == mrtRIBIPv4Unicast, peers)
+				if err != nil {
+					return fmt.Errorf("invalid RIB record at offset %d: %w", offset, err)
+				}
+				if len(routes) > 0 {
+					if err := s.AddCIDR(prf, policy(routes)); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		offset += int64(len(header)) + int64(length)
+	}
+}
+
+// decompress wraps r in a gzip or bzip2 reader if the input starts with
+// their magic bytes.
+func decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(3)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		return bzip2.NewReader(br), nil
+	default:
+		return br, nil
+	}
+}
+
+type mrtPeer struct {
+	addr netip.Addr
+	as   uint32
+}
+
+// mrtBuffer is a cursor over an MRT record body.
+type mrtBuffer struct {
+	b   []byte
+	err error
+}
+
+func (m *mrtBuffer) next(n int) []byte {
+	if m.err != nil {
+		return nil
+	}
+	if n > len(m.b) {
+		m.err = io.ErrUnexpectedEOF
+		return nil
+	}
+
+	b := m.b[:n]
+	m.b = m.b[n:]
+
+	return b
+}
+
+func (m *mrtBuffer) uint8() uint8 {
+	if b := m.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (m *mrtBuffer) uint16() uint16 {
+	if b := m.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (m *mrtBuffer) uint32() uint32 {
+	if b := m.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (m *mrtBuffer) addr(is4 bool) netip.Addr {
+	if is4 {
+		if b := m.next(4); b != nil {
+			return netip.AddrFrom4([4]byte(b))
+		}
+		return netip.Addr{}
+	}
+
+	if b := m.next(16); b != nil {
+		return netip.AddrFrom16([16]byte(b))
+	}
+	return netip.Addr{}
+}
+
+func parsePeerIndexTable(body []byte) ([]mrtPeer, error) {
+	m := &mrtBuffer{b: body}
+	m.next(4) // collector BGP ID
+	m.next(int(m.uint16()))
+
+	count := int(m.uint16())
+	peers := make([]mrtPeer, 0, count)
+	for range count {
+		typ := m.uint8()
+		m.next(4) // peer BGP ID
+		p := mrtPeer{addr: m.addr(typ&0x01 == 0)}
+		if typ&0x02 != 0 {
+			p.as = m.uint32()
+		} else {
+			p.as = uint32(m.uint16())
+		}
+		peers = append(peers, p)
+	}
+
+	return peers, m.err
+}
+
+func parseRIBEntries(body []byte, is4 bool, peers []mrtPeer) (netip.Prefix, []Route, error) {
+	m := &mrtBuffer{b: body}
+	m.uint32() // sequence number
+
+	bits := int(m.uint8())
+	maxBits := 128
+	if is4 {
+		maxBits = 32
+	}
+	if bits > maxBits {
+		return netip.Prefix{}, nil, fmt.Errorf("invalid prefix length %d", bits)
+	}
+
+	var addr [16]byte
+	copy(addr[:], m.next((bits+7)/8))
+	a := netip.AddrFrom16(addr)
+	if is4 {
+		a = netip.AddrFrom4([4]byte(addr[:4]))
+	}
+	prf := netip.PrefixFrom(a, bits)
+
+	count := int(m.uint16())
+	routes := make([]Route, 0, count)
+	for range count {
+		idx := int(m.uint16())
+		m.uint32() // originated time
+		attrs := m.next(int(m.uint16()))
+		if m.err != nil {
+			break
+		}
+		if idx >= len(peers) {
+			return netip.Prefix{}, nil, fmt.Errorf("unknown peer index %d", idx)
+		}
+
+		route, err := parseBGPAttributes(attrs)
+		if err != nil {
+			return netip.Prefix{}, nil, err
+		}
+		route.PeerAS = peers[idx].as
+		route.PeerAddr = peers[idx].addr
+		routes = append(routes, route)
+	}
+
+	return prf, routes, m.err
+}
+
+func parseBGPAttributes(attrs []byte) (Route, error) {
+	var route Route
+	m := &mrtBuffer{b: attrs}
+	for len(m.b) > 0 && m.err == nil {
+		flags := m.uint8()
+		typ := m.uint8()
+		var length int
+		if flags&0x10 != 0 {
+			length = int(m.uint16())
+		} else {
+			length = int(m.uint8())
+		}
+		value := &mrtBuffer{b: m.next(length)}
+		if m.err != nil {
+			break
+		}
+
+		switch typ {
+		case bgpAttrASPath:
+			for len(value.b) > 0 && value.err == nil {
+				segType := value.uint8()
+				n := int(value.uint8())
+				for i := range n {
+					as := value.uint32()
+					// only the first AS of a set counts towards the path
+					if segType == bgpASSequence || (segType == bgpASSet && i == 0) {
+						route.ASPath = append(route.ASPath, as)
+					}
+				}
+			}
+			if value.err != nil {
+				return Route{}, fmt.Errorf("invalid AS path: %w", value.err)
+			}
+			if len(route.ASPath) > 0 {
+				route.OriginAS = route.ASPath[len(route.ASPath)-1]
+			}
+		case bgpAttrNextHop:
+			route.NextHop = value.addr(true)
+		case bgpAttrMPReachNLRI:
+			// RIB entries only hold the next hop length and address
+			switch value.uint8() {
+			case 4:
+				route.NextHop = value.addr(true)
+			case 16, 32:
+				route.NextHop = value.addr(false)
+			}
+		}
+	}
+
+	if m.err != nil {
+		return Route{}, fmt.Errorf("invalid BGP attributes: %w", m.err)
+	}
+
+	return route, nil
+}
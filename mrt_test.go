@@ -0,0 +1,130 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipstore_test
+
+import (
+	"bytes"
+	"net/netip"
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/hslatman/ipstore"
+)
+
+func TestImportMRT(t *testing.T) {
+	for _, path := range []string{
+		"testdata/mrt/rib.mrt",
+		"testdata/mrt/rib.mrt.gz",
+		"testdata/mrt/rib.mrt.bz2",
+	} {
+		t.Run(path, func(t *testing.T) {
+			s := ipstore.New[ipstore.Route]()
+			if err := ipstore.ImportMRTFile(s, path, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			if s.Len() != 3 {
+				t.Errorf("expected 3 entries; got %d", s.Len())
+			}
+
+			r, ok := s.GetOne(netip.MustParseAddr("198.51.100.10"))
+			if !ok {
+				t.Fatal("expected 198.51.100.10 to be in store")
+			}
+			if r.OriginAS != 64511 {
+				t.Errorf("expected origin AS 64511; got %d", r.OriginAS)
+			}
+			if !slices.Equal(r.ASPath, []uint32{64496, 64500, 64511}) {
+				t.Errorf("unexpected AS path %v", r.ASPath)
+			}
+			if r.NextHop != netip.MustParseAddr("192.0.2.1") {
+				t.Errorf("expected next hop 192.0.2.1; got %s", r.NextHop)
+			}
+			if r.PeerAS != 64496 || r.PeerAddr != netip.MustParseAddr("192.0.2.1") {
+				t.Errorf("unexpected peer %d (%s)", r.PeerAS, r.PeerAddr)
+			}
+
+			r, ok = s.GetOne(netip.MustParseAddr("2001:db8:1000::1"))
+			if !ok {
+				t.Fatal("expected 2001:db8:1000::1 to be in store")
+			}
+			if r.OriginAS != 64510 {
+				t.Errorf("expected origin AS 64510; got %d", r.OriginAS)
+			}
+			if r.NextHop != netip.MustParseAddr("2001:db8::1") {
+				t.Errorf("expected next hop 2001:db8::1; got %s", r.NextHop)
+			}
+			if r.PeerAS != 4200000000 || r.PeerAddr != netip.MustParseAddr("2001:db8::1") {
+				t.Errorf("unexpected peer %d (%s)", r.PeerAS, r.PeerAddr)
+			}
+		})
+	}
+}
+
+func TestImportMRTPolicies(t *testing.T) {
+	ip := netip.MustParseAddr("203.0.113.1")
+
+	s := ipstore.New[ipstore.Route]()
+	if err := ipstore.ImportMRTFile(s, "testdata/mrt/rib.mrt", ipstore.FirstPeer); err != nil {
+		t.Fatal(err)
+	}
+	if r, _ := s.GetOne(ip); r.OriginAS != 64502 {
+		t.Errorf("expected origin AS 64502; got %d", r.OriginAS)
+	}
+
+	s = ipstore.New[ipstore.Route]()
+	if err := ipstore.ImportMRTFile(s, "testdata/mrt/rib.mrt", ipstore.ShortestASPath); err != nil {
+		t.Fatal(err)
+	}
+	if r, _ := s.GetOne(ip); r.OriginAS != 64502 {
+		t.Errorf("expected origin AS 64502; got %d", r.OriginAS)
+	}
+
+	routes := []ipstore.Route{
+		{OriginAS: 1, ASPath: []uint32{10, 20, 1}},
+		{OriginAS: 2, ASPath: []uint32{2}},
+		{OriginAS: 3, ASPath: []uint32{30, 3}},
+		{OriginAS: 2, ASPath: []uint32{40, 50, 2}},
+	}
+	if r := ipstore.ShortestASPath(routes); r.OriginAS != 2 || len(r.ASPath) != 1 {
+		t.Errorf("unexpected route %#+v", r)
+	}
+	if r := ipstore.MostCommonOrigin(routes); r.OriginAS != 2 || len(r.ASPath) != 1 {
+		t.Errorf("unexpected route %#+v", r)
+	}
+}
+
+func TestImportMRTErrors(t *testing.T) {
+	b, err := os.ReadFile("testdata/mrt/rib.mrt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := ipstore.New[ipstore.Route]()
+	if err := ipstore.ImportMRT(s, bytes.NewReader(b[:len(b)-5]), nil); err == nil {
+		t.Error("expected error for truncated dump")
+	}
+
+	// a header announcing a record of 4 GiB.
+	header := []byte{0, 0, 0, 0, 0, 13, 0, 2, 0xff, 0xff, 0xff, 0xff}
+	if err := ipstore.ImportMRT(s, bytes.NewReader(header), nil); err == nil {
+		t.Error("expected error for oversized record")
+	}
+
+	if err := ipstore.ImportMRT(s, bytes.NewReader(nil), nil); err != nil {
+		t.Errorf("expected empty dump to be imported; got %v", err)
+	}
+}
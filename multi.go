@@ -0,0 +1,197 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipstore
+
+import (
+	"iter"
+	"net/netip"
+	"reflect"
+	"slices"
+)
+
+// Sourced is a value in a [MultiStore], together with the source it was
+// added by, such as the name of a feed.
+type Sourced[T any] struct {
+	Source string
+	Value  T
+}
+
+// MultiStore is a Key/Value store using IPs and CIDRs as keys, holding
+// multiple values per key. Values are kept in the order they're added.
+type MultiStore[T any] struct {
+	store *Store[[]Sourced[T]]
+	equal func(a, b T) bool
+}
+
+// NewMultiStore returns a new instance of [MultiStore]. The equal function
+// is used to find values to remove, and to skip adding a value a source
+// already added. When equal is nil, values are compared using
+// [reflect.DeepEqual].
+func NewMultiStore[T any](equal func(a, b T) bool, opts ...Option) *MultiStore[T] {
+	if equal == nil {
+		equal = func(a, b T) bool {
+			return reflect.DeepEqual(a, b)
+		}
+	}
+
+	return &MultiStore[T]{
+		store: New[[]Sourced[T]](opts...),
+		equal: equal,
+	}
+}
+
+// AddCIDR adds the value from source to the entry mapped by
+// [netip.Prefix], keeping the values already stored for it.
+func (s *MultiStore[T]) AddCIDR(key netip.Prefix, source string, value T) error {
+	v := Sourced[T]{Source: source, Value: value}
+
+	return s.store.AddMerge(key, []Sourced[T]{v}, func(old, _ []Sourced[T]) []Sourced[T] {
+		if slices.ContainsFunc(old, func(o Sourced[T]) bool {
+			return o.Source == source && s.equal(o.Value, value)
+		}) {
+			return old
+		}
+
+		// values are never modified in place, so slices returned earlier
+		// stay valid.
+		return append(slices.Clip(old), v)
+	})
+}
+
+// AddIPOrCIDR adds the value from source to the entry mapped by an IP or
+// CIDR.
+func (s *MultiStore[T]) AddIPOrCIDR(ipOrCIDR, source string, value T) error {
+	prf, err := s.store.opts.parsePrefix(ipOrCIDR)
+	if err != nil {
+		return err
+	}
+
+	return s.AddCIDR(prf, source, value)
+}
+
+// RemoveCIDR removes all values mapped by [netip.Prefix], returning them.
+func (s *MultiStore[T]) RemoveCIDR(key netip.Prefix) ([]Sourced[T], error) {
+	return s.store.RemoveCIDR(key)
+}
+
+// RemoveValue removes the values mapped by [netip.Prefix] equal to value,
+// regardless of their source. It returns the number of values removed.
+func (s *MultiStore[T]) RemoveValue(key netip.Prefix, value T) int {
+	return s.removeFunc(key, func(v Sourced[T]) bool {
+		return s.equal(v.Value, value)
+	})
+}
+
+// RemoveSource removes the values mapped by [netip.Prefix] added by
+// source. It returns the number of values removed.
+func (s *MultiStore[T]) RemoveSource(key netip.Prefix, source string) int {
+	return s.removeFunc(key, func(v Sourced[T]) bool {
+		return v.Source == source
+	})
+}
+
+// Purge removes the values added by source from all entries, for example
+// when a feed is no longer used. It returns the number of values removed.
+func (s *MultiStore[T]) Purge(source string) int {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	var keys []netip.Prefix
+	for prf, vs := range s.store.table.All() {
+		if slices.ContainsFunc(vs, func(v Sourced[T]) bool { return v.Source == source }) {
+			keys = append(keys, prf)
+		}
+	}
+
+	n := 0
+	for _, prf := range keys {
+		vs, _ := s.store.table.Get(prf)
+		kept := slices.DeleteFunc(slices.Clone(vs), func(v Sourced[T]) bool { return v.Source == source })
+		n += len(vs) - len(kept)
+		if len(kept) == 0 {
+			s.store.table.Delete(prf)
+			s.store.forget(prf)
+		} else {
+			s.store.table.Insert(prf, slices.Clip(kept))
+		}
+	}
+
+	return n
+}
+
+func (s *MultiStore[T]) removeFunc(key netip.Prefix, del func(Sourced[T]) bool) int {
+	n := 0
+	s.store.modify(key, func(vs []Sourced[T], ok bool) ([]Sourced[T], bool) {
+		if !ok {
+			return nil, true
+		}
+		kept := slices.DeleteFunc(slices.Clone(vs), del)
+		n = len(vs) - len(kept)
+
+		return slices.Clip(kept), len(kept) == 0
+	})
+
+	return n
+}
+
+// Get returns the values of all entries containing the [netip.Addr] key,
+// most specific entry first.
+func (s *MultiStore[T]) Get(key netip.Addr) ([]Sourced[T], error) {
+	prf, ok, err := s.store.opts.lookupPrefix(key)
+	if !ok {
+		return nil, err
+	}
+
+	return s.GetCIDR(prf)
+}
+
+// GetCIDR returns the values of all entries containing the [netip.Prefix]
+// key, most specific entry first.
+func (s *MultiStore[T]) GetCIDR(key netip.Prefix) ([]Sourced[T], error) {
+	var result []Sourced[T]
+	for _, vs := range s.store.Supernets(key) {
+		result = append(result, vs...)
+	}
+
+	return result, nil
+}
+
+// GetOne returns the values of the most specific entry containing the
+// [netip.Addr] key. The slice returned must not be modified.
+func (s *MultiStore[T]) GetOne(key netip.Addr) ([]Sourced[T], bool) {
+	return s.store.GetOne(key)
+}
+
+// GetOneCIDR returns the values of the most specific entry containing the
+// [netip.Prefix] key. The slice returned must not be modified.
+func (s *MultiStore[T]) GetOneCIDR(key netip.Prefix) ([]Sourced[T], bool) {
+	return s.store.GetOneCIDR(key)
+}
+
+// Contains returns whether an entry is available for the [netip.Addr].
+func (s *MultiStore[T]) Contains(ip netip.Addr) (bool, error) {
+	return s.store.Contains(ip)
+}
+
+// All returns an iterator over all entries in the [MultiStore]. The
+// slices yielded must not be modified.
+func (s *MultiStore[T]) All() iter.Seq2[netip.Prefix, []Sourced[T]] {
+	return s.store.All()
+}
+
+// Len returns the number of entries in the [MultiStore].
+func (s *MultiStore[T]) Len() int {
+	return s.store.Len()
+}
@@ -0,0 +1,123 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipstore_test
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/hslatman/ipstore"
+)
+
+type sourced = ipstore.Sourced[string]
+
+func newMultiStore(t *testing.T) *ipstore.MultiStore[string] {
+	t.Helper()
+
+	s := ipstore.NewMultiStore[string](nil)
+	for _, e := range []struct{ cidr, source, value string }{
+		{"10.0.0.0/8", "drop", "SBL1"},
+		{"10.0.0.0/8", "firehol", "level1"},
+		{"10.0.0.0/8", "drop", "SBL1"},
+		{"10.0.0.0/8", "drop", "SBL2"},
+		{"10.1.0.0/16", "firehol", "level1"},
+	} {
+		if err := s.AddIPOrCIDR(e.cidr, e.source, e.value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return s
+}
+
+func TestMultiStoreGet(t *testing.T) {
+	s := newMultiStore(t)
+	if s.Len() != 2 {
+		t.Errorf("expected 2 entries; got %d", s.Len())
+	}
+
+	got, err := s.Get(netip.MustParseAddr("10.1.2.3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []sourced{{"firehol", "level1"}, {"drop", "SBL1"}, {"firehol", "level1"}, {"drop", "SBL2"}}
+	if !slices.Equal(got, expected) {
+		t.Errorf("expected %v; got %v", expected, got)
+	}
+
+	one, ok := s.GetOne(netip.MustParseAddr("10.2.3.4"))
+	if !ok {
+		t.Fatal("expected a match")
+	}
+	if expected := expected[1:]; !slices.Equal(one, expected) {
+		t.Errorf("expected %v; got %v", expected, one)
+	}
+	if _, ok := s.GetOneCIDR(netip.MustParsePrefix("192.0.2.0/24")); ok {
+		t.Error("expected no match")
+	}
+	if ok, _ := s.Contains(netip.MustParseAddr("10.255.0.1")); !ok {
+		t.Error("expected 10.255.0.1 to be contained")
+	}
+}
+
+func TestMultiStoreRemove(t *testing.T) {
+	s := newMultiStore(t)
+	prf := netip.MustParsePrefix("10.0.0.0/8")
+
+	before, _ := s.GetOneCIDR(prf)
+	if n := s.RemoveSource(prf, "drop"); n != 2 {
+		t.Errorf("expected 2 values removed; got %d", n)
+	}
+	if expected := []sourced{{"drop", "SBL1"}, {"firehol", "level1"}, {"drop", "SBL2"}}; !slices.Equal(before, expected) {
+		t.Errorf("expected earlier result to be unchanged; got %v", before)
+	}
+	if n := s.RemoveSource(prf, "drop"); n != 0 {
+		t.Errorf("expected 0 values removed; got %d", n)
+	}
+
+	if n := s.RemoveValue(prf, "level1"); n != 1 {
+		t.Errorf("expected 1 value removed; got %d", n)
+	}
+	if s.Len() != 1 {
+		t.Errorf("expected 1 entry; got %d", s.Len())
+	}
+	if _, ok := s.GetOne(netip.MustParseAddr("10.2.3.4")); ok {
+		t.Error("expected no match after removing all values")
+	}
+
+	removed, err := s.RemoveCIDR(netip.MustParsePrefix("10.1.0.0/16"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []sourced{{"firehol", "level1"}}; !slices.Equal(removed, expected) {
+		t.Errorf("expected %v; got %v", expected, removed)
+	}
+}
+
+func TestMultiStorePurge(t *testing.T) {
+	s := newMultiStore(t)
+	if n := s.Purge("firehol"); n != 2 {
+		t.Errorf("expected 2 values removed; got %d", n)
+	}
+	if s.Len() != 1 {
+		t.Errorf("expected 1 entry; got %d", s.Len())
+	}
+	for prf, vs := range s.All() {
+		if prf != netip.MustParsePrefix("10.0.0.0/8") || len(vs) != 2 {
+			t.Errorf("unexpected entry %s: %v", prf, vs)
+		}
+	}
+}
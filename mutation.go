@@ -0,0 +1,220 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+)
+
+// Op is the kind of operation performed by a [Mutation].
+type Op uint8
+
+const (
+	// OpAdd adds an entry, like [Store.AddCIDR].
+	OpAdd Op = iota + 1
+	// OpRemove removes an entry, like [Store.RemoveCIDR].
+	OpRemove
+)
+
+func (o Op) String() string {
+	switch o {
+	case OpAdd:
+		return "add"
+	case OpRemove:
+		return "remove"
+	default:
+		return fmt.Sprintf("Op(%d)", o)
+	}
+}
+
+// Mutation is a single change to a [Store]. Value is only used when
+// adding an entry.
+type Mutation[T any] struct {
+	Op     Op
+	Prefix netip.Prefix
+	Value  T
+}
+
+// ErrInvalidMutation is returned when applying or decoding a malformed
+// [Mutation].
+var ErrInvalidMutation = errors.New("invalid mutation")
+
+// Validate returns an error wrapping [ErrInvalidMutation] when the
+// [Mutation] can't be applied.
+func (m Mutation[T]) Validate() error {
+	if m.Op != OpAdd && m.Op != OpRemove {
+		return fmt.Errorf("%w: unknown operation %s", ErrInvalidMutation, m.Op)
+	}
+	if !m.Prefix.IsValid() {
+		return fmt.Errorf("%w: invalid prefix", ErrInvalidMutation)
+	}
+
+	return nil
+}
+
+// Apply applies the mutations to the [Store] in order. The mutations are
+// applied atomically: readers either observe none or all of them, and
+// none are applied when one of them is invalid.
+func (s *Store[T]) Apply(ms ...Mutation[T]) error {
+	for _, m := range ms {
+		if err := m.Validate(); err != nil {
+			return err
+		}
+		if _, _, err := s.opts.canonical(m.Prefix); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, m := range ms {
+		if m.Op == OpAdd {
+			s.table.Insert(s.opts.prefix(m.Prefix), m.Value)
+		} else {
+			s.table.Delete(s.opts.prefix(m.Prefix))
+			s.forget(s.opts.prefix(m.Prefix))
+		}
+	}
+
+	return nil
+}
+
+// Clone returns a copy of the [Store]. Values are copied shallowly; hit
+// statistics aren't copied.
+func (s *Store[T]) Clone() *Store[T] {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.clone()
+}
+
+// clone returns a copy of the [Store]. The read lock must be held.
+func (s *Store[T]) clone() *Store[T] {
+	return &Store[T]{
+		table:      s.table.Clone(),
+		newBackend: s.newBackend,
+		opts:       s.opts,
+		hits:       s.opts.newHitCounter(),
+		zero:       s.zero,
+	}
+}
+
+// AppendMutation appends the binary encoding of the [Mutation] to b,
+// encoding its value using the [Codec] provided.
+func AppendMutation[T any](b []byte, m Mutation[T], c Codec[T]) ([]byte, error) {
+	b = append(b, byte(m.Op))
+	b = appendPrefix(b, m.Prefix)
+	if m.Op != OpAdd {
+		return b, nil
+	}
+
+	v, err := c.Marshal(m.Value)
+	if err != nil {
+		return nil, fmt.Errorf("failed encoding value for %s: %w", m.Prefix, err)
+	}
+	b = binary.AppendUvarint(b, uint64(len(v)))
+
+	return append(b, v...), nil
+}
+
+// DecodeMutation decodes a [Mutation] encoded by [AppendMutation],
+// decoding its value using the [Codec] provided.
+func DecodeMutation[T any](b []byte, c Codec[T]) (Mutation[T], error) {
+	r := bytes.NewReader(b)
+
+	op, err := r.ReadByte()
+	if err != nil {
+		return Mutation[T]{}, fmt.Errorf("%w: %w", ErrInvalidMutation, io.ErrUnexpectedEOF)
+	}
+	m := Mutation[T]{Op: Op(op)}
+	if m.Op != OpAdd && m.Op != OpRemove {
+		return Mutation[T]{}, fmt.Errorf("%w: unknown operation %s", ErrInvalidMutation, m.Op)
+	}
+
+	prf, ok, err := readPrefix(r)
+	if err != nil || !ok {
+		return Mutation[T]{}, fmt.Errorf("%w: invalid prefix", ErrInvalidMutation)
+	}
+	m.Prefix = prf
+
+	if m.Op == OpAdd {
+		n, err := binary.ReadUvarint(r)
+		if err != nil || n != uint64(r.Len()) {
+			return Mutation[T]{}, fmt.Errorf("%w: invalid value length", ErrInvalidMutation)
+		}
+		if m.Value, err = c.Unmarshal(b[len(b)-int(n):]); err != nil {
+			return Mutation[T]{}, fmt.Errorf("failed decoding value for %s: %w", prf, err)
+		}
+	}
+	if m.Op == OpRemove && r.Len() > 0 {
+		return Mutation[T]{}, fmt.Errorf("%w: trailing data", ErrInvalidMutation)
+	}
+
+	return m, nil
+}
+
+// AppendMutations appends the binary encoding of a batch of mutations to
+// b: the number of mutations, followed by each of the mutations encoded by
+// [AppendMutation] and prefixed by its length.
+func AppendMutations[T any](b []byte, ms []Mutation[T], c Codec[T]) ([]byte, error) {
+	b = binary.AppendUvarint(b, uint64(len(ms)))
+
+	var buf []byte
+	for _, m := range ms {
+		var err error
+		if buf, err = AppendMutation(buf[:0], m, c); err != nil {
+			return nil, err
+		}
+		b = binary.AppendUvarint(b, uint64(len(buf)))
+		b = append(b, buf...)
+	}
+
+	return b, nil
+}
+
+// DecodeMutations decodes a batch of mutations encoded by
+// [AppendMutations].
+func DecodeMutations[T any](b []byte, c Codec[T]) ([]Mutation[T], error) {
+	n, k := binary.Uvarint(b)
+	if k <= 0 || n > uint64(len(b)) {
+		return nil, fmt.Errorf("%w: invalid batch length", ErrInvalidMutation)
+	}
+	b = b[k:]
+
+	ms := make([]Mutation[T], 0, n)
+	for range n {
+		l, k := binary.Uvarint(b)
+		if k <= 0 || l > uint64(len(b)-k) {
+			return nil, fmt.Errorf("%w: invalid batch", ErrInvalidMutation)
+		}
+		m, err := DecodeMutation(b[k:k+int(l)], c)
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+		b = b[k+int(l):]
+	}
+	if len(b) > 0 {
+		return nil, fmt.Errorf("%w: trailing data in batch", ErrInvalidMutation)
+	}
+
+	return ms, nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipstore_test
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/hslatman/ipstore"
+)
+
+func TestApply(t *testing.T) {
+	s := ipstore.New[string]()
+	if err := s.AddIPOrCIDR("10.0.0.0/8", "private"); err != nil {
+		t.Fatal(err)
+	}
+
+	err := s.Apply(
+		ipstore.Mutation[string]{Op: ipstore.OpAdd, Prefix: netip.MustParsePrefix("192.0.2.0/24"), Value: "test"},
+		ipstore.Mutation[string]{Op: ipstore.OpRemove, Prefix: netip.MustParsePrefix("10.0.0.0/8")},
+		ipstore.Mutation[string]{Op: ipstore.OpRemove, Prefix: netip.MustParsePrefix("172.16.0.0/12")},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Len() != 1 {
+		t.Errorf("expected 1 entry; got %d", s.Len())
+	}
+	if v, _ := s.GetOneIPOrCIDR("192.0.2.1"); v != "test" {
+		t.Errorf("expected %q; got %q", "test", v)
+	}
+
+	err = s.Apply(
+		ipstore.Mutation[string]{Op: ipstore.OpAdd, Prefix: netip.MustParsePrefix("198.51.100.0/24"), Value: "test"},
+		ipstore.Mutation[string]{Op: 42, Prefix: netip.MustParsePrefix("192.0.2.0/24")},
+	)
+	if !errors.Is(err, ipstore.ErrInvalidMutation) {
+		t.Errorf("expected ErrInvalidMutation; got %v", err)
+	}
+	if s.Len() != 1 {
+		t.Errorf("expected no mutations to be applied; got %d entries", s.Len())
+	}
+}
+
+func TestClone(t *testing.T) {
+	s := ipstore.New[string]()
+	if err := s.AddIPOrCIDR("10.0.0.0/8", "private"); err != nil {
+		t.Fatal(err)
+	}
+
+	c := s.Clone()
+	if err := s.AddIPOrCIDR("192.0.2.0/24", "test"); err != nil {
+		t.Fatal(err)
+	}
+	if c.Len() != 1 {
+		t.Errorf("expected clone to hold 1 entry; got %d", c.Len())
+	}
+}
+
+func TestMutationEncoding(t *testing.T) {
+	c := ipstore.StringCodec{}
+	for _, m := range []ipstore.Mutation[string]{
+		{Op: ipstore.OpAdd, Prefix: netip.MustParsePrefix("10.0.0.0/8"), Value: "private"},
+		{Op: ipstore.OpAdd, Prefix: netip.MustParsePrefix("2001:db8::/32"), Value: ""},
+		{Op: ipstore.OpRemove, Prefix: netip.MustParsePrefix("192.0.2.1/32")},
+	} {
+		b, err := ipstore.AppendMutation(nil, m, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := ipstore.DecodeMutation(b, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d != m {
+			t.Errorf("expected %v; got %v", m, d)
+		}
+
+		if _, err := ipstore.DecodeMutation(b[:len(b)-1], c); !errors.Is(err, ipstore.ErrInvalidMutation) {
+			t.Errorf("expected ErrInvalidMutation for truncated %v; got %v", m, err)
+		}
+	}
+
+	if _, err := ipstore.DecodeMutation([]byte{3, 4, 10, 0, 0, 0, 8}, c); !errors.Is(err, ipstore.ErrInvalidMutation) {
+		t.Errorf("expected ErrInvalidMutation for unknown operation; got %v", err)
+	}
+}
+
+func TestMutationsEncoding(t *testing.T) {
+	c := ipstore.StringCodec{}
+	ms := []ipstore.Mutation[string]{
+		{Op: ipstore.OpAdd, Prefix: netip.MustParsePrefix("10.0.0.0/8"), Value: "private"},
+		{Op: ipstore.OpRemove, Prefix: netip.MustParsePrefix("192.0.2.1/32")},
+	}
+
+	b, err := ipstore.AppendMutations(nil, ms, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := ipstore.DecodeMutations(b, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d) != 2 || d[0] != ms[0] || d[1] != ms[1] {
+		t.Errorf("expected %v; got %v", ms, d)
+	}
+
+	if _, err := ipstore.DecodeMutations(b[:len(b)-1], c); !errors.Is(err, ipstore.ErrInvalidMutation) {
+		t.Errorf("expected ErrInvalidMutation for truncated batch; got %v", err)
+	}
+	if _, err := ipstore.DecodeMutations(append(b, 0), c); !errors.Is(err, ipstore.ErrInvalidMutation) {
+		t.Errorf("expected ErrInvalidMutation for trailing data; got %v", err)
+	}
+}
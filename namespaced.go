@@ -0,0 +1,226 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipstore
+
+import (
+	"io"
+	"net/netip"
+	"sync"
+)
+
+// NamespacedStore holds an independent [Store] per namespace, such as a
+// tenant or VRF, so that the same prefixes can be stored in each of them.
+type NamespacedStore[K comparable, T any] struct {
+	mu     sync.RWMutex
+	stores map[K]*Store[T]
+	opts   []Option
+}
+
+// NewNamespacedStore returns a new instance of [NamespacedStore]. The
+// options are used for the [Store] of every namespace.
+func NewNamespacedStore[K comparable, T any](opts ...Option) *NamespacedStore[K, T] {
+	return &NamespacedStore[K, T]{
+		stores: make(map[K]*Store[T]),
+		opts:   opts,
+	}
+}
+
+// Store returns the [Store] of the namespace, or nil when the namespace
+// doesn't exist.
+func (s *NamespacedStore[K, T]) Store(ns K) *Store[T] {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.stores[ns]
+}
+
+// write calls fn with the [Store] of the namespace, creating it when it
+// doesn't exist. The namespace can't be removed or replaced while fn is
+// running, so that its modifications aren't lost.
+func (s *NamespacedStore[K, T]) write(ns K, fn func(store *Store[T]) error) error {
+	for {
+		s.mu.RLock()
+		if store := s.stores[ns]; store != nil {
+			defer s.mu.RUnlock()
+			return fn(store)
+		}
+		s.mu.RUnlock()
+
+		s.mu.Lock()
+		if _, ok := s.stores[ns]; !ok {
+			s.stores[ns] = New[T](s.opts...)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// AddCIDR adds a new entry to the namespace mapped by [netip.Prefix],
+// creating the namespace when it doesn't exist.
+func (s *NamespacedStore[K, T]) AddCIDR(ns K, key netip.Prefix, value T) error {
+	return s.write(ns, func(store *Store[T]) error {
+		return store.AddCIDR(key, value)
+	})
+}
+
+// AddIPOrCIDR adds a new entry to the namespace mapped by an IP or CIDR,
+// creating the namespace when it doesn't exist.
+func (s *NamespacedStore[K, T]) AddIPOrCIDR(ns K, ipOrCIDR string, value T) error {
+	return s.write(ns, func(store *Store[T]) error {
+		return store.AddIPOrCIDR(ipOrCIDR, value)
+	})
+}
+
+// RemoveCIDR removes the entry associated with [netip.Prefix] from the
+// namespace.
+func (s *NamespacedStore[K, T]) RemoveCIDR(ns K, key netip.Prefix) (T, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	store := s.stores[ns]
+	if store == nil {
+		return zero[T](), nil
+	}
+
+	return store.RemoveCIDR(key)
+}
+
+// GetOne returns a single entry from the namespace based on the
+// [netip.Addr] key.
+func (s *NamespacedStore[K, T]) GetOne(ns K, key netip.Addr) (T, bool) {
+	store := s.Store(ns)
+	if store == nil {
+		return zero[T](), false
+	}
+
+	return store.GetOne(key)
+}
+
+// Get returns entries from the namespace based on the [netip.Addr] key.
+func (s *NamespacedStore[K, T]) Get(ns K, key netip.Addr) ([]T, error) {
+	store := s.Store(ns)
+	if store == nil {
+		return nil, nil
+	}
+
+	return store.Get(key)
+}
+
+// Contains returns whether an entry is available in the namespace for the
+// [netip.Addr].
+func (s *NamespacedStore[K, T]) Contains(ns K, ip netip.Addr) (bool, error) {
+	store := s.Store(ns)
+	if store == nil {
+		return false, nil
+	}
+
+	return store.Contains(ip)
+}
+
+// Match returns the most specific entry containing the [netip.Addr] in
+// every namespace that has one.
+func (s *NamespacedStore[K, T]) Match(ip netip.Addr) map[K]T {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make(map[K]T)
+	for ns, store := range s.stores {
+		if v, ok := store.GetOne(ip); ok {
+			result[ns] = v
+		}
+	}
+
+	return result
+}
+
+// Containing returns the namespaces with an entry containing the
+// [netip.Addr], in no particular order.
+func (s *NamespacedStore[K, T]) Containing(ip netip.Addr) []K {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var result []K
+	for ns, store := range s.stores {
+		if ok, _ := store.Contains(ip); ok {
+			result = append(result, ns)
+		}
+	}
+
+	return result
+}
+
+// Namespaces returns the namespaces in the [NamespacedStore], in no
+// particular order.
+func (s *NamespacedStore[K, T]) Namespaces() []K {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]K, 0, len(s.stores))
+	for ns := range s.stores {
+		result = append(result, ns)
+	}
+
+	return result
+}
+
+// Len returns the number of entries in the namespace.
+func (s *NamespacedStore[K, T]) Len(ns K) int {
+	store := s.Store(ns)
+	if store == nil {
+		return 0
+	}
+
+	return store.Len()
+}
+
+// RemoveNamespace removes the namespace and all of its entries. It
+// returns whether the namespace existed.
+func (s *NamespacedStore[K, T]) RemoveNamespace(ns K) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.stores[ns]
+	delete(s.stores, ns)
+
+	return ok
+}
+
+// WriteSnapshot writes the entries in the namespace to w, as described by
+// [Store.WriteSnapshot]. A namespace that doesn't exist is written as an
+// empty snapshot.
+func (s *NamespacedStore[K, T]) WriteSnapshot(ns K, w io.Writer, c Codec[T]) error {
+	store := s.Store(ns)
+	if store == nil {
+		store = New[T](s.opts...)
+	}
+
+	return store.WriteSnapshot(w, c)
+}
+
+// ReadSnapshot replaces the entries in the namespace with the entries in
+// the snapshot read from r, creating the namespace when it doesn't exist.
+// The namespace is only modified when the snapshot was read successfully.
+func (s *NamespacedStore[K, T]) ReadSnapshot(ns K, r io.Reader, c Codec[T]) error {
+	store := New[T](s.opts...)
+	if err := store.ReadSnapshot(r, c); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stores[ns] = store
+
+	return nil
+}
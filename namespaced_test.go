@@ -0,0 +1,194 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipstore_test
+
+import (
+	"bytes"
+	"maps"
+	"net/netip"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/hslatman/ipstore"
+)
+
+func newNamespacedStore(t *testing.T) *ipstore.NamespacedStore[string, string] {
+	t.Helper()
+
+	s := ipstore.NewNamespacedStore[string, string]()
+	for _, e := range []struct{ ns, cidr, value string }{
+		{"tenant-a", "10.0.0.0/8", "a-vpc"},
+		{"tenant-a", "10.1.0.0/16", "a-subnet"},
+		{"tenant-b", "10.0.0.0/8", "b-vpc"},
+		{"tenant-c", "172.16.0.0/12", "c-vpc"},
+	} {
+		if err := s.AddIPOrCIDR(e.ns, e.cidr, e.value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return s
+}
+
+func TestNamespacedStore(t *testing.T) {
+	s := newNamespacedStore(t)
+	ip := netip.MustParseAddr("10.1.2.3")
+
+	if v, _ := s.GetOne("tenant-a", ip); v != "a-subnet" {
+		t.Errorf("expected %q; got %q", "a-subnet", v)
+	}
+	if v, _ := s.GetOne("tenant-b", ip); v != "b-vpc" {
+		t.Errorf("expected %q; got %q", "b-vpc", v)
+	}
+	if _, ok := s.GetOne("tenant-d", ip); ok {
+		t.Error("expected no match in missing namespace")
+	}
+	if vs, _ := s.Get("tenant-a", ip); !slices.Equal(vs, []string{"a-subnet", "a-vpc"}) {
+		t.Errorf("unexpected values %v", vs)
+	}
+	if ok, _ := s.Contains("tenant-c", ip); ok {
+		t.Error("expected tenant-c not to contain 10.1.2.3")
+	}
+
+	if got, expected := s.Match(ip), map[string]string{"tenant-a": "a-subnet", "tenant-b": "b-vpc"}; !maps.Equal(got, expected) {
+		t.Errorf("expected %v; got %v", expected, got)
+	}
+	got := s.Containing(ip)
+	slices.Sort(got)
+	if expected := []string{"tenant-a", "tenant-b"}; !slices.Equal(got, expected) {
+		t.Errorf("expected %v; got %v", expected, got)
+	}
+
+	if n := s.Len("tenant-a"); n != 2 {
+		t.Errorf("expected 2 entries; got %d", n)
+	}
+	if n := s.Len("tenant-d"); n != 0 {
+		t.Errorf("expected 0 entries; got %d", n)
+	}
+
+	if v, _ := s.RemoveCIDR("tenant-a", netip.MustParsePrefix("10.1.0.0/16")); v != "a-subnet" {
+		t.Errorf("expected %q; got %q", "a-subnet", v)
+	}
+	if _, err := s.RemoveCIDR("tenant-d", netip.MustParsePrefix("10.1.0.0/16")); err != nil {
+		t.Error(err)
+	}
+	if s.Store("tenant-d") != nil {
+		t.Error("expected removing from a missing namespace not to create it")
+	}
+
+	if !s.RemoveNamespace("tenant-b") {
+		t.Error("expected tenant-b to be removed")
+	}
+	if s.RemoveNamespace("tenant-b") {
+		t.Error("expected tenant-b to be removed already")
+	}
+	namespaces := s.Namespaces()
+	slices.Sort(namespaces)
+	if expected := []string{"tenant-a", "tenant-c"}; !slices.Equal(namespaces, expected) {
+		t.Errorf("expected %v; got %v", expected, namespaces)
+	}
+}
+
+func TestNamespacedStoreSnapshot(t *testing.T) {
+	s := newNamespacedStore(t)
+
+	var buf bytes.Buffer
+	if err := s.WriteSnapshot("tenant-a", &buf, ipstore.StringCodec{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ReadSnapshot("tenant-d", &buf, ipstore.StringCodec{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.Len("tenant-d"); n != 2 {
+		t.Errorf("expected 2 entries; got %d", n)
+	}
+	if v, _ := s.GetOne("tenant-d", netip.MustParseAddr("10.1.2.3")); v != "a-subnet" {
+		t.Errorf("expected %q; got %q", "a-subnet", v)
+	}
+
+	if err := s.ReadSnapshot("tenant-e", bytes.NewReader([]byte("invalid")), ipstore.StringCodec{}); err == nil {
+		t.Error("expected error for invalid snapshot")
+	}
+	if s.Store("tenant-e") != nil {
+		t.Error("expected failed read not to create the namespace")
+	}
+}
+
+func TestNamespacedStoreConcurrentAdd(t *testing.T) {
+	s := ipstore.NewNamespacedStore[int, int](ipstore.WithBackend(ipstore.LiteBackend))
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Go(func() {
+			for j := range 100 {
+				prf := netip.PrefixFrom(netip.AddrFrom4([4]byte{10, 0, byte(j), 0}), 24)
+				if err := s.AddCIDR(j%4, prf, i); err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+	wg.Wait()
+
+	for ns := range 4 {
+		if n := s.Len(ns); n != 25 {
+			t.Errorf("expected 25 entries in %d; got %d", ns, n)
+		}
+	}
+}
+
+func TestNamespacedStoreConcurrentRemove(t *testing.T) {
+	s := ipstore.NewNamespacedStore[string, int]()
+
+	var (
+		wg      sync.WaitGroup
+		removed int
+		done    = make(chan struct{})
+	)
+	wg.Go(func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			// entries added to a namespace after it was removed would
+			// be lost, so its size mustn't change once removed.
+			if store := s.Store("ns"); store != nil && s.RemoveNamespace("ns") {
+				removed += store.Len()
+			}
+		}
+	})
+
+	var writers sync.WaitGroup
+	for i := range 8 {
+		writers.Go(func() {
+			for j := range 1000 {
+				prf := netip.PrefixFrom(netip.AddrFrom4([4]byte{10, byte(i), byte(j >> 8), byte(j)}), 32)
+				if err := s.AddCIDR("ns", prf, j); err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+	writers.Wait()
+	close(done)
+	wg.Wait()
+
+	if n := removed + s.Len("ns"); n != 8000 {
+		t.Errorf("expected 8000 entries; got %d", n)
+	}
+}
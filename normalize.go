@@ -0,0 +1,214 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipstore
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+)
+
+// ErrZone is returned when using an address with an IPv6 zone as a key in
+// a [Store] using [ZoneReject].
+var ErrZone = errors.New("address has a zone")
+
+// ZonePolicy determines how a [Store] handles IPv6 zones, such as the
+// eth0 in fe80::1%eth0, in addresses used as keys. Prefixes can't have
+// zones, so entries are never stored with one.
+type ZonePolicy int
+
+const (
+	// ZoneStrip removes the zone, so that fe80::1%eth0 matches the same
+	// entries as fe80::1. It's the default.
+	ZoneStrip ZonePolicy = iota
+	// ZoneReject returns [ErrZone] for addresses with a zone. Methods
+	// that don't return errors treat them as not matching any entry.
+	ZoneReject
+	// ZoneKeep passes addresses to the [Backend] as is. Addresses with a
+	// zone are stored without it, but don't match any entry when looked
+	// up.
+	ZoneKeep
+)
+
+func (p ZonePolicy) String() string {
+	switch p {
+	case ZoneStrip:
+		return "strip"
+	case ZoneReject:
+		return "reject"
+	case ZoneKeep:
+		return "keep"
+	default:
+		return fmt.Sprintf("ZonePolicy(%d)", p)
+	}
+}
+
+// PrefixPolicy determines how a [Store] handles prefixes with host bits
+// set, such as 10.1.2.3/8, when adding and removing entries.
+type PrefixPolicy int
+
+const (
+	// PrefixCanonical masks prefixes, so that 10.1.2.3/8 is stored as
+	// 10.0.0.0/8. [Store.AddCIDRReport] reports when a prefix was masked.
+	// It's the default.
+	PrefixCanonical PrefixPolicy = iota
+	// PrefixStrict returns a [*NonCanonicalError] for prefixes with host
+	// bits set.
+	PrefixStrict
+)
+
+func (p PrefixPolicy) String() string {
+	switch p {
+	case PrefixCanonical:
+		return "canonical"
+	case PrefixStrict:
+		return "strict"
+	default:
+		return fmt.Sprintf("PrefixPolicy(%d)", p)
+	}
+}
+
+// NonCanonicalError is returned when adding or removing an entry by a
+// prefix with host bits set in a [Store] using [PrefixStrict].
+type NonCanonicalError struct {
+	Prefix netip.Prefix
+}
+
+func (e *NonCanonicalError) Error() string {
+	return fmt.Sprintf("prefix %s has host bits set; did you mean %s?", e.Prefix, e.Prefix.Masked())
+}
+
+// WithPrefixPolicy sets how prefixes with host bits set are handled. It
+// defaults to [PrefixCanonical].
+func WithPrefixPolicy(p PrefixPolicy) Option {
+	return func(o *options) {
+		o.prefixes = p
+	}
+}
+
+// WithUnmap converts IPv4-mapped IPv6 keys to IPv4, so that
+// ::ffff:10.0.0.1 and 10.0.0.1 match the same entries, as do
+// ::ffff:10.0.0.0/104 and 10.0.0.0/8. Prefixes shorter than /96 are kept
+// as IPv6. By default, keys aren't unmapped.
+func WithUnmap() Option {
+	return func(o *options) {
+		o.unmap = true
+	}
+}
+
+// WithZonePolicy sets how IPv6 zones in keys are handled. It defaults to
+// [ZoneStrip].
+func WithZonePolicy(p ZonePolicy) Option {
+	return func(o *options) {
+		o.zones = p
+	}
+}
+
+// addr returns the normalized form of the address.
+func (o options) addr(ip netip.Addr) (netip.Addr, error) {
+	if ip.Zone() != "" {
+		switch o.zones {
+		case ZoneStrip:
+			ip = ip.WithZone("")
+		case ZoneReject:
+			return netip.Addr{}, fmt.Errorf("%w: %s", ErrZone, ip)
+		}
+	}
+	if o.unmap {
+		ip = ip.Unmap()
+	}
+
+	return ip, nil
+}
+
+// addrPrefix returns the normalized, single address prefix for the
+// address.
+func (o options) addrPrefix(ip netip.Addr) (netip.Prefix, error) {
+	ip, err := o.addr(ip)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+
+	return ip.Prefix(ip.BitLen())
+}
+
+// lookupPrefix returns the normalized, single address prefix for looking
+// up the address. It returns false when the address doesn't match any
+// entry because it has a zone, which is only kept when using [ZoneKeep].
+func (o options) lookupPrefix(ip netip.Addr) (netip.Prefix, bool, error) {
+	ip, err := o.addr(ip)
+	if err != nil {
+		return netip.Prefix{}, false, err
+	}
+	if ip.Zone() != "" {
+		return netip.Prefix{}, false, nil
+	}
+
+	prf, err := ip.Prefix(ip.BitLen())
+	return prf, err == nil, err
+}
+
+// prefix returns the normalized form of the prefix.
+func (o options) prefix(prf netip.Prefix) netip.Prefix {
+	if o.unmap && prf.Addr().Is4In6() && prf.Bits() >= 96 {
+		return netip.PrefixFrom(prf.Addr().Unmap(), prf.Bits()-96)
+	}
+
+	return prf
+}
+
+// canonical returns the normalized, masked form of the prefix, and
+// whether it had host bits set. It returns a [*NonCanonicalError] instead
+// when using [PrefixStrict].
+func (o options) canonical(prf netip.Prefix) (netip.Prefix, bool, error) {
+	prf = o.prefix(prf)
+	if !prf.IsValid() {
+		return prf, false, nil
+	}
+
+	masked := prf.Masked()
+	if masked == prf {
+		return prf, false, nil
+	}
+	if o.prefixes == PrefixStrict {
+		return prf, false, &NonCanonicalError{Prefix: prf}
+	}
+
+	return masked, true, nil
+}
+
+// parsePrefix parses an IP or CIDR into its normalized prefix.
+func (o options) parsePrefix(s string) (netip.Prefix, error) {
+	ip, err := netip.ParseAddr(s)
+	if err != nil || !ip.IsValid() {
+		prf, err := netip.ParsePrefix(s)
+		return o.prefix(prf), err
+	}
+
+	return o.addrPrefix(ip)
+}
+
+// parseLookup parses an IP or CIDR into its normalized prefix for looking
+// up entries, like parsePrefix. It returns false when the IP doesn't match
+// any entry, like lookupPrefix.
+func (o options) parseLookup(s string) (netip.Prefix, bool, error) {
+	ip, err := netip.ParseAddr(s)
+	if err != nil || !ip.IsValid() {
+		prf, err := netip.ParsePrefix(s)
+		return o.prefix(prf), err == nil, err
+	}
+
+	return o.lookupPrefix(ip)
+}
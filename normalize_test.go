@@ -0,0 +1,391 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipstore_test
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/hslatman/ipstore"
+)
+
+// adders add an entry for key to the store using each of the Add* and
+// Apply entry points. The key is an IP or CIDR.
+var adders = map[string]func(s *ipstore.Store[string], key string) error{
+	"Add": func(s *ipstore.Store[string], key string) error {
+		return s.Add(netip.MustParseAddr(key), "value")
+	},
+	"AddCIDR": func(s *ipstore.Store[string], key string) error {
+		return s.AddCIDR(mustParsePrefix(key), "value")
+	},
+	"AddIPOrCIDR": func(s *ipstore.Store[string], key string) error {
+		return s.AddIPOrCIDR(key, "value")
+	},
+	"AddMerge": func(s *ipstore.Store[string], key string) error {
+		return s.AddMerge(mustParsePrefix(key), "value", func(_, new string) string { return new })
+	},
+	"Apply": func(s *ipstore.Store[string], key string) error {
+		return s.Apply(ipstore.Mutation[string]{Op: ipstore.OpAdd, Prefix: mustParsePrefix(key), Value: "value"})
+	},
+}
+
+// getters return whether an entry for key is found using each of the
+// Get* and Contains entry points.
+var getters = map[string]func(s *ipstore.Store[string], key string) (bool, error){
+	"Contains": func(s *ipstore.Store[string], key string) (bool, error) {
+		return s.Contains(netip.MustParseAddr(key))
+	},
+	"Get": func(s *ipstore.Store[string], key string) (bool, error) {
+		vs, err := s.Get(netip.MustParseAddr(key))
+		return len(vs) > 0, err
+	},
+	"GetOne": func(s *ipstore.Store[string], key string) (bool, error) {
+		_, ok := s.GetOne(netip.MustParseAddr(key))
+		return ok, nil
+	},
+	"GetInto": func(s *ipstore.Store[string], key string) (bool, error) {
+		return len(s.GetInto(netip.MustParseAddr(key), nil)) > 0, nil
+	},
+	"Matches": func(s *ipstore.Store[string], key string) (bool, error) {
+		for range s.Matches(netip.MustParseAddr(key)) {
+			return true, nil
+		}
+		return false, nil
+	},
+	"LookupBatch": func(s *ipstore.Store[string], key string) (bool, error) {
+		out := make([]ipstore.Result[string], 1)
+		s.LookupBatch([]netip.Addr{netip.MustParseAddr(key)}, out)
+		return out[0].Found, nil
+	},
+	"GetCIDR": func(s *ipstore.Store[string], key string) (bool, error) {
+		vs, err := s.GetCIDR(mustParsePrefix(key))
+		return len(vs) > 0, err
+	},
+	"GetOneCIDR": func(s *ipstore.Store[string], key string) (bool, error) {
+		_, ok := s.GetOneCIDR(mustParsePrefix(key))
+		return ok, nil
+	},
+	"GetIPOrCIDR": func(s *ipstore.Store[string], key string) (bool, error) {
+		vs, err := s.GetIPOrCIDR(key)
+		return len(vs) > 0, err
+	},
+	"GetOneIPOrCIDR": func(s *ipstore.Store[string], key string) (bool, error) {
+		_, ok := s.GetOneIPOrCIDR(key)
+		return ok, nil
+	},
+	"Supernets": func(s *ipstore.Store[string], key string) (bool, error) {
+		for range s.Supernets(mustParsePrefix(key)) {
+			return true, nil
+		}
+		return false, nil
+	},
+	"Subnets": func(s *ipstore.Store[string], key string) (bool, error) {
+		for range s.Subnets(mustParsePrefix(key)) {
+			return true, nil
+		}
+		return false, nil
+	},
+}
+
+// removers remove the entry for key using each of the Remove* entry
+// points.
+var removers = map[string]func(s *ipstore.Store[string], key string) error{
+	"Remove": func(s *ipstore.Store[string], key string) error {
+		_, err := s.Remove(netip.MustParseAddr(key))
+		return err
+	},
+	"RemoveCIDR": func(s *ipstore.Store[string], key string) error {
+		_, err := s.RemoveCIDR(mustParsePrefix(key))
+		return err
+	},
+	"RemoveIPOrCIDR": func(s *ipstore.Store[string], key string) error {
+		_, err := s.RemoveIPOrCIDR(key)
+		return err
+	},
+	"Apply": func(s *ipstore.Store[string], key string) error {
+		return s.Apply(ipstore.Mutation[string]{Op: ipstore.OpRemove, Prefix: mustParsePrefix(key)})
+	},
+}
+
+// mustParsePrefix parses an IP or CIDR into a prefix, keeping the zone
+// of an IP out of it like [netip.Addr.Prefix] does.
+func mustParsePrefix(key string) netip.Prefix {
+	if ip, err := netip.ParseAddr(key); err == nil {
+		return netip.PrefixFrom(ip, ip.BitLen())
+	}
+
+	return netip.MustParsePrefix(key)
+}
+
+func TestUnmap(t *testing.T) {
+	for _, keys := range [][2]string{
+		{"::ffff:10.0.0.1", "10.0.0.1"},
+		{"10.0.0.1", "::ffff:10.0.0.1"},
+	} {
+		added, looked := keys[0], keys[1]
+		for an, add := range adders {
+			for gn, get := range getters {
+				s := ipstore.New[string](ipstore.WithUnmap())
+				if err := add(s, added); err != nil {
+					t.Fatal(err)
+				}
+				if ok, err := get(s, looked); !ok || err != nil {
+					t.Errorf("%s(%s), %s(%s): expected a match; got %t, %v", an, added, gn, looked, ok, err)
+				}
+			}
+			for rn, remove := range removers {
+				s := ipstore.New[string](ipstore.WithUnmap())
+				if err := add(s, added); err != nil {
+					t.Fatal(err)
+				}
+				if err := remove(s, looked); err != nil {
+					t.Fatal(err)
+				}
+				if s.Len() != 0 {
+					t.Errorf("%s(%s), %s(%s): expected the entry to be removed", an, added, rn, looked)
+				}
+			}
+		}
+	}
+}
+
+func TestUnmapPrefixes(t *testing.T) {
+	s := ipstore.New[string](ipstore.WithUnmap())
+	if err := s.AddIPOrCIDR("::ffff:10.0.0.0/104", "mapped"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddIPOrCIDR("::/64", "short"); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, _ := s.GetOneIPOrCIDR("10.1.2.3"); v != "mapped" {
+		t.Errorf("expected %q; got %q", "mapped", v)
+	}
+	for p := range s.All() {
+		if p != netip.MustParsePrefix("10.0.0.0/8") && p != netip.MustParsePrefix("::/64") {
+			t.Errorf("unexpected prefix %s", p)
+		}
+	}
+	// the /64 is kept as IPv6, so it doesn't contain unmapped addresses.
+	if v, ok := s.GetOneIPOrCIDR("::ffff:192.0.2.1"); ok {
+		t.Errorf("expected no match; got %q", v)
+	}
+}
+
+func TestNoUnmapByDefault(t *testing.T) {
+	s := ipstore.New[string]()
+	if err := s.AddIPOrCIDR("::ffff:10.0.0.1", "mapped"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := s.Contains(netip.MustParseAddr("10.0.0.1")); ok {
+		t.Error("expected 10.0.0.1 not to match ::ffff:10.0.0.1")
+	}
+}
+
+func TestZonePolicy(t *testing.T) {
+	const zoned, plain = "fe80::1%eth0", "fe80::1"
+
+	for _, p := range []ipstore.ZonePolicy{ipstore.ZoneStrip, ipstore.ZoneReject, ipstore.ZoneKeep} {
+		for an, add := range adders {
+			s := ipstore.New[string](ipstore.WithZonePolicy(p))
+			err := add(s, zoned)
+			switch {
+			case an != "Add" && an != "AddIPOrCIDR":
+				// prefixes can't have zones, so these never see one.
+				if err != nil {
+					t.Errorf("%s: %s(%s): unexpected error %v", p, an, zoned, err)
+				}
+			case p == ipstore.ZoneReject:
+				if !errors.Is(err, ipstore.ErrZone) {
+					t.Errorf("%s: %s(%s): expected ErrZone; got %v", p, an, zoned, err)
+				}
+				continue
+			case err != nil:
+				t.Errorf("%s: %s(%s): unexpected error %v", p, an, zoned, err)
+			}
+			if ok, _ := s.Contains(netip.MustParseAddr(plain)); !ok {
+				t.Errorf("%s: %s(%s): expected %s to match", p, an, zoned, plain)
+			}
+		}
+
+		for gn, get := range getters {
+			s := ipstore.New[string](ipstore.WithZonePolicy(p))
+			if err := s.AddIPOrCIDR("fe80::/64", "link-local"); err != nil {
+				t.Fatal(err)
+			}
+			ok, err := get(s, zoned)
+			switch {
+			case gn == "GetCIDR" || gn == "GetOneCIDR" || gn == "Supernets" || gn == "Subnets":
+				// prefixes can't have zones, so these behave the same as
+				// without one.
+				if expected, _ := get(s, plain); ok != expected || err != nil {
+					t.Errorf("%s: %s(%s): expected %t; got %t, %v", p, gn, zoned, expected, ok, err)
+				}
+			case p == ipstore.ZoneStrip:
+				if !ok || err != nil {
+					t.Errorf("%s: %s(%s): expected a match; got %t, %v", p, gn, zoned, ok, err)
+				}
+			case p == ipstore.ZoneReject:
+				if ok {
+					t.Errorf("%s: %s(%s): expected no match", p, gn, zoned)
+				}
+				if (gn == "Contains" || gn == "Get" || gn == "GetIPOrCIDR") && !errors.Is(err, ipstore.ErrZone) {
+					t.Errorf("%s: %s(%s): expected ErrZone; got %v", p, gn, zoned, err)
+				}
+			case p == ipstore.ZoneKeep:
+				if ok || err != nil {
+					t.Errorf("%s: %s(%s): expected no match; got %t, %v", p, gn, zoned, ok, err)
+				}
+			}
+		}
+
+		for rn, remove := range removers {
+			s := ipstore.New[string](ipstore.WithZonePolicy(p))
+			if err := s.AddIPOrCIDR(plain, "host"); err != nil {
+				t.Fatal(err)
+			}
+			err := remove(s, zoned)
+			if p == ipstore.ZoneReject && (rn == "Remove" || rn == "RemoveIPOrCIDR") {
+				if !errors.Is(err, ipstore.ErrZone) {
+					t.Errorf("%s: %s(%s): expected ErrZone; got %v", p, rn, zoned, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.Len() != 0 {
+				t.Errorf("%s: %s(%s): expected the entry to be removed", p, rn, zoned)
+			}
+		}
+	}
+}
+
+func TestZonePolicyOtherStores(t *testing.T) {
+	m := ipstore.NewMultiStore[string](nil, ipstore.WithZonePolicy(ipstore.ZoneReject))
+	if err := m.AddIPOrCIDR("fe80::1%eth0", "feed", "value"); !errors.Is(err, ipstore.ErrZone) {
+		t.Errorf("expected ErrZone; got %v", err)
+	}
+	if _, err := m.Get(netip.MustParseAddr("fe80::1%eth0")); !errors.Is(err, ipstore.ErrZone) {
+		t.Errorf("expected ErrZone; got %v", err)
+	}
+
+	n := ipstore.NewNamespacedStore[string, string](ipstore.WithUnmap())
+	if err := n.AddIPOrCIDR("tenant", "::ffff:10.0.0.1", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := n.Contains("tenant", netip.MustParseAddr("10.0.0.1")); !ok {
+		t.Error("expected 10.0.0.1 to match")
+	}
+}
+
+func TestAddCIDRReport(t *testing.T) {
+	s := ipstore.New[string]()
+
+	r, err := s.AddCIDRReport(netip.MustParsePrefix("10.1.2.3/8"), "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (ipstore.AddReport{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Masked: true}); r != expected {
+		t.Errorf("expected %+v; got %+v", expected, r)
+	}
+
+	r, err = s.AddCIDRReport(netip.MustParsePrefix("10.0.0.0/8"), "second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (ipstore.AddReport{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Replaced: true}); r != expected {
+		t.Errorf("expected %+v; got %+v", expected, r)
+	}
+	if s.Len() != 1 {
+		t.Errorf("expected 1 entry; got %d", s.Len())
+	}
+	if v, _ := s.GetOneIPOrCIDR("10.0.0.1"); v != "second" {
+		t.Errorf("expected %q; got %q", "second", v)
+	}
+}
+
+func TestPrefixStrict(t *testing.T) {
+	const key = "10.1.2.3/8"
+	prf := netip.MustParsePrefix(key)
+
+	for an, add := range adders {
+		if an == "Add" {
+			continue
+		}
+		s := ipstore.New[string](ipstore.WithPrefixPolicy(ipstore.PrefixStrict))
+		err := add(s, key)
+		var nce *ipstore.NonCanonicalError
+		if !errors.As(err, &nce) {
+			t.Errorf("%s(%s): expected NonCanonicalError; got %v", an, key, err)
+			continue
+		}
+		if nce.Prefix != prf {
+			t.Errorf("%s(%s): expected error for %s; got %s", an, key, prf, nce.Prefix)
+		}
+		if s.Len() != 0 {
+			t.Errorf("%s(%s): expected no entries; got %d", an, key, s.Len())
+		}
+	}
+
+	s := ipstore.New[string](ipstore.WithPrefixPolicy(ipstore.PrefixStrict))
+	if _, err := s.AddCIDRReport(prf, "value"); err == nil {
+		t.Error("expected error for non-canonical prefix")
+	}
+	if err := s.AddIPOrCIDR("10.0.0.0/8", "value"); err != nil {
+		t.Fatal(err)
+	}
+	for rn, remove := range removers {
+		if rn == "Remove" {
+			continue
+		}
+		var nce *ipstore.NonCanonicalError
+		if err := remove(s, key); !errors.As(err, &nce) {
+			t.Errorf("%s(%s): expected NonCanonicalError; got %v", rn, key, err)
+		}
+	}
+	if s.Len() != 1 {
+		t.Errorf("expected 1 entry; got %d", s.Len())
+	}
+
+	// lookups match by containment, so host bits are allowed.
+	if v, _ := s.GetOneCIDR(prf); v != "value" {
+		t.Errorf("expected %q; got %q", "value", v)
+	}
+}
+
+func TestPrefixCanonical(t *testing.T) {
+	for an, add := range adders {
+		if an == "Add" {
+			continue
+		}
+		s := ipstore.New[string]()
+		if err := add(s, "10.1.2.3/8"); err != nil {
+			t.Fatal(err)
+		}
+		for p := range s.All() {
+			if p != netip.MustParsePrefix("10.0.0.0/8") {
+				t.Errorf("%s: expected 10.0.0.0/8; got %s", an, p)
+			}
+		}
+		if _, err := s.RemoveIPOrCIDR("10.9.9.9/8"); err != nil {
+			t.Fatal(err)
+		}
+		if s.Len() != 0 {
+			t.Errorf("%s: expected the entry to be removed", an)
+		}
+	}
+}
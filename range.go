@@ -0,0 +1,152 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipstore
+
+import (
+	"context"
+	"errors"
+	"iter"
+	"net/netip"
+	"slices"
+)
+
+// rangePrefixes returns the minimal set of prefixes covering the
+// (inclusive) range of addresses from start to end.
+func rangePrefixes(start, end netip.Addr) ([]netip.Prefix, error) {
+	if !start.IsValid() || !end.IsValid() {
+		return nil, errors.New("invalid range boundary")
+	}
+	if start.Is4() != end.Is4() {
+		return nil, errors.New("range boundaries must be of the same address family")
+	}
+	if end.Less(start) {
+		return nil, errors.New("range end before range start")
+	}
+
+	start, end = start.WithZone(""), end.WithZone("")
+
+	var result []netip.Prefix
+	for {
+		prf := largestPrefix(start, end)
+		result = append(result, prf)
+
+		last := lastAddr(prf)
+		if last == end {
+			return result, nil
+		}
+		start = last.Next()
+	}
+}
+
+// largestPrefix returns the largest prefix starting at start that
+// doesn't extend beyond end.
+func largestPrefix(start, end netip.Addr) netip.Prefix {
+	for bits := 0; bits < start.BitLen(); bits++ {
+		prf := netip.PrefixFrom(start, bits)
+		if prf.Masked().Addr() != start {
+			continue
+		}
+		if last := lastAddr(prf); !end.Less(last) {
+			return prf
+		}
+	}
+
+	return netip.PrefixFrom(start, start.BitLen())
+}
+
+// lastAddr returns the last address contained in the prefix.
+func lastAddr(prf netip.Prefix) netip.Addr {
+	prf = prf.Masked()
+	b := prf.Addr().AsSlice()
+	for i := prf.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// Aggregate returns the minimal, sorted set of prefixes covering exactly
+// the same addresses as the prefixes provided. Overlapping prefixes are
+// merged and adjacent prefixes are combined where possible. IPv4 prefixes
+// sort before IPv6 prefixes.
+func Aggregate(prefixes iter.Seq[netip.Prefix]) []netip.Prefix {
+	result, _ := AggregateContext(context.Background(), prefixes)
+	return result
+}
+
+// AggregateContext returns the minimal, sorted set of prefixes covering
+// exactly the same addresses as the prefixes provided, like [Aggregate].
+// It returns the context's error when it's done before all prefixes were
+// aggregated.
+func AggregateContext(ctx context.Context, prefixes iter.Seq[netip.Prefix], opts ...ContextOption) ([]netip.Prefix, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	p := newProgress(ctx, opts)
+	var ranges []addrRange
+	for prf := range prefixes {
+		if err := p.step(); err != nil {
+			return nil, err
+		}
+		if !prf.IsValid() {
+			continue
+		}
+		prf = prf.Masked()
+		ranges = append(ranges, addrRange{from: prf.Addr(), to: lastAddr(prf)})
+	}
+
+	var result []netip.Prefix
+	for _, r := range mergeRanges(ranges) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		prefixes, _ := rangePrefixes(r.from, r.to)
+		result = append(result, prefixes...)
+	}
+	p.done()
+
+	return result, nil
+}
+
+// addrRange is an inclusive range of addresses of the same family.
+type addrRange struct {
+	from, to netip.Addr
+}
+
+// mergeRanges sorts the ranges and merges the ones that overlap or are
+// adjacent. It reorders the slice provided.
+func mergeRanges(ranges []addrRange) []addrRange {
+	slices.SortFunc(ranges, func(a, b addrRange) int {
+		return a.from.Compare(b.from)
+	})
+
+	var merged []addrRange
+	for _, r := range ranges {
+		if n := len(merged); n > 0 {
+			last := &merged[n-1]
+			if last.from.Is4() == r.from.Is4() && (!last.to.Less(r.from) || last.to.Next() == r.from) {
+				if last.to.Less(r.to) {
+					last.to = r.to
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+
+	return merged
+}
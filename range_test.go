@@ -0,0 +1,107 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipstore_test
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/hslatman/ipstore"
+)
+
+func prefixes(s ...string) []netip.Prefix {
+	result := make([]netip.Prefix, 0, len(s))
+	for _, p := range s {
+		result = append(result, netip.MustParsePrefix(p))
+	}
+
+	return result
+}
+
+func TestAggregate(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		in       []netip.Prefix
+		expected []netip.Prefix
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:     "adjacent",
+			in:       prefixes("10.0.0.128/25", "10.0.0.0/25"),
+			expected: prefixes("10.0.0.0/24"),
+		},
+		{
+			name:     "covered",
+			in:       prefixes("10.0.0.5/32", "10.0.0.0/24", "10.0.0.0/28"),
+			expected: prefixes("10.0.0.0/24"),
+		},
+		{
+			name:     "non-masked",
+			in:       prefixes("10.1.2.3/8"),
+			expected: prefixes("10.0.0.0/8"),
+		},
+		{
+			name:     "unaligned",
+			in:       prefixes("10.0.0.1/32", "10.0.0.2/31", "10.0.0.4/32"),
+			expected: prefixes("10.0.0.1/32", "10.0.0.2/31", "10.0.0.4/32"),
+		},
+		{
+			name:     "families",
+			in:       prefixes("2001:db8:1::/48", "192.0.2.0/24", "2001:db8::/48", "0.0.0.0/1", "128.0.0.0/1"),
+			expected: prefixes("0.0.0.0/0", "2001:db8::/47"),
+		},
+		{
+			name:     "end of address space",
+			in:       prefixes("255.255.255.255/32", "255.255.255.254/32"),
+			expected: prefixes("255.255.255.254/31"),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := ipstore.Aggregate(slices.Values(tc.in))
+			if !slices.Equal(got, tc.expected) {
+				t.Errorf("expected %v; got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestAggregateContext(t *testing.T) {
+	seq := func(yield func(netip.Prefix) bool) {
+		for p := range entries(4096) {
+			if !yield(p) {
+				return
+			}
+		}
+	}
+
+	result, err := ipstore.AggregateContext(context.Background(), seq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := prefixes("10.0.0.0/20"); !slices.Equal(result, expected) {
+		t.Errorf("expected %v; got %v", expected, result)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result, err = ipstore.AggregateContext(ctx, seq, ipstore.WithProgress(func(int) { cancel() }))
+	if !errors.Is(err, context.Canceled) || result != nil {
+		t.Errorf("expected context.Canceled and no result; got %v and %v", err, result)
+	}
+}
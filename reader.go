@@ -0,0 +1,60 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipstore
+
+import (
+	"iter"
+	"net/netip"
+)
+
+// Reader provides lookups in a store using IPs and CIDRs as keys. Lookups
+// by IP match the entries containing the IP; lookups by CIDR match the
+// entries containing all of the CIDR. Entries are returned most specific
+// first.
+//
+// The ipstoretest package verifies implementations behave like [Store].
+type Reader[T any] interface {
+	Contains(ip netip.Addr) (bool, error)
+	Get(key netip.Addr) ([]T, error)
+	GetOne(key netip.Addr) (T, bool)
+	GetCIDR(key netip.Prefix) ([]T, error)
+	GetOneCIDR(key netip.Prefix) (T, bool)
+	GetIPOrCIDR(ipOrCIDR string) ([]T, error)
+	GetOneIPOrCIDR(ipOrCIDR string) (T, bool)
+	Supernets(key netip.Prefix) iter.Seq2[netip.Prefix, T]
+	Subnets(key netip.Prefix) iter.Seq2[netip.Prefix, T]
+	All() iter.Seq2[netip.Prefix, T]
+	Len() int
+}
+
+// Writer modifies entries in a store. RemoveCIDR returns the value of the
+// entry removed, or the zero value when there was none.
+type Writer[T any] interface {
+	AddCIDR(key netip.Prefix, value T) error
+	RemoveCIDR(key netip.Prefix) (T, error)
+	Apply(ms ...Mutation[T]) error
+}
+
+// ReadWriter is a [Reader] and [Writer].
+type ReadWriter[T any] interface {
+	Reader[T]
+	Writer[T]
+}
+
+var (
+	_ ReadWriter[any] = (*Store[any])(nil)
+	_ ReadWriter[any] = (*ShardedStore[any])(nil)
+	_ Reader[any]     = (*CompiledStore[any])(nil)
+)
@@ -0,0 +1,51 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipstore_test
+
+import (
+	"testing"
+
+	"github.com/hslatman/ipstore"
+	"github.com/hslatman/ipstore/ipstoretest"
+)
+
+func newStore(t *testing.T, entries []ipstoretest.Entry) *ipstore.Store[string] {
+	t.Helper()
+
+	s := ipstore.New[string]()
+	for _, e := range entries {
+		if err := s.AddCIDR(e.Prefix, e.Value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return s
+}
+
+func TestStoreConformance(t *testing.T) {
+	ipstoretest.RunReader(t, func(t *testing.T, entries []ipstoretest.Entry) ipstore.Reader[string] {
+		return newStore(t, entries)
+	})
+	ipstoretest.RunWriter(t, func(t *testing.T) (ipstore.Writer[string], ipstore.Reader[string]) {
+		s := ipstore.New[string]()
+		return s, s
+	})
+}
+
+func TestCompiledStoreConformance(t *testing.T) {
+	ipstoretest.RunReader(t, func(t *testing.T, entries []ipstoretest.Entry) ipstore.Reader[string] {
+		return compile(t, newStore(t, entries))
+	})
+}
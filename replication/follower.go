@@ -0,0 +1,228 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replication
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hslatman/ipstore"
+)
+
+// Dialer opens a connection to a [Leader].
+type Dialer func(ctx context.Context) (net.Conn, error)
+
+// TCPDialer returns a [Dialer] connecting to a [Leader] at the TCP address.
+func TCPDialer(addr string) Dialer {
+	return func(ctx context.Context) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", addr)
+	}
+}
+
+type backoff struct {
+	min, max time.Duration
+	onError  func(error)
+}
+
+// WithBackoff sets the minimum and maximum time a [Follower] waits before
+// reconnecting to its [Leader]. The time waited doubles after every failed
+// attempt. It defaults to between 100ms and 30s.
+func WithBackoff(min, max time.Duration) Option {
+	return func(o *options) {
+		o.backoff.min = min
+		o.backoff.max = max
+	}
+}
+
+// WithErrorHandler sets a function called by [Follower.Run] with the error
+// that ended a connection to the [Leader], before reconnecting.
+func WithErrorHandler(fn func(error)) Option {
+	return func(o *options) {
+		o.backoff.onError = fn
+	}
+}
+
+// Follower applies the snapshots and mutations streamed by a [Leader] to
+// a local [ipstore.Store]. The store must not be modified other than
+// through the [Follower].
+type Follower[T any] struct {
+	store   *ipstore.Store[T]
+	codec   ipstore.Codec[T]
+	dial    Dialer
+	backoff backoff
+
+	mu    sync.Mutex
+	epoch uint64
+	seq   uint64
+}
+
+// NewFollower returns a new [Follower] replicating into the
+// [ipstore.Store], connecting to the [Leader] using the [Dialer] and
+// decoding values using the [ipstore.Codec] provided.
+func NewFollower[T any](store *ipstore.Store[T], codec ipstore.Codec[T], dial Dialer, opts ...Option) *Follower[T] {
+	o := options{backoff: backoff{min: 100 * time.Millisecond, max: 30 * time.Second}}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return &Follower[T]{
+		store:   store,
+		codec:   codec,
+		dial:    dial,
+		backoff: o.backoff,
+	}
+}
+
+// Seq returns the sequence number of the last batch applied, which is 0
+// before the first snapshot has been received.
+func (f *Follower[T]) Seq() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.seq
+}
+
+// Run connects to the [Leader] and replicates its store, reconnecting
+// when the connection fails. It returns when ctx is done.
+func (f *Follower[T]) Run(ctx context.Context) error {
+	wait := f.backoff.min
+	for {
+		start := f.Seq()
+
+		conn, err := f.dial(ctx)
+		if err == nil {
+			err = f.Sync(ctx, conn)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if f.backoff.onError != nil {
+			f.backoff.onError(err)
+		}
+
+		// start over with the minimum backoff once a connection made
+		// progress, so that a leader restart is recovered from quickly.
+		if f.Seq() != start {
+			wait = f.backoff.min
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+		wait = min(2*wait, f.backoff.max)
+	}
+}
+
+// Sync replicates the store over a single connection to the [Leader],
+// until the connection fails or ctx is done. It closes the connection
+// when done.
+func (f *Follower[T]) Sync(ctx context.Context, conn net.Conn) error {
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	f.mu.Lock()
+	epoch, seq := f.epoch, f.seq
+	f.mu.Unlock()
+
+	if err := writeHello(conn, epoch, seq); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(conn)
+	var hdr [12]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return err
+	}
+	if [4]byte(hdr[:4]) != magic {
+		return fmt.Errorf("%w: unknown handshake", ErrProtocol)
+	}
+	leaderEpoch := binary.BigEndian.Uint64(hdr[4:])
+
+	for {
+		if err := f.readFrame(r, leaderEpoch); err != nil {
+			return err
+		}
+	}
+}
+
+func (f *Follower[T]) readFrame(r *bufio.Reader, epoch uint64) error {
+	typ, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	seq, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+
+	switch typ {
+	case frameSnapshot:
+		if err := f.store.ReadSnapshot(r, f.codec); err != nil {
+			return err
+		}
+
+		f.mu.Lock()
+		f.epoch, f.seq = epoch, seq
+		f.mu.Unlock()
+	case frameBatch:
+		f.mu.Lock()
+		expected := f.seq + 1
+		ok := f.epoch == epoch
+		f.mu.Unlock()
+		if !ok || seq != expected {
+			return fmt.Errorf("%w: expected batch %d; got %d", ErrProtocol, expected, seq)
+		}
+
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return err
+		}
+		if n > maxFrame {
+			return fmt.Errorf("%w: batch of %d bytes too large", ErrProtocol, n)
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return err
+		}
+		ms, err := ipstore.DecodeMutations(b, f.codec)
+		if err != nil {
+			return err
+		}
+		if err := f.store.Apply(ms...); err != nil {
+			return err
+		}
+
+		f.mu.Lock()
+		f.seq = seq
+		f.mu.Unlock()
+	default:
+		return fmt.Errorf("%w: unknown frame type %q", ErrProtocol, typ)
+	}
+
+	return nil
+}
@@ -0,0 +1,415 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package replication replicates an [ipstore.Store] from a single
+// [Leader] to any number of [Follower] instances over a [net.Conn].
+//
+// All writes go through the [Leader], which assigns every batch of
+// mutations a sequence number and keeps the most recent batches in a log.
+// A follower connecting for the first time receives a snapshot of the
+// store, followed by the batches applied after it. Followers that
+// reconnect resume from the last sequence number they applied, and
+// receive a new snapshot when the batches they missed are no longer in
+// the log, or when the leader was restarted.
+package replication
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/hslatman/ipstore"
+)
+
+const (
+	// DefaultLogSize is the default number of batches kept in the log.
+	DefaultLogSize = 10000
+
+	// maxFrame limits the size of a single encoded batch.
+	maxFrame = 64 << 20
+)
+
+var _ ipstore.Writer[any] = (*Leader[any])(nil)
+
+var magic = [4]byte{'I', 'P', 'R', 1}
+
+// frame types sent by the leader.
+const (
+	frameSnapshot byte = 'S'
+	frameBatch    byte = 'B'
+)
+
+// ErrClosed is returned by [Leader.Serve] after the [Leader] has been
+// closed.
+var ErrClosed = errors.New("replication: leader closed")
+
+// ErrProtocol is returned when a peer sends malformed data.
+var ErrProtocol = errors.New("replication: protocol error")
+
+// Option configures a [Leader] or [Follower].
+type Option func(*options)
+
+type options struct {
+	logSize int
+	backoff backoff
+}
+
+// WithLogSize sets the number of batches kept by a [Leader] for followers
+// that reconnect. Followers that missed more batches than that receive a
+// full snapshot instead. It defaults to [DefaultLogSize].
+func WithLogSize(n int) Option {
+	return func(o *options) {
+		o.logSize = max(n, 1)
+	}
+}
+
+// Leader accepts writes to an [ipstore.Store] and replicates them to
+// followers. The store must only be modified through the [Leader].
+type Leader[T any] struct {
+	store *ipstore.Store[T]
+	codec ipstore.Codec[T]
+	epoch uint64
+
+	mu      sync.Mutex
+	seq     uint64
+	log     [][]byte // encoded batches, the last one having sequence seq
+	logSize int
+	changed chan struct{}
+
+	connsMu   sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	done      chan struct{}
+}
+
+// NewLeader returns a new [Leader] for the [ipstore.Store], encoding
+// values using the [ipstore.Codec] provided.
+func NewLeader[T any](store *ipstore.Store[T], codec ipstore.Codec[T], opts ...Option) *Leader[T] {
+	o := options{logSize: DefaultLogSize}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	// the epoch identifies this instance of the leader, so that followers
+	// don't resume using sequence numbers of a previous instance.
+	var b [8]byte
+	rand.Read(b[:])
+
+	return &Leader[T]{
+		store:     store,
+		codec:     codec,
+		epoch:     binary.BigEndian.Uint64(b[:]),
+		logSize:   o.logSize,
+		changed:   make(chan struct{}),
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// AddCIDR adds an entry to the store and replicates it.
+func (l *Leader[T]) AddCIDR(key netip.Prefix, value T) error {
+	return l.Apply(ipstore.Mutation[T]{Op: ipstore.OpAdd, Prefix: key, Value: value})
+}
+
+// RemoveCIDR removes an entry from the store and replicates its removal.
+// It returns the value of the entry removed.
+func (l *Leader[T]) RemoveCIDR(key netip.Prefix) (T, error) {
+	var old T
+	ms := []ipstore.Mutation[T]{{Op: ipstore.OpRemove, Prefix: key}}
+	b, err := l.encode(ms)
+	if err != nil {
+		return old, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	old, _ = l.store.GetExactCIDR(key)
+	if err := l.commit(b, ms); err != nil {
+		var zero T
+		return zero, err
+	}
+
+	return old, nil
+}
+
+// Apply applies the mutations to the store atomically, and replicates
+// them as a single batch.
+func (l *Leader[T]) Apply(ms ...ipstore.Mutation[T]) error {
+	if len(ms) == 0 {
+		return nil
+	}
+
+	b, err := l.encode(ms)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.commit(b, ms)
+}
+
+func (l *Leader[T]) encode(ms []ipstore.Mutation[T]) ([]byte, error) {
+	for _, m := range ms {
+		if err := m.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	b, err := ipstore.AppendMutations(nil, ms, l.codec)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxFrame {
+		return nil, fmt.Errorf("batch of %d bytes exceeds the maximum of %d", len(b), maxFrame)
+	}
+
+	return b, nil
+}
+
+// commit applies the mutations to the store, and appends the batch
+// encoding them to the log. It must be called with l.mu held.
+func (l *Leader[T]) commit(b []byte, ms []ipstore.Mutation[T]) error {
+	if err := l.store.Apply(ms...); err != nil {
+		return err
+	}
+
+	l.seq++
+	l.log = append(l.log, b)
+	if len(l.log) > l.logSize {
+		l.log = append(l.log[:0:0], l.log[len(l.log)-l.logSize:]...)
+	}
+	close(l.changed)
+	l.changed = make(chan struct{})
+
+	return nil
+}
+
+// Seq returns the sequence number of the last batch applied.
+func (l *Leader[T]) Seq() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.seq
+}
+
+// Serve accepts connections from followers on the [net.Listener],
+// serving each of them in a new goroutine. It blocks until the listener
+// fails, or until the [Leader] is closed, in which case [ErrClosed] is
+// returned.
+func (l *Leader[T]) Serve(ln net.Listener) error {
+	l.connsMu.Lock()
+	if l.closed {
+		l.connsMu.Unlock()
+		return ErrClosed
+	}
+	l.listeners[ln] = struct{}{}
+	l.connsMu.Unlock()
+
+	defer func() {
+		l.connsMu.Lock()
+		delete(l.listeners, ln)
+		l.connsMu.Unlock()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-l.done:
+				return ErrClosed
+			default:
+				return err
+			}
+		}
+
+		go l.ServeConn(conn)
+	}
+}
+
+// Close closes all listeners and follower connections.
+func (l *Leader[T]) Close() error {
+	l.connsMu.Lock()
+	defer l.connsMu.Unlock()
+
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	close(l.done)
+
+	var errs []error
+	for ln := range l.listeners {
+		errs = append(errs, ln.Close())
+	}
+	for c := range l.conns {
+		errs = append(errs, c.Close())
+	}
+
+	return errors.Join(errs...)
+}
+
+// ServeConn streams the store to the follower on the other end of the
+// connection until either side closes it. It closes the connection when
+// done, and returns the error that ended the stream.
+func (l *Leader[T]) ServeConn(conn net.Conn) error {
+	l.connsMu.Lock()
+	if l.closed {
+		l.connsMu.Unlock()
+		conn.Close()
+		return ErrClosed
+	}
+	l.conns[conn] = struct{}{}
+	l.connsMu.Unlock()
+
+	defer func() {
+		l.connsMu.Lock()
+		delete(l.conns, conn)
+		l.connsMu.Unlock()
+		conn.Close()
+	}()
+
+	return l.stream(conn)
+}
+
+func (l *Leader[T]) stream(conn net.Conn) error {
+	r := bufio.NewReader(conn)
+	epoch, seq, err := readHello(r)
+	if err != nil {
+		return err
+	}
+
+	// followers don't send anything after the handshake, so reading
+	// only fails once the follower goes away.
+	gone := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, r)
+		close(gone)
+	}()
+
+	w := bufio.NewWriter(conn)
+	if _, err := w.Write(magic[:]); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, l.epoch); err != nil {
+		return err
+	}
+	if epoch != l.epoch {
+		seq = 0
+	}
+
+	// next is the sequence number of the next batch to send; after a
+	// snapshot it follows the sequence number the snapshot was taken at.
+	next := seq + 1
+	snapshot := seq == 0
+	for {
+		l.mu.Lock()
+		first := l.seq - uint64(len(l.log)) + 1
+		if next < first || next > l.seq+1 {
+			snapshot = true
+		}
+		var store *ipstore.Store[T]
+		var batches [][]byte
+		if snapshot {
+			store, next = l.store.Clone(), l.seq+1
+		} else {
+			batches = l.log[next-first:]
+		}
+		changed := l.changed
+		l.mu.Unlock()
+
+		if snapshot {
+			if err := writeSnapshot(w, store, l.codec, next-1); err != nil {
+				return err
+			}
+			snapshot = false
+		}
+		for _, b := range batches {
+			if err := writeBatch(w, next, b); err != nil {
+				return err
+			}
+			next++
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		if store == nil && len(batches) == 0 {
+			select {
+			case <-changed:
+			case <-gone:
+				return io.EOF
+			case <-l.done:
+				return ErrClosed
+			}
+		}
+	}
+}
+
+func writeSnapshot[T any](w *bufio.Writer, s *ipstore.Store[T], c ipstore.Codec[T], seq uint64) error {
+	if err := w.WriteByte(frameSnapshot); err != nil {
+		return err
+	}
+	if _, err := w.Write(binary.AppendUvarint(nil, seq)); err != nil {
+		return err
+	}
+
+	return s.WriteSnapshot(w, c)
+}
+
+func writeBatch(w *bufio.Writer, seq uint64, b []byte) error {
+	hdr := []byte{frameBatch}
+	hdr = binary.AppendUvarint(hdr, seq)
+	hdr = binary.AppendUvarint(hdr, uint64(len(b)))
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+
+	return err
+}
+
+func writeHello(w io.Writer, epoch, seq uint64) error {
+	b := append(magic[:0:0], magic[:]...)
+	b = binary.BigEndian.AppendUint64(b, epoch)
+	b = binary.AppendUvarint(b, seq)
+	_, err := w.Write(b)
+
+	return err
+}
+
+func readHello(r *bufio.Reader) (epoch, seq uint64, err error) {
+	var hdr [12]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, 0, err
+	}
+	if [4]byte(hdr[:4]) != magic {
+		return 0, 0, fmt.Errorf("%w: unknown handshake", ErrProtocol)
+	}
+	if seq, err = binary.ReadUvarint(r); err != nil {
+		return 0, 0, fmt.Errorf("%w: %w", ErrProtocol, err)
+	}
+
+	return binary.BigEndian.Uint64(hdr[4:]), seq, nil
+}
@@ -0,0 +1,297 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replication_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/hslatman/ipstore"
+	"github.com/hslatman/ipstore/ipstoretest"
+	"github.com/hslatman/ipstore/replication"
+)
+
+func newLeader(t *testing.T, opts ...replication.Option) (*replication.Leader[string], *ipstore.Store[string], string) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := ipstore.New[string]()
+	l := replication.NewLeader(s, ipstore.StringCodec{}, opts...)
+	done := make(chan error, 1)
+	go func() {
+		done <- l.Serve(ln)
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		if err := <-done; !errors.Is(err, replication.ErrClosed) {
+			t.Errorf("expected ErrClosed; got %v", err)
+		}
+	})
+
+	return l, s, ln.Addr().String()
+}
+
+// follow runs a follower until the returned function is called.
+func follow(t *testing.T, f *replication.Follower[string]) (stop func()) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- f.Run(ctx)
+	}()
+
+	stop = func() {
+		cancel()
+		if err := <-done; !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context.Canceled; got %v", err)
+		}
+	}
+	t.Cleanup(func() {
+		if ctx.Err() == nil {
+			stop()
+		}
+	})
+
+	return stop
+}
+
+func waitForSeq(t *testing.T, f *replication.Follower[string], seq uint64) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for f.Seq() != seq {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected follower to reach sequence %d; got %d", seq, f.Seq())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func add(t *testing.T, l *replication.Leader[string], cidrs ...string) {
+	t.Helper()
+
+	for _, cidr := range cidrs {
+		if err := l.AddCIDR(netip.MustParsePrefix(cidr), cidr); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func assertEqual(t *testing.T, a, b *ipstore.Store[string]) {
+	t.Helper()
+
+	if changes := ipstore.Diff(a, b, nil); len(changes) > 0 {
+		t.Errorf("expected stores to be equal; got changes %v", changes)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	l, ls, addr := newLeader(t)
+	add(t, l, "10.0.0.0/8", "192.0.2.0/24")
+
+	s := ipstore.New[string]()
+	f := replication.NewFollower(s, ipstore.StringCodec{}, replication.TCPDialer(addr))
+	follow(t, f)
+	waitForSeq(t, f, 2)
+	if s.Len() != 2 {
+		t.Errorf("expected 2 entries; got %d", s.Len())
+	}
+
+	add(t, l, "2001:db8::/32")
+	if _, err := l.RemoveCIDR(netip.MustParsePrefix("10.0.0.0/8")); err != nil {
+		t.Fatal(err)
+	}
+	err := l.Apply(
+		ipstore.Mutation[string]{Op: ipstore.OpAdd, Prefix: netip.MustParsePrefix("198.51.100.0/24"), Value: "batch"},
+		ipstore.Mutation[string]{Op: ipstore.OpRemove, Prefix: netip.MustParsePrefix("192.0.2.0/24")},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitForSeq(t, f, 5)
+	if l.Seq() != 5 {
+		t.Errorf("expected leader at sequence 5; got %d", l.Seq())
+	}
+	assertEqual(t, ls, s)
+}
+
+func TestReplicationResume(t *testing.T) {
+	l, _, addr := newLeader(t, replication.WithLogSize(10))
+	add(t, l, "10.0.0.0/8")
+
+	s := ipstore.New[string]()
+	f := replication.NewFollower(s, ipstore.StringCodec{}, replication.TCPDialer(addr))
+	stop := follow(t, f)
+	waitForSeq(t, f, 1)
+	stop()
+
+	// an entry only present in the follower survives resuming from the
+	// log, but not receiving a new snapshot.
+	if err := s.AddIPOrCIDR("203.0.113.0/24", "local"); err != nil {
+		t.Fatal(err)
+	}
+
+	add(t, l, "192.0.2.0/24", "198.51.100.0/24")
+	follow(t, f)
+	waitForSeq(t, f, 3)
+	if s.Len() != 4 {
+		t.Errorf("expected follower to resume from the log; got %d entries", s.Len())
+	}
+}
+
+func TestReplicationResyncAfterTruncation(t *testing.T) {
+	l, ls, addr := newLeader(t, replication.WithLogSize(2))
+	add(t, l, "10.0.0.0/8")
+
+	s := ipstore.New[string]()
+	f := replication.NewFollower(s, ipstore.StringCodec{}, replication.TCPDialer(addr))
+	stop := follow(t, f)
+	waitForSeq(t, f, 1)
+	stop()
+
+	if err := s.AddIPOrCIDR("203.0.113.0/24", "local"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 5 {
+		add(t, l, fmt.Sprintf("192.0.%d.0/24", i))
+	}
+	follow(t, f)
+	waitForSeq(t, f, 6)
+	if _, ok := s.GetOneIPOrCIDR("203.0.113.1"); ok {
+		t.Error("expected follower to receive a new snapshot")
+	}
+	assertEqual(t, ls, s)
+}
+
+func TestReplicationLeaderRestart(t *testing.T) {
+	l, _, addr := newLeader(t)
+	add(t, l, "10.0.0.0/8", "172.16.0.0/12")
+
+	s := ipstore.New[string]()
+	f := replication.NewFollower(s, ipstore.StringCodec{}, replication.TCPDialer(addr))
+	stop := follow(t, f)
+	waitForSeq(t, f, 2)
+	stop()
+
+	// a new leader at a higher sequence number must not be resumed from.
+	l2, ls2, addr2 := newLeader(t)
+	add(t, l2, "192.0.2.0/24", "198.51.100.0/24", "203.0.113.0/24")
+
+	f = replication.NewFollower(s, ipstore.StringCodec{}, replication.TCPDialer(addr2))
+	follow(t, f)
+	waitForSeq(t, f, 3)
+	assertEqual(t, ls2, s)
+}
+
+func TestFollowerReconnects(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+
+	l := replication.NewLeader(ipstore.New[string](), ipstore.StringCodec{})
+	add(t, l, "10.0.0.0/8")
+	go l.Serve(ln)
+
+	errs := make(chan error, 10)
+	s := ipstore.New[string]()
+	f := replication.NewFollower(s, ipstore.StringCodec{}, replication.TCPDialer(addr),
+		replication.WithBackoff(time.Millisecond, 10*time.Millisecond),
+		replication.WithErrorHandler(func(err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		}),
+	)
+	follow(t, f)
+	waitForSeq(t, f, 1)
+
+	l.Close()
+	<-errs
+
+	ln, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("failed listening on %s again: %v", addr, err)
+	}
+	l = replication.NewLeader(ipstore.New[string](), ipstore.StringCodec{})
+	t.Cleanup(func() { l.Close() })
+	add(t, l, "192.0.2.0/24", "198.51.100.0/24")
+	go l.Serve(ln)
+
+	waitForSeq(t, f, 2)
+	if _, ok := s.GetOneIPOrCIDR("10.0.0.1"); ok {
+		t.Error("expected entries of the previous leader to be removed")
+	}
+}
+
+func TestSync(t *testing.T) {
+	ls := ipstore.New[string]()
+	l := replication.NewLeader(ls, ipstore.StringCodec{})
+	add(t, l, "10.0.0.0/8", "2001:db8::/32")
+
+	c1, c2 := net.Pipe()
+	go l.ServeConn(c1)
+
+	s := ipstore.New[string]()
+	f := replication.NewFollower(s, ipstore.StringCodec{}, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- f.Sync(ctx, c2)
+	}()
+	waitForSeq(t, f, 2)
+	assertEqual(t, ls, s)
+
+	cancel()
+	if err := <-done; err == nil {
+		t.Error("expected Sync to return an error after cancelling")
+	}
+}
+
+func TestProtocolError(t *testing.T) {
+	c1, c2 := net.Pipe()
+	go func() {
+		c1.Write([]byte("HTTP/1.1 200 OK\r\n"))
+		c1.Close()
+	}()
+
+	f := replication.NewFollower(ipstore.New[string](), ipstore.StringCodec{}, nil)
+	go io.Copy(io.Discard, c1)
+	if err := f.Sync(context.Background(), c2); !errors.Is(err, replication.ErrProtocol) {
+		t.Errorf("expected ErrProtocol; got %v", err)
+	}
+}
+
+func TestLeaderConformance(t *testing.T) {
+	ipstoretest.RunWriter(t, func(t *testing.T) (ipstore.Writer[string], ipstore.Reader[string]) {
+		s := ipstore.New[string]()
+		return replication.NewLeader(s, ipstore.StringCodec{}), s
+	})
+}
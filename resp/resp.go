@@ -0,0 +1,484 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package resp exposes an [ipstore.Store] using the Redis serialization
+// protocol (RESP), so that any Redis client can perform lookups.
+//
+// The following commands are supported, next to PING, ECHO, HELLO and
+// QUIT:
+//
+//	IPADD <ip-or-cidr> <value>   add an entry
+//	IPGET <ip-or-cidr>           value of the longest matching entry, or nil
+//	IPDEL <ip-or-cidr>           remove an entry
+//	IPSUBNETS <cidr>             entries contained in a CIDR, as a map
+//	IPLEN                        number of entries
+//
+// Connections start out using RESP2, and can switch to RESP3 using
+// HELLO 3. Commands can be pipelined; replies are written in order.
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hslatman/ipstore"
+)
+
+const (
+	// maxBulkLen limits the size of a single argument.
+	maxBulkLen = 64 << 20
+	// maxArgs limits the number of arguments of a single command.
+	maxArgs = 1024
+	// maxEcho limits the length of arguments echoed in error replies.
+	maxEcho = 128
+	// bulkChunk is the size of the chunks large arguments are read in,
+	// so that memory is only allocated as their data arrives.
+	bulkChunk = 64 << 10
+)
+
+// ErrServerClosed is returned by [Server.Serve] after the [Server] has
+// been closed.
+var ErrServerClosed = errors.New("resp: server closed")
+
+// Server serves an [ipstore.Store] using RESP.
+type Server struct {
+	store *ipstore.Store[[]byte]
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+}
+
+// New returns a new [Server] for the [ipstore.Store].
+func New(store *ipstore.Store[[]byte]) *Server {
+	return &Server{
+		store:     store,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+// Serve accepts connections on the [net.Listener], serving each of them
+// in a new goroutine. It blocks until the listener fails, or until the
+// [Server] is closed, in which case [ErrServerClosed] is returned.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		go s.ServeConn(conn)
+	}
+}
+
+// Close closes all listeners and active connections.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+
+	var errs []error
+	for l := range s.listeners {
+		errs = append(errs, l.Close())
+	}
+	for c := range s.conns {
+		errs = append(errs, c.Close())
+	}
+
+	return errors.Join(errs...)
+}
+
+// ServeConn serves commands sent over the connection until the client
+// quits or the connection fails. It closes the connection when done.
+func (s *Server) ServeConn(conn net.Conn) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.Close()
+		return
+	}
+	s.conns[conn] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	c := &client{
+		r:     bufio.NewReader(conn),
+		w:     &writer{w: bufio.NewWriter(conn), proto: 2},
+		store: s.store,
+	}
+	c.serve()
+}
+
+// client holds the state of a single connection.
+type client struct {
+	r     *bufio.Reader
+	w     *writer
+	store *ipstore.Store[[]byte]
+}
+
+func (c *client) serve() {
+	for {
+		// replies to pipelined commands are buffered, and only flushed
+		// once all commands read so far have been handled.
+		if c.r.Buffered() == 0 {
+			if err := c.w.w.Flush(); err != nil {
+				return
+			}
+		}
+
+		args, err := readCommand(c.r)
+		if err != nil {
+			var perr protocolError
+			if errors.As(err, &perr) {
+				c.w.error("ERR Protocol error: " + perr.Error())
+				c.w.w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		if quit := c.handle(args); quit {
+			c.w.w.Flush()
+			return
+		}
+	}
+}
+
+func (c *client) handle(args [][]byte) (quit bool) {
+	name := strings.ToUpper(string(args[0]))
+	args = args[1:]
+
+	arity := func(n int) bool {
+		if len(args) != n {
+			c.w.error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", echo(strings.ToLower(name))))
+			return false
+		}
+		return true
+	}
+
+	switch name {
+	case "PING":
+		switch len(args) {
+		case 0:
+			c.w.simple("PONG")
+		case 1:
+			c.w.bulk(args[0])
+		default:
+			arity(1)
+		}
+	case "ECHO":
+		if arity(1) {
+			c.w.bulk(args[0])
+		}
+	case "QUIT":
+		c.w.simple("OK")
+		return true
+	case "HELLO":
+		c.hello(args)
+	case "COMMAND":
+		// clients such as redis-cli query the available commands on
+		// connect; an empty reply is sufficient for them.
+		c.w.array(0)
+	case "IPADD":
+		if !arity(2) {
+			return false
+		}
+		prf, ok := c.prefix(args[0])
+		if !ok {
+			return false
+		}
+		if err := c.store.AddCIDR(prf, append([]byte{}, args[1]...)); err != nil {
+			c.w.error("ERR " + err.Error())
+			return false
+		}
+		c.w.simple("OK")
+	case "IPGET":
+		if !arity(1) {
+			return false
+		}
+		prf, ok := c.prefix(args[0])
+		if !ok {
+			return false
+		}
+		if v, ok := c.store.GetOneCIDR(prf); ok {
+			c.w.bulk(v)
+		} else {
+			c.w.null()
+		}
+	case "IPDEL":
+		if !arity(1) {
+			return false
+		}
+		prf, ok := c.prefix(args[0])
+		if !ok {
+			return false
+		}
+		if _, err := c.store.RemoveCIDR(prf); err != nil {
+			c.w.error("ERR " + err.Error())
+			return false
+		}
+		c.w.simple("OK")
+	case "IPSUBNETS":
+		if !arity(1) {
+			return false
+		}
+		prf, ok := c.prefix(args[0])
+		if !ok {
+			return false
+		}
+		var entries [][2][]byte
+		for p, v := range c.store.Subnets(prf) {
+			entries = append(entries, [2][]byte{[]byte(p.String()), v})
+		}
+		c.w.mapHeader(len(entries))
+		for _, e := range entries {
+			c.w.bulk(e[0])
+			c.w.bulk(e[1])
+		}
+	case "IPLEN":
+		if arity(0) {
+			c.w.integer(int64(c.store.Len()))
+		}
+	default:
+		c.w.error(fmt.Sprintf("ERR unknown command '%s'", echo(strings.ToLower(name))))
+	}
+
+	return false
+}
+
+func (c *client) hello(args [][]byte) {
+	if len(args) > 0 {
+		proto, err := strconv.Atoi(string(args[0]))
+		if err != nil || (proto != 2 && proto != 3) {
+			c.w.error("NOPROTO unsupported protocol version")
+			return
+		}
+		c.w.proto = proto
+	}
+
+	c.w.mapHeader(3)
+	c.w.bulk([]byte("server"))
+	c.w.bulk([]byte("ipstore"))
+	c.w.bulk([]byte("proto"))
+	c.w.integer(int64(c.w.proto))
+	c.w.bulk([]byte("mode"))
+	c.w.bulk([]byte("standalone"))
+}
+
+func (c *client) prefix(arg []byte) (netip.Prefix, bool) {
+	s := string(arg)
+	if addr, err := netip.ParseAddr(s); err == nil {
+		prf, err := addr.Prefix(addr.BitLen())
+		if err == nil {
+			return prf, true
+		}
+	}
+
+	prf, err := netip.ParsePrefix(s)
+	if err != nil {
+		c.w.error(fmt.Sprintf("ERR invalid IP or CIDR '%s'", echo(s)))
+		return netip.Prefix{}, false
+	}
+
+	return prf, true
+}
+
+// lineBreaks replaces line breaks in error replies, so that arguments
+// echoed in them can't end the reply early.
+var lineBreaks = strings.NewReplacer("\r", " ", "\n", " ")
+
+// echo returns the argument truncated for including in an error reply.
+func echo(s string) string {
+	if len(s) > maxEcho {
+		return s[:maxEcho]
+	}
+
+	return s
+}
+
+// protocolError is returned for malformed requests.
+type protocolError string
+
+func (e protocolError) Error() string {
+	return string(e)
+}
+
+// readCommand reads a single command, either as a RESP array of bulk
+// strings or as an inline command.
+func readCommand(r *bufio.Reader) ([][]byte, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, nil
+	}
+
+	if line[0] != '*' {
+		var args [][]byte
+		for _, f := range strings.Fields(string(line)) {
+			args = append(args, []byte(f))
+		}
+		return args, nil
+	}
+
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > maxArgs {
+		return nil, protocolError("invalid multibulk length")
+	}
+
+	args := make([][]byte, 0, max(n, 0))
+	for range n {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, protocolError("expected '$'")
+		}
+		l, err := strconv.Atoi(string(line[1:]))
+		if err != nil || l < 0 || l > maxBulkLen {
+			return nil, protocolError("invalid bulk length")
+		}
+
+		b, err := readBulk(r, l+2)
+		if err != nil {
+			return nil, err
+		}
+		if b[l] != '\r' || b[l+1] != '\n' {
+			return nil, protocolError("expected CRLF after bulk string")
+		}
+		args = append(args, b[:l])
+	}
+
+	return args, nil
+}
+
+// readBulk reads n bytes, growing the buffer in chunks of at most
+// bulkChunk bytes as data arrives.
+func readBulk(r *bufio.Reader, n int) ([]byte, error) {
+	b := make([]byte, 0, min(n, bulkChunk))
+	for len(b) < n {
+		m := min(n-len(b), bulkChunk)
+		b = slices.Grow(b, m)
+		if _, err := io.ReadFull(r, b[len(b):len(b)+m]); err != nil {
+			return nil, err
+		}
+		b = b[:len(b)+m]
+	}
+
+	return b, nil
+}
+
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return nil, protocolError("line too long")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	line = line[:len(line)-1]
+	if n := len(line); n > 0 && line[n-1] == '\r' {
+		line = line[:n-1]
+	}
+
+	return line, nil
+}
+
+// writer writes replies in the protocol version negotiated.
+type writer struct {
+	w     *bufio.Writer
+	proto int
+}
+
+func (w *writer) simple(s string) {
+	w.w.WriteString("+" + s + "\r\n")
+}
+
+func (w *writer) error(s string) {
+	w.w.WriteString("-" + lineBreaks.Replace(s) + "\r\n")
+}
+
+func (w *writer) integer(i int64) {
+	w.w.WriteString(":" + strconv.FormatInt(i, 10) + "\r\n")
+}
+
+func (w *writer) bulk(b []byte) {
+	w.w.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+	w.w.Write(b)
+	w.w.WriteString("\r\n")
+}
+
+func (w *writer) null() {
+	if w.proto == 3 {
+		w.w.WriteString("_\r\n")
+		return
+	}
+	w.w.WriteString("$-1\r\n")
+}
+
+func (w *writer) array(n int) {
+	w.w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+// mapHeader writes the header of a map with n entries; in RESP2 maps are
+// written as flat arrays of keys and values.
+func (w *writer) mapHeader(n int) {
+	if w.proto == 3 {
+		w.w.WriteString("%" + strconv.Itoa(n) + "\r\n")
+		return
+	}
+	w.array(2 * n)
+}
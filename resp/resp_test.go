@@ -0,0 +1,238 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resp_test
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hslatman/ipstore"
+	"github.com/hslatman/ipstore/resp"
+)
+
+func newServer(t *testing.T) (*ipstore.Store[[]byte], string) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := ipstore.New[[]byte]()
+	srv := resp.New(s)
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Serve(l)
+	}()
+	t.Cleanup(func() {
+		srv.Close()
+		if err := <-done; !errors.Is(err, resp.ErrServerClosed) {
+			t.Errorf("expected ErrServerClosed; got %v", err)
+		}
+	})
+
+	return s, l.Addr().String()
+}
+
+type conn struct {
+	t *testing.T
+	c net.Conn
+	r *bufio.Reader
+}
+
+func dial(t *testing.T, addr string) *conn {
+	t.Helper()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	return &conn{t: t, c: c, r: bufio.NewReader(c)}
+}
+
+// send writes commands encoded as RESP arrays in a single write.
+func (c *conn) send(cmds ...[]string) {
+	c.t.Helper()
+
+	var b strings.Builder
+	for _, cmd := range cmds {
+		fmt.Fprintf(&b, "*%d\r\n", len(cmd))
+		for _, arg := range cmd {
+			fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if _, err := io.WriteString(c.c, b.String()); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// expect reads the raw reply and compares it with the expected reply.
+func (c *conn) expect(expected string) {
+	c.t.Helper()
+
+	b := make([]byte, len(expected))
+	if _, err := io.ReadFull(c.r, b); err != nil {
+		c.t.Fatalf("failed reading %q: %v (got %q)", expected, err, b)
+	}
+	if string(b) != expected {
+		c.t.Errorf("expected %q; got %q", expected, b)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	s, addr := newServer(t)
+	c := dial(t, addr)
+
+	c.send([]string{"PING"})
+	c.expect("+PONG\r\n")
+
+	c.send([]string{"IPADD", "10.0.0.0/8", "private"})
+	c.expect("+OK\r\n")
+	c.send([]string{"ipadd", "10.1.2.3", "host"})
+	c.expect("+OK\r\n")
+	if s.Len() != 2 {
+		t.Errorf("expected 2 entries; got %d", s.Len())
+	}
+
+	c.send([]string{"IPGET", "10.1.2.3"})
+	c.expect("$4\r\nhost\r\n")
+	c.send([]string{"IPGET", "10.2.2.2"})
+	c.expect("$7\r\nprivate\r\n")
+	c.send([]string{"IPGET", "192.0.2.1"})
+	c.expect("$-1\r\n")
+
+	c.send([]string{"IPLEN"})
+	c.expect(":2\r\n")
+
+	c.send([]string{"IPSUBNETS", "10.0.0.0/8"})
+	c.expect("*4\r\n$10\r\n10.0.0.0/8\r\n$7\r\nprivate\r\n$11\r\n10.1.2.3/32\r\n$4\r\nhost\r\n")
+
+	c.send([]string{"IPDEL", "10.1.2.3"})
+	c.expect("+OK\r\n")
+	c.send([]string{"IPLEN"})
+	c.expect(":1\r\n")
+
+	c.send([]string{"IPGET", "not-an-ip"})
+	c.expect("-ERR invalid IP or CIDR 'not-an-ip'\r\n")
+	c.send([]string{"IPADD", "10.0.0.0/8"})
+	c.expect("-ERR wrong number of arguments for 'ipadd' command\r\n")
+	c.send([]string{"FLUSHALL"})
+	c.expect("-ERR unknown command 'flushall'\r\n")
+
+	c.send([]string{"QUIT"})
+	c.expect("+OK\r\n")
+	if _, err := c.r.ReadByte(); !errors.Is(err, io.EOF) {
+		t.Errorf("expected connection to be closed; got %v", err)
+	}
+}
+
+func TestRESP3(t *testing.T) {
+	_, addr := newServer(t)
+	c := dial(t, addr)
+
+	c.send([]string{"HELLO", "3"})
+	c.expect("%3\r\n$6\r\nserver\r\n$7\r\nipstore\r\n$5\r\nproto\r\n:3\r\n$4\r\nmode\r\n$10\r\nstandalone\r\n")
+
+	c.send([]string{"IPGET", "192.0.2.1"})
+	c.expect("_\r\n")
+
+	c.send([]string{"IPADD", "2001:db8::/32", "doc"})
+	c.expect("+OK\r\n")
+	c.send([]string{"IPSUBNETS", "2001:db8::/16"})
+	c.expect("%1\r\n$13\r\n2001:db8::/32\r\n$3\r\ndoc\r\n")
+
+	c.send([]string{"HELLO", "4"})
+	c.expect("-NOPROTO unsupported protocol version\r\n")
+}
+
+func TestPipelining(t *testing.T) {
+	_, addr := newServer(t)
+	c := dial(t, addr)
+
+	var cmds [][]string
+	var expected strings.Builder
+	for i := range 100 {
+		cmds = append(cmds, []string{"IPADD", fmt.Sprintf("10.0.%d.0/24", i), fmt.Sprint(i)})
+		expected.WriteString("+OK\r\n")
+	}
+	for i := range 100 {
+		v := fmt.Sprint(i)
+		cmds = append(cmds, []string{"IPGET", fmt.Sprintf("10.0.%d.1", i)})
+		fmt.Fprintf(&expected, "$%d\r\n%s\r\n", len(v), v)
+	}
+	cmds = append(cmds, []string{"IPLEN"})
+	expected.WriteString(":100\r\n")
+
+	c.send(cmds...)
+	c.expect(expected.String())
+}
+
+func TestInlineCommands(t *testing.T) {
+	_, addr := newServer(t)
+	c := dial(t, addr)
+
+	if _, err := io.WriteString(c.c, "IPADD 192.0.2.0/24 test\r\nIPGET 192.0.2.1\r\nPING hello\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	c.expect("+OK\r\n$4\r\ntest\r\n$5\r\nhello\r\n")
+}
+
+func TestErrorInjection(t *testing.T) {
+	_, addr := newServer(t)
+	c := dial(t, addr)
+
+	c.send([]string{"IPGET", "x\r\n+OK"}, []string{"PING"})
+	c.expect("-ERR invalid IP or CIDR 'x  +OK'\r\n+PONG\r\n")
+
+	c.send([]string{strings.Repeat("x", 200)})
+	c.expect("-ERR unknown command '" + strings.Repeat("x", 128) + "'\r\n")
+}
+
+func TestLargeBulkLength(t *testing.T) {
+	_, addr := newServer(t)
+	c := dial(t, addr)
+
+	// the announced argument never arrives, so the command is still
+	// incomplete when the connection is closed.
+	if _, err := io.WriteString(c.c, "*2\r\n$5\r\nIPGET\r\n$67108864\r\n10.0.0.1\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	c.c.(*net.TCPConn).CloseWrite()
+	if _, err := c.r.ReadByte(); !errors.Is(err, io.EOF) {
+		t.Errorf("expected connection to be closed; got %v", err)
+	}
+}
+
+func TestProtocolError(t *testing.T) {
+	_, addr := newServer(t)
+	c := dial(t, addr)
+
+	if _, err := io.WriteString(c.c, "*1\r\n+PING\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	c.expect("-ERR Protocol error: expected '$'\r\n")
+	if _, err := c.r.ReadByte(); !errors.Is(err, io.EOF) {
+		t.Errorf("expected connection to be closed; got %v", err)
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Delegation describes a delegation of address space by a Regional
+// Internet Registry (RIR).
+type Delegation struct {
+	// Registry is the RIR the record was published by, e.g. "ripencc".
+	Registry string
+	// Country is the ISO 3166 country code the resources were delegated
+	// to. It's empty for resources that haven't been delegated.
+	Country string
+	// Status is the status of the delegation, e.g. "allocated",
+	// "assigned", "available" or "reserved".
+	Status string
+	// Date is the date the delegation was made. It's zero when the
+	// registry didn't record a date.
+	Date time.Time
+	// OpaqueID identifies the holder of the resources across records.
+	// It's only available in the extended format.
+	OpaqueID string
+}
+
+// ImportDelegated imports the IPv4 and IPv6 records in an RIR delegated
+// (extended) statistics file read from r into the [Store]. IPv4 records,
+// expressed as a start address and a number of addresses, are stored as
+// the minimal set of CIDRs covering them. Header, summary, comment and
+// ASN records are skipped. Importing stops at the first malformed line,
+// in which case a [*ParseError] is returned.
+func ImportDelegated(s *Store[Delegation], r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		prefixes, d, err := parseDelegatedLine(text)
+		if err != nil {
+			return &ParseError{Line: line, Text: text, Err: err}
+		}
+
+		for _, prf := range prefixes {
+			if err := s.AddCIDR(prf, d); err != nil {
+				return &ParseError{Line: line, Text: text, Err: err}
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed reading delegated statistics: %w", err)
+	}
+
+	return nil
+}
+
+func parseDelegatedLine(line string) ([]netip.Prefix, Delegation, error) {
+	if line == "" || line[0] == '#' {
+		return nil, Delegation{}, nil
+	}
+
+	fields := strings.Split(line, "|")
+	// the version header starts with a version number, such as 2 for
+	// RIPE NCC and 2.3 for ARIN and LACNIC.
+	if _, err := strconv.ParseFloat(fields[0], 64); err == nil {
+		return nil, Delegation{}, nil
+	}
+	if len(fields) < 6 {
+		return nil, Delegation{}, fmt.Errorf("expected at least 6 fields; got %d", len(fields))
+	}
+	if fields[5] == "summary" {
+		return nil, Delegation{}, nil
+	}
+	if len(fields) < 7 {
+		return nil, Delegation{}, fmt.Errorf("expected at least 7 fields; got %d", len(fields))
+	}
+
+	var prefixes []netip.Prefix
+	switch fields[2] {
+	case "asn":
+		return nil, Delegation{}, nil
+	case "ipv4":
+		start, err := netip.ParseAddr(fields[3])
+		if err != nil || !start.Is4() {
+			return nil, Delegation{}, fmt.Errorf("invalid IPv4 start address %q", fields[3])
+		}
+		count, err := strconv.ParseUint(fields[4], 10, 32)
+		if err != nil || count == 0 {
+			return nil, Delegation{}, fmt.Errorf("invalid IPv4 address count %q", fields[4])
+		}
+		first := uint64(binary.BigEndian.Uint32(start.AsSlice()))
+		if first+count-1 > 0xffffffff {
+			return nil, Delegation{}, errors.New("IPv4 range exceeds address space")
+		}
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], uint32(first+count-1))
+		if prefixes, err = rangePrefixes(start, netip.AddrFrom4(b)); err != nil {
+			return nil, Delegation{}, err
+		}
+	case "ipv6":
+		start, err := netip.ParseAddr(fields[3])
+		if err != nil || !start.Is6() {
+			return nil, Delegation{}, fmt.Errorf("invalid IPv6 start address %q", fields[3])
+		}
+		bits, err := strconv.Atoi(fields[4])
+		if err != nil {
+			return nil, Delegation{}, fmt.Errorf("invalid IPv6 prefix length %q", fields[4])
+		}
+		prf, err := start.Prefix(bits)
+		if err != nil {
+			return nil, Delegation{}, err
+		}
+		prefixes = []netip.Prefix{prf}
+	default:
+		return nil, Delegation{}, fmt.Errorf("unknown record type %q", fields[2])
+	}
+
+	d := Delegation{
+		Registry: fields[0],
+		Country:  fields[1],
+		Status:   fields[6],
+	}
+	if fields[5] != "" && fields[5] != "00000000" {
+		date, err := time.Parse("20060102", fields[5])
+		if err != nil {
+			return nil, Delegation{}, fmt.Errorf("invalid date %q", fields[5])
+		}
+		d.Date = date
+	}
+	if len(fields) > 7 {
+		d.OpaqueID = fields[7]
+	}
+
+	return prefixes, d, nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipstore_test
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hslatman/ipstore"
+)
+
+func TestImportDelegated(t *testing.T) {
+	f, err := os.Open("testdata/rir/delegated-ripencc-extended")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	s := ipstore.New[ipstore.Delegation]()
+	if err := ipstore.ImportDelegated(s, f); err != nil {
+		t.Fatal(err)
+	}
+
+	// 2.0.0.0/12, 31.3.0.0/21 + 31.3.8.0/22, 185.0.0.0/24 and two IPv6 prefixes
+	if s.Len() != 6 {
+		t.Errorf("expected 6 entries; got %d", s.Len())
+	}
+
+	r, err := s.GetCIDR(netip.MustParsePrefix("2.0.0.0/12"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r) != 1 {
+		t.Fatalf("expected 1 result; got %d", len(r))
+	}
+	expected := ipstore.Delegation{
+		Registry: "ripencc",
+		Country:  "FR",
+		Status:   "allocated",
+		Date:     time.Date(2010, 7, 12, 0, 0, 0, 0, time.UTC),
+		OpaqueID: "0f3cc1c4-6a40-4c15-b8a0-4b5ee7e8e6b4",
+	}
+	if r[0] != expected {
+		t.Errorf("expected %#+v; got %#+v", expected, r[0])
+	}
+
+	for _, ip := range []string{"31.3.0.1", "31.3.11.255"} {
+		v, ok := s.GetOne(netip.MustParseAddr(ip))
+		if !ok {
+			t.Errorf("expected %s to be in store", ip)
+		}
+		if v.Country != "NL" {
+			t.Errorf("expected NL for %s; got %q", ip, v.Country)
+		}
+	}
+	if ok, _ := s.Contains(netip.MustParseAddr("31.3.12.0")); ok {
+		t.Error("expected 31.3.12.0 not to be in store")
+	}
+
+	v, ok := s.GetOne(netip.MustParseAddr("185.0.0.1"))
+	if !ok {
+		t.Error("expected 185.0.0.1 to be in store")
+	}
+	if v.Status != "available" || !v.Date.IsZero() || v.OpaqueID != "" {
+		t.Errorf("unexpected delegation %#+v", v)
+	}
+
+	v, ok = s.GetOne(netip.MustParseAddr("2a00:1028::1"))
+	if !ok {
+		t.Error("expected 2a00:1028::1 to be in store")
+	}
+	if v.Country != "DE" {
+		t.Errorf("expected DE; got %q", v.Country)
+	}
+}
+
+func TestImportDelegatedARIN(t *testing.T) {
+	f, err := os.Open("testdata/rir/delegated-arin-extended")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	s := ipstore.New[ipstore.Delegation]()
+	if err := ipstore.ImportDelegated(s, f); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Len() != 2 {
+		t.Errorf("expected 2 entries; got %d", s.Len())
+	}
+	if v, _ := s.GetOne(netip.MustParseAddr("3.1.2.3")); v.Registry != "arin" || v.Country != "US" {
+		t.Errorf("expected an ARIN delegation to the US; got %#+v", v)
+	}
+	if v, _ := s.GetOne(netip.MustParseAddr("2001:400::1")); v.Status != "allocated" {
+		t.Errorf("expected allocated; got %#+v", v)
+	}
+}
+
+func TestImportDelegatedErrors(t *testing.T) {
+	for _, line := range []string{
+		"ripencc|FR|ipv4|2.0.0.0",
+		"ripencc|FR|ipv4|2.0.0|256|20100712|allocated",
+		"ripencc|FR|ipv4|2.0.0.0|abc|20100712|allocated",
+		"ripencc|FR|ipv4|255.255.255.0|512|20100712|allocated",
+		"ripencc|FR|ipv6|2001:610::|129|20100712|allocated",
+		"ripencc|FR|ipv4|2.0.0.0|256|2010-07-12|allocated",
+		"ripencc|FR|ipx|2.0.0.0|256|20100712|allocated",
+	} {
+		s := ipstore.New[ipstore.Delegation]()
+		err := ipstore.ImportDelegated(s, strings.NewReader("2|ripencc|20240101|1|19830705|20231231|+0100\n"+line+"\n"))
+		var perr *ipstore.ParseError
+		if !errors.As(err, &perr) {
+			t.Errorf("expected *ParseError for %q; got %v", line, err)
+			continue
+		}
+		if perr.Line != 2 {
+			t.Errorf("expected error on line 2 for %q; got %d", line, perr.Line)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package server exposes an [ipstore.Store] over HTTP, using JSON for
+// requests and responses.
+//
+// The following endpoints are available:
+//
+//	GET    /lookup/{ip}         longest match and all matches for an IP or CIDR
+//	POST   /lookup              lookups for a JSON array of IPs and CIDRs
+//	PUT    /entries/{prefix...} add an entry with the JSON request body as value
+//	DELETE /entries/{prefix...} remove an entry
+//	GET    /snapshot            download a binary snapshot of the store
+//
+// CIDRs in paths are written as usual, e.g. /lookup/10.0.0.0/8. The admin
+// endpoints for adding and removing entries are disabled unless they're
+// protected by a bearer token using [WithAdminToken], or explicitly opened
+// to everyone using [WithUnauthenticatedAdmin].
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+
+	"github.com/hslatman/ipstore"
+)
+
+// maxBatch limits the number of lookups in a single batch request.
+const maxBatch = 10000
+
+// maxBody limits the size of request bodies in bytes.
+const maxBody = 1 << 20
+
+// Server serves lookups in an [ipstore.Store] over HTTP.
+type Server[T any] struct {
+	store      *ipstore.Store[T]
+	codec      ipstore.Codec[T]
+	snapCodec  ipstore.Codec[T]
+	adminToken string
+	openAdmin  bool
+	mux        *http.ServeMux
+}
+
+// Option configures a [Server].
+type Option func(*options)
+
+type options struct {
+	adminToken string
+	openAdmin  bool
+}
+
+// WithAdminToken requires requests to the admin endpoints to carry the
+// token provided as a bearer token in the Authorization header.
+func WithAdminToken(token string) Option {
+	return func(o *options) {
+		o.adminToken = token
+	}
+}
+
+// WithUnauthenticatedAdmin enables the admin endpoints without requiring a
+// token, allowing anyone who can reach the [Server] to modify the store.
+// It's ignored when an admin token is set.
+func WithUnauthenticatedAdmin() Option {
+	return func(o *options) {
+		o.openAdmin = true
+	}
+}
+
+// New returns a new [Server] for a store holding raw JSON values.
+func New(store *ipstore.Store[json.RawMessage], opts ...Option) *Server[json.RawMessage] {
+	return NewWithCodec(store, ipstore.JSONCodec[json.RawMessage]{}, opts...)
+}
+
+// NewWithCodec returns a new [Server] for a store holding values of any
+// type. The [ipstore.Codec] provided encodes values to, and decodes them
+// from, JSON.
+func NewWithCodec[T any](store *ipstore.Store[T], codec ipstore.Codec[T], opts ...Option) *Server[T] {
+	return NewWithCodecs(store, codec, codec, opts...)
+}
+
+// NewWithCodecs returns a new [Server] like [NewWithCodec], encoding the
+// values in the snapshots it serves using snapshotCodec instead, so that
+// they can be loaded using the same codec.
+func NewWithCodecs[T any](store *ipstore.Store[T], codec, snapshotCodec ipstore.Codec[T], opts ...Option) *Server[T] {
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	s := &Server[T]{
+		store:      store,
+		codec:      codec,
+		snapCodec:  snapshotCodec,
+		adminToken: o.adminToken,
+		openAdmin:  o.openAdmin,
+		mux:        http.NewServeMux(),
+	}
+
+	s.mux.HandleFunc("GET /lookup/{query...}", s.handleLookup)
+	s.mux.HandleFunc("POST /lookup", s.handleBatchLookup)
+	s.mux.HandleFunc("PUT /entries/{prefix...}", s.admin(s.handleAdd))
+	s.mux.HandleFunc("DELETE /entries/{prefix...}", s.admin(s.handleRemove))
+	s.mux.HandleFunc("GET /snapshot", s.handleSnapshot)
+
+	return s
+}
+
+// ServeHTTP implements [http.Handler].
+func (s *Server[T]) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Match is an entry matching a lookup.
+type Match struct {
+	Prefix netip.Prefix    `json:"prefix"`
+	Value  json.RawMessage `json:"value"`
+}
+
+// Result is the result of a lookup. Longest is the most specific entry
+// matching the query, and is nil when there's no match. Matches holds all
+// entries matching the query, most specific first.
+type Result struct {
+	Query   string  `json:"query"`
+	Longest *Match  `json:"longest"`
+	Matches []Match `json:"matches"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func (s *Server[T]) lookup(query string) (Result, error) {
+	prf, err := parsePrefix(query)
+	if err != nil {
+		return Result{}, err
+	}
+
+	result := Result{Query: query, Matches: []Match{}}
+	for p, v := range s.store.Supernets(prf) {
+		b, err := s.codec.Marshal(v)
+		if err != nil {
+			return Result{}, fmt.Errorf("failed encoding value for %s: %w", p, err)
+		}
+		result.Matches = append(result.Matches, Match{Prefix: p, Value: b})
+	}
+	if len(result.Matches) > 0 {
+		result.Longest = &result.Matches[0]
+	}
+
+	return result, nil
+}
+
+func (s *Server[T]) handleLookup(w http.ResponseWriter, r *http.Request) {
+	result, err := s.lookup(r.PathValue("query"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	status := http.StatusOK
+	if result.Longest == nil {
+		status = http.StatusNotFound
+	}
+
+	writeJSON(w, status, result)
+}
+
+func (s *Server[T]) handleBatchLookup(w http.ResponseWriter, r *http.Request) {
+	var queries []string
+	if !decodeBody(w, r, &queries) {
+		return
+	}
+	if len(queries) > maxBatch {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("at most %d queries are allowed", maxBatch))
+		return
+	}
+
+	results := make([]Result, 0, len(queries))
+	for _, q := range queries {
+		result, err := s.lookup(q)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		results = append(results, result)
+	}
+
+	writeJSON(w, http.StatusOK, results)
+}
+
+func (s *Server[T]) handleAdd(w http.ResponseWriter, r *http.Request) {
+	prf, err := parsePrefix(r.PathValue("prefix"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var raw json.RawMessage
+	if !decodeBody(w, r, &raw) {
+		return
+	}
+	v, err := s.codec.Unmarshal(raw)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid value: %w", err))
+		return
+	}
+
+	if err := s.store.AddCIDR(prf, v); err != nil {
+		writeError(w, storeStatus(err), err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server[T]) handleRemove(w http.ResponseWriter, r *http.Request) {
+	prf, err := parsePrefix(r.PathValue("prefix"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if _, err := s.store.RemoveCIDR(prf); err != nil {
+		writeError(w, storeStatus(err), err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server[T]) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="ipstore.snap"`)
+
+	// headers have been sent by the time writing fails, so the client is
+	// left with a snapshot that fails its checksum.
+	_ = s.store.WriteSnapshot(w, s.snapCodec)
+}
+
+func (s *Server[T]) admin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case s.adminToken != "":
+			token := r.Header.Get("Authorization")
+			if subtle.ConstantTimeCompare([]byte(token), []byte("Bearer "+s.adminToken)) != 1 {
+				writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+				return
+			}
+		case !s.openAdmin:
+			writeError(w, http.StatusForbidden, errors.New("admin endpoints are disabled"))
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func parsePrefix(s string) (netip.Prefix, error) {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return addr.Prefix(addr.BitLen())
+	}
+
+	prf, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid IP or CIDR %q", s)
+	}
+
+	return prf, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// storeStatus returns the status for an error returned by the store,
+// which is the client's fault when it rejects the key.
+func storeStatus(err error) int {
+	var nce *ipstore.NonCanonicalError
+	if errors.As(err, &nce) || errors.Is(err, ipstore.ErrZone) {
+		return http.StatusBadRequest
+	}
+
+	return http.StatusInternalServerError
+}
+
+// decodeBody decodes the JSON request body into v, limiting its size to
+// maxBody. It writes an error response and returns false when that fails.
+func decodeBody(w http.ResponseWriter, r *http.Request, v any) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		var mbe *http.MaxBytesError
+		if errors.As(err, &mbe) {
+			writeError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("request body exceeds %d bytes", mbe.Limit))
+			return false
+		}
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return false
+	}
+
+	return true
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
@@ -0,0 +1,313 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/hslatman/ipstore"
+	"github.com/hslatman/ipstore/server"
+)
+
+func newServer(t *testing.T, opts ...server.Option) (*ipstore.Store[json.RawMessage], *httptest.Server) {
+	t.Helper()
+
+	s := ipstore.New[json.RawMessage]()
+	for ipOrCIDR, v := range map[string]string{
+		"10.0.0.0/8":    `{"name":"private"}`,
+		"10.1.0.0/16":   `{"name":"office"}`,
+		"2001:db8::/32": `"documentation"`,
+	} {
+		if err := s.AddIPOrCIDR(ipOrCIDR, json.RawMessage(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ts := httptest.NewServer(server.New(s, opts...))
+	t.Cleanup(ts.Close)
+
+	return s, ts
+}
+
+func do(t *testing.T, method, url, token, body string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+
+	return resp
+}
+
+func decode[T any](t *testing.T, resp *http.Response) T {
+	t.Helper()
+
+	var v T
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+
+	return v
+}
+
+func TestLookup(t *testing.T) {
+	_, ts := newServer(t)
+
+	resp := do(t, http.MethodGet, ts.URL+"/lookup/10.1.2.3", "", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200; got %d", resp.StatusCode)
+	}
+	result := decode[server.Result](t, resp)
+	if result.Longest == nil || result.Longest.Prefix != netip.MustParsePrefix("10.1.0.0/16") {
+		t.Errorf("unexpected longest match %#+v", result.Longest)
+	}
+	if string(result.Longest.Value) != `{"name":"office"}` {
+		t.Errorf("unexpected value %s", result.Longest.Value)
+	}
+	if len(result.Matches) != 2 || result.Matches[1].Prefix != netip.MustParsePrefix("10.0.0.0/8") {
+		t.Errorf("unexpected matches %#+v", result.Matches)
+	}
+
+	resp = do(t, http.MethodGet, ts.URL+"/lookup/2001:db8::/48", "", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200; got %d", resp.StatusCode)
+	}
+	result = decode[server.Result](t, resp)
+	if string(result.Longest.Value) != `"documentation"` {
+		t.Errorf("unexpected value %s", result.Longest.Value)
+	}
+
+	resp = do(t, http.MethodGet, ts.URL+"/lookup/192.0.2.1", "", "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status 404; got %d", resp.StatusCode)
+	}
+	result = decode[server.Result](t, resp)
+	if result.Longest != nil || len(result.Matches) != 0 {
+		t.Errorf("expected no matches; got %#+v", result)
+	}
+
+	resp = do(t, http.MethodGet, ts.URL+"/lookup/not-an-ip", "", "")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400; got %d", resp.StatusCode)
+	}
+}
+
+func TestBatchLookup(t *testing.T) {
+	_, ts := newServer(t)
+
+	resp := do(t, http.MethodPost, ts.URL+"/lookup", "", `["10.1.2.3", "192.0.2.1", "2001:db8::1"]`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200; got %d", resp.StatusCode)
+	}
+	results := decode[[]server.Result](t, resp)
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results; got %d", len(results))
+	}
+	if results[0].Query != "10.1.2.3" || len(results[0].Matches) != 2 {
+		t.Errorf("unexpected result %#+v", results[0])
+	}
+	if results[1].Longest != nil {
+		t.Errorf("expected no match; got %#+v", results[1])
+	}
+	if results[2].Longest == nil {
+		t.Errorf("expected match; got %#+v", results[2])
+	}
+
+	resp = do(t, http.MethodPost, ts.URL+"/lookup", "", `["10.1.2.3", "invalid"]`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400; got %d", resp.StatusCode)
+	}
+	resp = do(t, http.MethodPost, ts.URL+"/lookup", "", `{`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400; got %d", resp.StatusCode)
+	}
+}
+
+func TestBodyLimit(t *testing.T) {
+	_, ts := newServer(t, server.WithAdminToken("secret"))
+
+	body := `["` + strings.Repeat("1", 1<<20) + `"]`
+	resp := do(t, http.MethodPost, ts.URL+"/lookup", "", body)
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status 413; got %d", resp.StatusCode)
+	}
+
+	body = `"` + strings.Repeat("x", 1<<20) + `"`
+	resp = do(t, http.MethodPut, ts.URL+"/entries/192.0.2.0/24", "secret", body)
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status 413; got %d", resp.StatusCode)
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	s, ts := newServer(t, server.WithAdminToken("secret"))
+
+	resp := do(t, http.MethodPut, ts.URL+"/entries/192.0.2.0/24", "", `{"name":"test"}`)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status 401; got %d", resp.StatusCode)
+	}
+	resp = do(t, http.MethodPut, ts.URL+"/entries/192.0.2.0/24", "wrong", `{"name":"test"}`)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status 401; got %d", resp.StatusCode)
+	}
+
+	resp = do(t, http.MethodPut, ts.URL+"/entries/192.0.2.0/24", "secret", `{"name":"test"}`)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("expected status 204; got %d", resp.StatusCode)
+	}
+	v, ok := s.GetOne(netip.MustParseAddr("192.0.2.1"))
+	if !ok || string(v) != `{"name":"test"}` {
+		t.Errorf("unexpected value %s", v)
+	}
+
+	resp = do(t, http.MethodPut, ts.URL+"/entries/192.0.2.0/24", "secret", `{`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400; got %d", resp.StatusCode)
+	}
+
+	resp = do(t, http.MethodDelete, ts.URL+"/entries/10.1.0.0/16", "secret", "")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("expected status 204; got %d", resp.StatusCode)
+	}
+	if s.Len() != 3 {
+		t.Errorf("expected 3 entries; got %d", s.Len())
+	}
+
+	resp = do(t, http.MethodDelete, ts.URL+"/entries/invalid", "secret", "")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400; got %d", resp.StatusCode)
+	}
+}
+
+func TestAdminDisabled(t *testing.T) {
+	s, ts := newServer(t)
+
+	resp := do(t, http.MethodPut, ts.URL+"/entries/192.0.2.0/24", "", `{"name":"test"}`)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected status 403; got %d", resp.StatusCode)
+	}
+	resp = do(t, http.MethodDelete, ts.URL+"/entries/10.0.0.0/8", "", "")
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected status 403; got %d", resp.StatusCode)
+	}
+	if s.Len() != 3 {
+		t.Errorf("expected the store to be unchanged; got %d entries", s.Len())
+	}
+
+	s, ts = newServer(t, server.WithUnauthenticatedAdmin())
+	resp = do(t, http.MethodDelete, ts.URL+"/entries/10.0.0.0/8", "", "")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("expected status 204; got %d", resp.StatusCode)
+	}
+	if s.Len() != 2 {
+		t.Errorf("expected 2 entries; got %d", s.Len())
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	s, ts := newServer(t)
+
+	resp := do(t, http.MethodGet, ts.URL+"/snapshot", "", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200; got %d", resp.StatusCode)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := ipstore.New[json.RawMessage]()
+	if err := r.ReadSnapshot(strings.NewReader(string(b)), ipstore.JSONCodec[json.RawMessage]{}); err != nil {
+		t.Fatal(err)
+	}
+	if r.Len() != s.Len() {
+		t.Errorf("expected %d entries; got %d", s.Len(), r.Len())
+	}
+}
+
+func TestNewWithCodecs(t *testing.T) {
+	s := ipstore.New[string]()
+	if err := s.AddIPOrCIDR("10.0.0.0/8", "private"); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(server.NewWithCodecs(s, ipstore.JSONCodec[string]{}, ipstore.StringCodec{}))
+	t.Cleanup(ts.Close)
+
+	resp := do(t, http.MethodGet, ts.URL+"/snapshot", "", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200; got %d", resp.StatusCode)
+	}
+	r := ipstore.New[string]()
+	if err := r.ReadSnapshot(resp.Body, ipstore.StringCodec{}); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := r.GetOneIPOrCIDR("10.1.2.3"); v != "private" {
+		t.Errorf("expected private; got %q", v)
+	}
+}
+
+func TestRejectedKey(t *testing.T) {
+	s := ipstore.New[string](ipstore.WithPrefixPolicy(ipstore.PrefixStrict))
+	ts := httptest.NewServer(server.NewWithCodec(s, ipstore.JSONCodec[string]{}, server.WithUnauthenticatedAdmin()))
+	t.Cleanup(ts.Close)
+
+	resp := do(t, http.MethodPut, ts.URL+"/entries/10.1.2.3/16", "", `"private"`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400; got %d", resp.StatusCode)
+	}
+	resp = do(t, http.MethodDelete, ts.URL+"/entries/10.1.2.3/16", "", "")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400; got %d", resp.StatusCode)
+	}
+}
+
+func TestNewWithCodec(t *testing.T) {
+	s := ipstore.New[string]()
+	if err := s.AddIPOrCIDR("10.0.0.0/8", "private"); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(server.NewWithCodec(s, ipstore.JSONCodec[string]{}, server.WithUnauthenticatedAdmin()))
+	t.Cleanup(ts.Close)
+
+	resp := do(t, http.MethodGet, ts.URL+"/lookup/10.0.0.1", "", "")
+	result := decode[server.Result](t, resp)
+	if result.Longest == nil || string(result.Longest.Value) != `"private"` {
+		t.Errorf("unexpected result %#+v", result)
+	}
+
+	resp = do(t, http.MethodPut, ts.URL+"/entries/192.0.2.1", "", `"documentation"`)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("expected status 204; got %d", resp.StatusCode)
+	}
+	if v, _ := s.GetOne(netip.MustParseAddr("192.0.2.1")); v != "documentation" {
+		t.Errorf("expected %q; got %q", "documentation", v)
+	}
+}
@@ -0,0 +1,282 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipstore
+
+import (
+	"iter"
+	"net/netip"
+	"slices"
+	"sync"
+
+	"github.com/gaissmai/bart"
+)
+
+// Set is a set of IP addresses, built from prefixes. Unlike a [Store], it
+// doesn't keep track of the prefixes added: adding 10.0.0.0/25 and
+// 10.0.0.128/25 results in the same set as adding 10.0.0.0/24, and
+// removing 10.0.0.1/32 from it removes only that address.
+type Set struct {
+	mu sync.RWMutex
+	// lite holds the minimal set of prefixes covering the addresses in
+	// the set. Its prefixes don't overlap, and siblings are merged.
+	lite *bart.Lite
+}
+
+// NewSet returns a new [Set] holding the prefixes provided.
+func NewSet(prefixes ...netip.Prefix) *Set {
+	s := &Set{lite: new(bart.Lite)}
+	for _, prf := range prefixes {
+		s.Add(prf)
+	}
+
+	return s
+}
+
+// Add adds the addresses in the prefix to the [Set]. Invalid prefixes are
+// ignored.
+func (s *Set) Add(prf netip.Prefix) {
+	if !prf.IsValid() {
+		return
+	}
+	prf = prf.Masked()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.lite.LookupPrefix(prf) {
+		return
+	}
+	for _, sub := range slices.Collect(s.lite.Subnets(prf)) {
+		s.lite.Delete(sub)
+	}
+
+	// merge the prefix with its sibling for as long as the sibling is in
+	// the set, too.
+	for prf.Bits() > 0 {
+		sibling := siblingPrefix(prf)
+		if !s.lite.Get(sibling) {
+			break
+		}
+		s.lite.Delete(sibling)
+		prf = netip.PrefixFrom(prf.Addr(), prf.Bits()-1).Masked()
+	}
+	s.lite.Insert(prf)
+}
+
+// Remove removes the addresses in the prefix from the [Set]. Invalid
+// prefixes are ignored.
+func (s *Set) Remove(prf netip.Prefix) {
+	if !prf.IsValid() {
+		return
+	}
+	prf = prf.Masked()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sub := range slices.Collect(s.lite.Subnets(prf)) {
+		s.lite.Delete(sub)
+	}
+
+	super, ok := s.lite.LookupPrefixLPM(prf)
+	if !ok {
+		return
+	}
+
+	// split the prefix covering the one removed into the halves that
+	// don't contain it.
+	s.lite.Delete(super)
+	for bits := prf.Bits(); bits > super.Bits(); bits-- {
+		s.lite.Insert(siblingPrefix(netip.PrefixFrom(prf.Addr(), bits).Masked()))
+	}
+}
+
+// Contains returns whether the [Set] contains the address.
+func (s *Set) Contains(ip netip.Addr) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.lite.Lookup(ip)
+}
+
+// ContainsPrefix returns whether the [Set] contains all addresses in the
+// prefix.
+func (s *Set) ContainsPrefix(prf netip.Prefix) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.lite.LookupPrefix(prf)
+}
+
+// Prefixes returns an iterator over the minimal, sorted set of prefixes
+// covering the addresses in the [Set]. IPv4 prefixes sort before IPv6
+// prefixes.
+func (s *Set) Prefixes() iter.Seq[netip.Prefix] {
+	return func(yield func(netip.Prefix) bool) {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+
+		s.lite.AllSorted()(yield)
+	}
+}
+
+// Ranges returns an iterator over the sorted, inclusive ranges of
+// addresses in the [Set], yielding the first and last address of each
+// range. IPv4 ranges sort before IPv6 ranges.
+func (s *Set) Ranges() iter.Seq2[netip.Addr, netip.Addr] {
+	return func(yield func(netip.Addr, netip.Addr) bool) {
+		for _, r := range s.ranges() {
+			if !yield(r.from, r.to) {
+				return
+			}
+		}
+	}
+}
+
+// Len returns the number of prefixes returned by [Set.Prefixes].
+func (s *Set) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.lite.Size()
+}
+
+// Clone returns a copy of the [Set].
+func (s *Set) Clone() *Set {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return &Set{lite: s.lite.Clone()}
+}
+
+// Union returns a new [Set] containing the addresses in either [Set].
+func (s *Set) Union(o *Set) *Set {
+	return setFromRanges(mergeRanges(append(s.ranges(), o.ranges()...)))
+}
+
+// Intersection returns a new [Set] containing the addresses in both sets.
+func (s *Set) Intersection(o *Set) *Set {
+	return setFromRanges(intersectRanges(s.ranges(), o.ranges()))
+}
+
+// Difference returns a new [Set] containing the addresses in s that
+// aren't in o.
+func (s *Set) Difference(o *Set) *Set {
+	return setFromRanges(subtractRanges(s.ranges(), o.ranges()))
+}
+
+// Complement returns a new [Set] containing the addresses in the universe
+// that aren't in the [Set]. Use 0.0.0.0/0 or ::/0 as the universe for the
+// complement within all IPv4 or IPv6 addresses.
+func (s *Set) Complement(universe netip.Prefix) *Set {
+	if !universe.IsValid() {
+		return NewSet()
+	}
+	universe = universe.Masked()
+	u := []addrRange{{from: universe.Addr(), to: lastAddr(universe)}}
+
+	return setFromRanges(subtractRanges(u, s.ranges()))
+}
+
+// ranges returns the merged ranges of addresses in the [Set].
+func (s *Set) ranges() []addrRange {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var ranges []addrRange
+	for prf := range s.lite.AllSorted() {
+		ranges = append(ranges, addrRange{from: prf.Addr(), to: lastAddr(prf)})
+	}
+
+	return mergeRanges(ranges)
+}
+
+// setFromRanges returns a new [Set] containing the addresses in the
+// sorted, merged ranges.
+func setFromRanges(ranges []addrRange) *Set {
+	s := NewSet()
+	for _, r := range ranges {
+		prefixes, _ := rangePrefixes(r.from, r.to)
+		for _, prf := range prefixes {
+			s.lite.Insert(prf)
+		}
+	}
+
+	return s
+}
+
+// siblingPrefix returns the other half of the parent of the prefix.
+func siblingPrefix(prf netip.Prefix) netip.Prefix {
+	b := prf.Addr().AsSlice()
+	i := prf.Bits() - 1
+	b[i/8] ^= 0x80 >> (i % 8)
+
+	addr, _ := netip.AddrFromSlice(b)
+	return netip.PrefixFrom(addr, prf.Bits())
+}
+
+// intersectRanges returns the ranges of addresses in both a and b, which
+// must be sorted and merged.
+func intersectRanges(a, b []addrRange) []addrRange {
+	var result []addrRange
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		from, to := a[i].from, a[i].to
+		if from.Less(b[j].from) {
+			from = b[j].from
+		}
+		if b[j].to.Less(to) {
+			to = b[j].to
+		}
+		if from.Is4() == to.Is4() && !to.Less(from) {
+			result = append(result, addrRange{from: from, to: to})
+		}
+
+		if a[i].to.Less(b[j].to) {
+			i++
+		} else {
+			j++
+		}
+	}
+
+	return result
+}
+
+// subtractRanges returns the ranges of addresses in a that aren't in b,
+// which must be sorted and merged.
+func subtractRanges(a, b []addrRange) []addrRange {
+	var result []addrRange
+	j := 0
+	for _, r := range a {
+		from := r.from
+		for j < len(b) && b[j].to.Less(from) {
+			j++
+		}
+		for k := j; k < len(b) && !r.to.Less(b[k].from); k++ {
+			if from.Less(b[k].from) {
+				result = append(result, addrRange{from: from, to: b[k].from.Prev()})
+			}
+			if !b[k].to.Less(r.to) {
+				from = netip.Addr{}
+				break
+			}
+			from = b[k].to.Next()
+		}
+		if from.IsValid() {
+			result = append(result, addrRange{from: from, to: r.to})
+		}
+	}
+
+	return result
+}
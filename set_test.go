@@ -0,0 +1,181 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipstore_test
+
+import (
+	"math/rand/v2"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/hslatman/ipstore"
+)
+
+// model is a set of addresses in 10.0.0.0/24, to verify a Set against.
+type model [256]bool
+
+func (m *model) set(prf netip.Prefix, v bool) {
+	for i := range m {
+		if prf.Contains(netip.AddrFrom4([4]byte{10, 0, 0, byte(i)})) {
+			m[i] = v
+		}
+	}
+}
+
+func (m *model) prefixes() []netip.Prefix {
+	var prefixes []netip.Prefix
+	for i, ok := range m {
+		if ok {
+			prefixes = append(prefixes, netip.PrefixFrom(netip.AddrFrom4([4]byte{10, 0, 0, byte(i)}), 32))
+		}
+	}
+
+	return ipstore.Aggregate(slices.Values(prefixes))
+}
+
+func randomSet(r *rand.Rand) (*ipstore.Set, *model) {
+	s, m := ipstore.NewSet(), new(model)
+	for range 20 {
+		prf := netip.PrefixFrom(netip.AddrFrom4([4]byte{10, 0, 0, byte(r.IntN(256))}), 24+r.IntN(9)).Masked()
+		if r.IntN(3) == 0 {
+			s.Remove(prf)
+			m.set(prf, false)
+		} else {
+			s.Add(prf)
+			m.set(prf, true)
+		}
+	}
+
+	return s, m
+}
+
+func verifySet(t *testing.T, name string, s *ipstore.Set, m *model) {
+	t.Helper()
+
+	if got, expected := slices.Collect(s.Prefixes()), m.prefixes(); !slices.Equal(got, expected) {
+		t.Errorf("%s: expected prefixes %v; got %v", name, expected, got)
+	}
+	for i, ok := range m {
+		if ip := netip.AddrFrom4([4]byte{10, 0, 0, byte(i)}); s.Contains(ip) != ok {
+			t.Errorf("%s: expected Contains(%s) to be %t", name, ip, ok)
+		}
+	}
+}
+
+func TestSetMatchesModel(t *testing.T) {
+	r := rand.New(rand.NewPCG(9, 10))
+	for range 200 {
+		a, ma := randomSet(r)
+		b, mb := randomSet(r)
+		verifySet(t, "a", a, ma)
+
+		var union, intersection, difference, complement model
+		for i := range ma {
+			union[i] = ma[i] || mb[i]
+			intersection[i] = ma[i] && mb[i]
+			difference[i] = ma[i] && !mb[i]
+			complement[i] = !ma[i]
+		}
+		verifySet(t, "union", a.Union(b), &union)
+		verifySet(t, "intersection", a.Intersection(b), &intersection)
+		verifySet(t, "difference", a.Difference(b), &difference)
+		verifySet(t, "complement", a.Complement(netip.MustParsePrefix("10.0.0.0/24")), &complement)
+	}
+}
+
+func TestSetContainsPrefix(t *testing.T) {
+	s := ipstore.NewSet(netip.MustParsePrefix("10.0.0.0/25"), netip.MustParsePrefix("10.0.0.128/25"))
+	if s.Len() != 1 {
+		t.Errorf("expected 1 prefix; got %d", s.Len())
+	}
+	if !s.ContainsPrefix(netip.MustParsePrefix("10.0.0.0/24")) {
+		t.Error("expected 10.0.0.0/24 to be contained")
+	}
+
+	s.Remove(netip.MustParsePrefix("10.0.0.1/32"))
+	if s.ContainsPrefix(netip.MustParsePrefix("10.0.0.0/24")) {
+		t.Error("expected 10.0.0.0/24 not to be contained")
+	}
+	if !s.ContainsPrefix(netip.MustParsePrefix("10.0.0.128/25")) {
+		t.Error("expected 10.0.0.128/25 to be contained")
+	}
+	if s.Contains(netip.MustParseAddr("10.0.0.1")) {
+		t.Error("expected 10.0.0.1 not to be contained")
+	}
+	if !s.Contains(netip.MustParseAddr("10.0.0.0")) {
+		t.Error("expected 10.0.0.0 to be contained")
+	}
+}
+
+func TestSetRanges(t *testing.T) {
+	s := ipstore.NewSet(
+		netip.MustParsePrefix("2001:db8::/32"),
+		netip.MustParsePrefix("10.0.0.0/24"),
+		netip.MustParsePrefix("10.0.1.0/25"),
+		netip.MustParsePrefix("192.0.2.0/24"),
+	)
+
+	type addrRange struct{ from, to string }
+	var got []addrRange
+	for from, to := range s.Ranges() {
+		got = append(got, addrRange{from.String(), to.String()})
+	}
+	expected := []addrRange{
+		{"10.0.0.0", "10.0.1.127"},
+		{"192.0.2.0", "192.0.2.255"},
+		{"2001:db8::", "2001:db8:ffff:ffff:ffff:ffff:ffff:ffff"},
+	}
+	if !slices.Equal(got, expected) {
+		t.Errorf("expected %v; got %v", expected, got)
+	}
+}
+
+func TestSetMixedFamilies(t *testing.T) {
+	a := ipstore.NewSet(netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8::/32"))
+	b := ipstore.NewSet(netip.MustParsePrefix("10.1.0.0/16"), netip.MustParsePrefix("::/0"))
+
+	if got := slices.Collect(a.Intersection(b).Prefixes()); !slices.Equal(got, []netip.Prefix{
+		netip.MustParsePrefix("10.1.0.0/16"),
+		netip.MustParsePrefix("2001:db8::/32"),
+	}) {
+		t.Errorf("unexpected intersection %v", got)
+	}
+	if got := a.Difference(b); got.Len() != 8 || got.Contains(netip.MustParseAddr("10.1.2.3")) || got.Contains(netip.MustParseAddr("2001:db8::1")) {
+		t.Errorf("unexpected difference %v", slices.Collect(got.Prefixes()))
+	}
+	if got := a.Union(b); got.Len() != 2 || !got.Contains(netip.MustParseAddr("10.255.255.255")) {
+		t.Errorf("unexpected union %v", slices.Collect(got.Prefixes()))
+	}
+
+	c := a.Complement(netip.MustParsePrefix("0.0.0.0/0"))
+	if c.Contains(netip.MustParseAddr("10.0.0.1")) || !c.Contains(netip.MustParseAddr("255.255.255.255")) || c.Contains(netip.MustParseAddr("2001:db8::1")) {
+		t.Errorf("unexpected complement %v", slices.Collect(c.Prefixes()))
+	}
+	if c := a.Complement(netip.MustParsePrefix("::/0")); c.Contains(netip.MustParseAddr("2001:db8::1")) || !c.Contains(netip.MustParseAddr("::1")) {
+		t.Errorf("unexpected complement %v", slices.Collect(c.Prefixes()))
+	}
+}
+
+func TestSetClone(t *testing.T) {
+	s := ipstore.NewSet(netip.MustParsePrefix("10.0.0.0/8"))
+	c := s.Clone()
+	s.Remove(netip.MustParsePrefix("10.0.0.0/8"))
+	if s.Len() != 0 {
+		t.Errorf("expected 0 prefixes; got %d", s.Len())
+	}
+	if !c.Contains(netip.MustParseAddr("10.0.0.1")) {
+		t.Error("expected 10.0.0.1 to be contained in clone")
+	}
+}
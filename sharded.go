@@ -0,0 +1,719 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipstore
+
+import (
+	"context"
+	"io"
+	"iter"
+	"net/netip"
+	"slices"
+)
+
+// defaultShardBits is the number of leading address bits used to select
+// the shard of a prefix when [WithShardBits] isn't used.
+const defaultShardBits = 8
+
+// WithShardBits sets the number of leading address bits used to select
+// the shard of a prefix in a [ShardedStore], resulting in 2^n shards per
+// address family. n is limited to between 1 and 16; the default is 8.
+func WithShardBits(n int) Option {
+	return func(o *options) {
+		o.shardBits = min(max(n, 1), 16)
+	}
+}
+
+// ShardedStore is a key/value store using IPs and CIDRs as keys, like
+// [Store], that partitions its entries by address family and leading
+// address bits into independent tables, each with their own lock. Writes
+// to different shards don't block each other, which helps workloads with
+// many concurrent writes.
+//
+// Prefixes shorter than the shard width are kept in a separate table, that
+// is consulted after the shard, so that lookups still return the most
+// specific entry. Lookups of a single key observe a consistent state, but
+// iterating over multiple shards, such as with [ShardedStore.All], doesn't.
+// Operations covering the whole store, such as snapshots and batch
+// lookups, lock all shards together. Snapshots and compiled stores are
+// interchangeable with those of a [Store].
+type ShardedStore[T any] struct {
+	// stores holds the table for prefixes shorter than the shard width,
+	// followed by the IPv4 shards and the IPv6 shards. Stores are always
+	// locked in this order.
+	stores []*Store[T]
+	short  *Store[T]
+	bits   int
+	opts   options
+}
+
+// NewShardedStore returns a new instance of [ShardedStore]. The options
+// are used for every shard.
+func NewShardedStore[T any](opts ...Option) *ShardedStore[T] {
+	o := options{shardBits: defaultShardBits}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	stores := make([]*Store[T], 1+2<<o.shardBits)
+	for i := range stores {
+		stores[i] = New[T](opts...)
+	}
+
+	return &ShardedStore[T]{
+		stores: stores,
+		short:  stores[0],
+		bits:   o.shardBits,
+		opts:   o,
+	}
+}
+
+// index returns the index of the store holding the prefix.
+func (s *ShardedStore[T]) index(prf netip.Prefix) int {
+	if prf.Bits() < s.bits {
+		return 0
+	}
+
+	addr := prf.Addr()
+	if addr.Is4() {
+		a := addr.As4()
+		return 1 + int(uint16(a[0])<<8|uint16(a[1]))>>(16-s.bits)
+	}
+	a := addr.As16()
+
+	return 1 + 1<<s.bits + int(uint16(a[0])<<8|uint16(a[1]))>>(16-s.bits)
+}
+
+// shard returns the store holding the prefix.
+func (s *ShardedStore[T]) shard(prf netip.Prefix) *Store[T] {
+	return s.stores[s.index(prf)]
+}
+
+// rlock read-locks the store for prefixes shorter than the shard width
+// and the shard.
+func (s *ShardedStore[T]) rlock(shard *Store[T]) {
+	s.short.mu.RLock()
+	if shard != s.short {
+		shard.mu.RLock()
+	}
+}
+
+// runlock releases the locks taken by rlock.
+func (s *ShardedStore[T]) runlock(shard *Store[T]) {
+	if shard != s.short {
+		shard.mu.RUnlock()
+	}
+	s.short.mu.RUnlock()
+}
+
+// rlockAll read-locks all stores.
+func (s *ShardedStore[T]) rlockAll() {
+	for _, store := range s.stores {
+		store.mu.RLock()
+	}
+}
+
+// runlockAll releases the locks taken by rlockAll.
+func (s *ShardedStore[T]) runlockAll() {
+	for _, store := range s.stores {
+		store.mu.RUnlock()
+	}
+}
+
+// lockAll locks all stores.
+func (s *ShardedStore[T]) lockAll() {
+	for _, store := range s.stores {
+		store.mu.Lock()
+	}
+}
+
+// unlockAll releases the locks taken by lockAll.
+func (s *ShardedStore[T]) unlockAll() {
+	for _, store := range s.stores {
+		store.mu.Unlock()
+	}
+}
+
+// Add adds a new entry to the store mapped by [netip.Addr].
+func (s *ShardedStore[T]) Add(key netip.Addr, value T) error {
+	prf, err := s.opts.addrPrefix(key)
+	if err != nil {
+		return err
+	}
+
+	return s.AddCIDR(prf, value)
+}
+
+// AddCIDR adds a new entry to the store mapped by [netip.Prefix].
+func (s *ShardedStore[T]) AddCIDR(key netip.Prefix, value T) error {
+	key, _, err := s.opts.canonical(key)
+	if err != nil {
+		return err
+	}
+
+	return s.shard(key).AddCIDR(key, value)
+}
+
+// AddCIDRReport adds a new entry to the store mapped by [netip.Prefix],
+// like [ShardedStore.AddCIDR], and reports how it was stored.
+func (s *ShardedStore[T]) AddCIDRReport(key netip.Prefix, value T) (AddReport, error) {
+	prf, masked, err := s.opts.canonical(key)
+	if err != nil {
+		return AddReport{}, err
+	}
+
+	r, err := s.shard(prf).AddCIDRReport(prf, value)
+	r.Masked = masked
+
+	return r, err
+}
+
+// AddIPOrCIDR adds a new entry to the store mapped by an IP or CIDR.
+func (s *ShardedStore[T]) AddIPOrCIDR(ipOrCIDR string, value T) error {
+	prf, err := s.opts.parsePrefix(ipOrCIDR)
+	if err != nil {
+		return err
+	}
+
+	return s.AddCIDR(prf, value)
+}
+
+// AddMerge adds a new entry to the store mapped by [netip.Prefix], like
+// [Store.AddMerge].
+func (s *ShardedStore[T]) AddMerge(key netip.Prefix, value T, merge func(old, new T) T) error {
+	key, _, err := s.opts.canonical(key)
+	if err != nil {
+		return err
+	}
+
+	return s.shard(key).AddMerge(key, value, merge)
+}
+
+// Remove removes the entry associated with [netip.Addr] from the store.
+func (s *ShardedStore[T]) Remove(key netip.Addr) (T, error) {
+	prf, err := s.opts.addrPrefix(key)
+	if err != nil {
+		return zero[T](), err
+	}
+
+	return s.RemoveCIDR(prf)
+}
+
+// RemoveCIDR removes the entry associated with [netip.Prefix] from the
+// store.
+func (s *ShardedStore[T]) RemoveCIDR(key netip.Prefix) (T, error) {
+	key, _, err := s.opts.canonical(key)
+	if err != nil {
+		return zero[T](), err
+	}
+
+	return s.shard(key).RemoveCIDR(key)
+}
+
+// RemoveIPOrCIDR removes the entry associated with an IP or CIDR from the
+// store.
+func (s *ShardedStore[T]) RemoveIPOrCIDR(ipOrCIDR string) (T, error) {
+	prf, err := s.opts.parsePrefix(ipOrCIDR)
+	if err != nil {
+		return zero[T](), err
+	}
+
+	return s.RemoveCIDR(prf)
+}
+
+// Apply applies the mutations to the store in order, like [Store.Apply].
+// The shards the mutations apply to are locked together, so the mutations
+// are applied atomically.
+func (s *ShardedStore[T]) Apply(ms ...Mutation[T]) error {
+	prefixes := make([]netip.Prefix, len(ms))
+	indexes := make([]int, len(ms))
+	for i, m := range ms {
+		if err := m.Validate(); err != nil {
+			return err
+		}
+		prf, _, err := s.opts.canonical(m.Prefix)
+		if err != nil {
+			return err
+		}
+		prefixes[i], indexes[i] = prf, s.index(prf)
+	}
+
+	locked := slices.Compact(slices.Sorted(slices.Values(indexes)))
+	for _, i := range locked {
+		s.stores[i].mu.Lock()
+	}
+	defer func() {
+		for _, i := range locked {
+			s.stores[i].mu.Unlock()
+		}
+	}()
+
+	for i, m := range ms {
+		store := s.stores[indexes[i]]
+		if m.Op == OpAdd {
+			store.table.Insert(prefixes[i], m.Value)
+		} else {
+			store.table.Delete(prefixes[i])
+			store.forget(prefixes[i])
+		}
+	}
+
+	return nil
+}
+
+// Load adds all entries in the sequence to the store.
+func (s *ShardedStore[T]) Load(seq iter.Seq2[netip.Prefix, T]) error {
+	for prf, v := range seq {
+		if err := s.AddCIDR(prf, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Contains returns whether an entry is available for the [netip.Addr].
+func (s *ShardedStore[T]) Contains(ip netip.Addr) (bool, error) {
+	if _, err := s.opts.addr(ip); err != nil {
+		return false, err
+	}
+
+	_, ok := s.GetOne(ip)
+
+	return ok, nil
+}
+
+// Get returns entries from the store based on the [netip.Addr] key, most
+// specific first.
+func (s *ShardedStore[T]) Get(key netip.Addr) ([]T, error) {
+	prf, ok, err := s.opts.lookupPrefix(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var result = make([]T, 0, 5)
+	if !ok {
+		return result, nil
+	}
+	s.supernets(prf, true, func(_ netip.Prefix, v T) bool {
+		result = append(result, v)
+		return true
+	})
+
+	return result, nil
+}
+
+// GetInto returns entries from the store based on the [netip.Addr] key,
+// like [Store.GetInto].
+func (s *ShardedStore[T]) GetInto(key netip.Addr, dst []T) []T {
+	dst = dst[:0]
+	for _, v := range s.Matches(key) {
+		dst = append(dst, v)
+	}
+
+	return dst
+}
+
+// Matches returns an iterator over the entries in the store containing
+// the [netip.Addr] key, like [Store.Matches].
+func (s *ShardedStore[T]) Matches(key netip.Addr) iter.Seq2[netip.Prefix, T] {
+	return func(yield func(netip.Prefix, T) bool) {
+		prf, ok, _ := s.opts.lookupPrefix(key)
+		if !ok {
+			return
+		}
+
+		s.supernets(prf, true, yield)
+	}
+}
+
+// supernets yields the entries containing the prefix, most specific first,
+// from its shard and the store for prefixes shorter than the shard width.
+// When count is true, hits are counted when enabled.
+func (s *ShardedStore[T]) supernets(prf netip.Prefix, count bool, yield func(netip.Prefix, T) bool) {
+	shard := s.shard(prf)
+	s.rlock(shard)
+	defer s.runlock(shard)
+
+	shardHits, shortHits := shard.hits, s.short.hits
+	if !count {
+		shardHits, shortHits = nil, nil
+	}
+
+	if walkMatches(shard.table, prf, shardHits, yield) && shard != s.short {
+		walkMatches(s.short.table, prf, shortHits, yield)
+	}
+}
+
+// GetOne returns a single entry from the store based on the [netip.Addr]
+// key.
+func (s *ShardedStore[T]) GetOne(key netip.Addr) (T, bool) {
+	prf, ok, _ := s.opts.lookupPrefix(key)
+	if !ok {
+		return zero[T](), false
+	}
+
+	shard := s.shard(prf)
+	s.rlock(shard)
+	defer s.runlock(shard)
+
+	if v, ok := shard.lookupOne(prf.Addr()); ok {
+		return v, ok
+	}
+
+	return s.short.lookupOne(prf.Addr())
+}
+
+// GetCIDR returns entries from the store by [netip.Prefix], most specific
+// first.
+func (s *ShardedStore[T]) GetCIDR(key netip.Prefix) ([]T, error) {
+	var result = make([]T, 0, 5)
+	s.supernets(s.opts.prefix(key).Masked(), false, func(_ netip.Prefix, v T) bool {
+		result = append(result, v)
+		return true
+	})
+
+	return result, nil
+}
+
+// GetExactCIDR returns the entry stored by exactly the [netip.Prefix]
+// key, without falling back to entries containing it.
+func (s *ShardedStore[T]) GetExactCIDR(key netip.Prefix) (T, bool) {
+	key = s.opts.prefix(key).Masked()
+	shard := s.shard(key)
+	s.rlock(shard)
+	defer s.runlock(shard)
+
+	return shard.table.Get(key)
+}
+
+// GetOneCIDR returns a single entry from the store by [netip.Prefix].
+func (s *ShardedStore[T]) GetOneCIDR(key netip.Prefix) (T, bool) {
+	key = s.opts.prefix(key)
+	shard := s.shard(key.Masked())
+	s.rlock(shard)
+	defer s.runlock(shard)
+
+	if v, ok := shard.table.LookupPrefix(key); ok || shard == s.short {
+		return v, ok
+	}
+
+	return s.short.table.LookupPrefix(key)
+}
+
+// GetIPOrCIDR returns entries from the store by IP or CIDR.
+func (s *ShardedStore[T]) GetIPOrCIDR(ipOrCIDR string) ([]T, error) {
+	prf, ok, err := s.opts.parseLookup(ipOrCIDR)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return make([]T, 0), nil
+	}
+
+	return s.GetCIDR(prf)
+}
+
+// GetOneIPOrCIDR returns a single entry from the store by IP or CIDR.
+func (s *ShardedStore[T]) GetOneIPOrCIDR(ipOrCIDR string) (T, bool) {
+	prf, ok, _ := s.opts.parseLookup(ipOrCIDR)
+	if !ok {
+		return zero[T](), false
+	}
+
+	return s.GetOneCIDR(prf)
+}
+
+// Supernets returns an iterator over the entries in the store containing
+// the [netip.Prefix] key, together with the prefixes they're stored by.
+// Entries are returned most specific first. The shard of the key is
+// read-locked while iterating, so the store must not be modified in the
+// loop.
+func (s *ShardedStore[T]) Supernets(key netip.Prefix) iter.Seq2[netip.Prefix, T] {
+	key = s.opts.prefix(key).Masked()
+
+	return func(yield func(netip.Prefix, T) bool) {
+		s.supernets(key, false, yield)
+	}
+}
+
+// Subnets returns an iterator over the entries in the store contained in
+// the [netip.Prefix] key, including the entry for the key itself,
+// together with the prefixes they're stored by. Each shard is read-locked
+// while iterating over its entries, so the store must not be modified in
+// the loop.
+func (s *ShardedStore[T]) Subnets(key netip.Prefix) iter.Seq2[netip.Prefix, T] {
+	key = s.opts.prefix(key).Masked()
+
+	return func(yield func(netip.Prefix, T) bool) {
+		if !key.IsValid() {
+			return
+		}
+
+		stores := []*Store[T]{s.shard(key)}
+		if key.Bits() < s.bits {
+			// the key covers all shards starting with its leading bits.
+			lo := s.index(netip.PrefixFrom(key.Addr(), s.bits))
+			stores = append(stores, s.stores[lo:lo+1<<(s.bits-key.Bits())]...)
+		}
+
+		for _, store := range stores {
+			if !iterate(store, store.table.Subnets(key), yield) {
+				return
+			}
+		}
+	}
+}
+
+// All returns an iterator over all prefix–value pairs in the store. Each
+// shard is read-locked while iterating over its entries, so the store must
+// not be modified in the loop.
+func (s *ShardedStore[T]) All() iter.Seq2[netip.Prefix, T] {
+	return func(yield func(netip.Prefix, T) bool) {
+		for _, store := range s.stores {
+			if !iterate(store, store.table.All(), yield) {
+				return
+			}
+		}
+	}
+}
+
+// iterate yields the entries in the sequence while holding the read lock
+// of the store. It returns false when yield returned false.
+func iterate[T any](store *Store[T], seq iter.Seq2[netip.Prefix, T], yield func(netip.Prefix, T) bool) bool {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	for prf, v := range seq {
+		if !yield(prf, v) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Len returns the number of entries in the store.
+func (s *ShardedStore[T]) Len() int {
+	n := 0
+	for _, store := range s.stores {
+		n += store.Len()
+	}
+
+	return n
+}
+
+// Stats returns an iterator over the entries in the store together with
+// their hit statistics, like [Store.Stats]. Each shard is read-locked while
+// iterating over its entries, so the store must not be modified in the
+// loop.
+func (s *ShardedStore[T]) Stats() iter.Seq2[netip.Prefix, HitStats] {
+	return func(yield func(netip.Prefix, HitStats) bool) {
+		for _, store := range s.stores {
+			for prf, st := range store.Stats() {
+				if !yield(prf, st) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// ResetStats resets the hit statistics of all entries in the store.
+func (s *ShardedStore[T]) ResetStats() {
+	for _, store := range s.stores {
+		store.ResetStats()
+	}
+}
+
+// Clone returns a copy of the store. Values are copied shallowly; hit
+// statistics aren't copied. All shards are read-locked together, so the
+// copy is consistent.
+func (s *ShardedStore[T]) Clone() *ShardedStore[T] {
+	s.rlockAll()
+	defer s.runlockAll()
+
+	stores := make([]*Store[T], len(s.stores))
+	for i, store := range s.stores {
+		stores[i] = store.clone()
+	}
+
+	return &ShardedStore[T]{
+		stores: stores,
+		short:  stores[0],
+		bits:   s.bits,
+		opts:   s.opts,
+	}
+}
+
+// LoadContext adds all entries in the sequence to the store, like
+// [Store.LoadContext]. It returns the context's error when it's done
+// before all entries were read, in which case none of them are added.
+func (s *ShardedStore[T]) LoadContext(ctx context.Context, seq iter.Seq2[netip.Prefix, T], opts ...ContextOption) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// entries are staged in a separate table per shard, so that the
+	// shards don't have to be locked while reading them.
+	p := newProgress(ctx, opts)
+	staged := make([]Backend[T], len(s.stores))
+	for prf, v := range seq {
+		prf, _, err := s.opts.canonical(prf)
+		if err != nil {
+			return err
+		}
+		i := s.index(prf)
+		if staged[i] == nil {
+			staged[i] = s.stores[i].newBackend()
+		}
+		staged[i].Insert(prf, v)
+		if err := p.step(); err != nil {
+			return err
+		}
+	}
+
+	s.lockAll()
+	for i, table := range staged {
+		if table == nil {
+			continue
+		}
+		store := s.stores[i]
+		if store.table.Size() == 0 {
+			store.table = table
+			continue
+		}
+		for prf, v := range table.All() {
+			store.table.Insert(prf, v)
+		}
+	}
+	s.unlockAll()
+
+	p.done()
+
+	return nil
+}
+
+// AllContext returns an iterator over all entries in the store, like
+// [ShardedStore.All]. It stops when the context is done; check ctx.Err()
+// after the loop to find out whether all entries were returned.
+func (s *ShardedStore[T]) AllContext(ctx context.Context, opts ...ContextOption) iter.Seq2[netip.Prefix, T] {
+	return func(yield func(netip.Prefix, T) bool) {
+		if ctx.Err() != nil {
+			return
+		}
+
+		p := newProgress(ctx, opts)
+		for _, store := range s.stores {
+			if !iterate(store, store.table.All(), func(prf netip.Prefix, v T) bool {
+				return yield(prf, v) && p.step() == nil
+			}) {
+				return
+			}
+		}
+		p.done()
+	}
+}
+
+// LookupBatch looks up the most specific entry containing each of the
+// addresses, like [Store.LookupBatch]. All shards are read-locked once for
+// the whole batch.
+func (s *ShardedStore[T]) LookupBatch(addrs []netip.Addr, out []Result[T], opts ...BatchOption) {
+	s.LookupBatchParallel(addrs, out, 1, opts...)
+}
+
+// LookupBatchParallel looks up the addresses like
+// [ShardedStore.LookupBatch], splitting the batch across at most workers
+// goroutines, like [Store.LookupBatchParallel].
+func (s *ShardedStore[T]) LookupBatchParallel(addrs []netip.Addr, out []Result[T], workers int, opts ...BatchOption) {
+	b := newBatch(addrs, out, workers, opts)
+
+	s.rlockAll()
+	defer s.runlockAll()
+
+	b.run(s.lookup)
+}
+
+// lookup returns the most specific entry containing the address. All
+// stores must be read-locked.
+func (s *ShardedStore[T]) lookup(addr netip.Addr) Result[T] {
+	prf, ok, _ := s.opts.lookupPrefix(addr)
+	if !ok {
+		return Result[T]{}
+	}
+
+	shard := s.shard(prf)
+	v, ok := shard.lookupOne(prf.Addr())
+	if !ok && shard != s.short {
+		v, ok = s.short.lookupOne(prf.Addr())
+	}
+
+	return Result[T]{Value: v, Found: ok}
+}
+
+// table returns a copy of the entries in all shards in a single table. All
+// shards are read-locked together, so the copy is consistent.
+func (s *ShardedStore[T]) table() Backend[T] {
+	table := s.short.newBackend()
+
+	s.rlockAll()
+	defer s.runlockAll()
+
+	for _, store := range s.stores {
+		for prf, v := range store.table.All() {
+			table.Insert(prf, v)
+		}
+	}
+
+	return table
+}
+
+// WriteSnapshot writes the entries in the store to w, like
+// [Store.WriteSnapshot].
+func (s *ShardedStore[T]) WriteSnapshot(w io.Writer, c Codec[T]) error {
+	return writeSnapshot(w, c, s.table())
+}
+
+// ReadSnapshot replaces the entries in the store with the entries in the
+// snapshot read from r, like [Store.ReadSnapshot]. The store is only
+// modified when the snapshot was read successfully.
+func (s *ShardedStore[T]) ReadSnapshot(r io.Reader, c Codec[T]) error {
+	table, err := readSnapshot(r, c, s.short.newBackend())
+	if err != nil {
+		return err
+	}
+
+	tables := make([]Backend[T], len(s.stores))
+	for i, store := range s.stores {
+		tables[i] = store.newBackend()
+	}
+	for prf, v := range table.All() {
+		tables[s.index(prf)].Insert(prf, v)
+	}
+
+	s.lockAll()
+	for i, store := range s.stores {
+		store.table = tables[i]
+		store.ResetStats()
+	}
+	s.unlockAll()
+
+	return nil
+}
+
+// Compile writes the entries in the store to w in the read-only format
+// opened by [OpenCompiled], like [Store.Compile].
+func (s *ShardedStore[T]) Compile(w io.Writer, c Codec[T]) error {
+	return compile(w, c, s.table())
+}
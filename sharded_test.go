@@ -0,0 +1,452 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipstore_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/hslatman/ipstore"
+	"github.com/hslatman/ipstore/ipstoretest"
+)
+
+var shardBits = []int{1, 8, 16}
+
+func TestShardedStoreConformance(t *testing.T) {
+	for _, bits := range shardBits {
+		t.Run(fmt.Sprint(bits), func(t *testing.T) {
+			ipstoretest.RunReader(t, func(t *testing.T, entries []ipstoretest.Entry) ipstore.Reader[string] {
+				s := ipstore.NewShardedStore[string](ipstore.WithShardBits(bits))
+				for _, e := range entries {
+					if err := s.AddCIDR(e.Prefix, e.Value); err != nil {
+						t.Fatal(err)
+					}
+				}
+				return s
+			})
+			ipstoretest.RunWriter(t, func(t *testing.T) (ipstore.Writer[string], ipstore.Reader[string]) {
+				s := ipstore.NewShardedStore[string](ipstore.WithShardBits(bits))
+				return s, s
+			})
+		})
+	}
+}
+
+func TestShardedStoreMatchesStore(t *testing.T) {
+	for _, bits := range shardBits {
+		t.Run(fmt.Sprint(bits), func(t *testing.T) {
+			r := rand.New(rand.NewPCG(5, 6))
+			// prefixes shorter than the shard width are added as well, so
+			// that lookups have to combine them with the shards.
+			randomShardPrefix := func() netip.Prefix {
+				prf := randomPrefix(r)
+				if r.IntN(10) == 0 {
+					return netip.PrefixFrom(prf.Addr(), r.IntN(bits+1)).Masked()
+				}
+				return prf
+			}
+
+			ref := ipstore.New[string]()
+			s := ipstore.NewShardedStore[string](ipstore.WithShardBits(bits))
+			for range 3000 {
+				prf := randomShardPrefix()
+				if r.IntN(5) == 0 {
+					ev, _ := ref.RemoveCIDR(prf)
+					gv, _ := s.RemoveCIDR(prf)
+					if ev != gv {
+						t.Fatalf("RemoveCIDR(%s): expected %q; got %q", prf, ev, gv)
+					}
+					continue
+				}
+				if err := ref.AddCIDR(prf, prf.String()); err != nil {
+					t.Fatal(err)
+				}
+				if err := s.AddCIDR(prf, prf.String()); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if s.Len() != ref.Len() {
+				t.Fatalf("expected %d entries; got %d", ref.Len(), s.Len())
+			}
+			if !slices.Equal(collect(s.All()), collect(ref.All())) {
+				t.Errorf("expected All to return the same entries")
+			}
+
+			for range 1000 {
+				prf := randomShardPrefix()
+				addr := prf.Addr().Next()
+
+				ev, eok := ref.GetOne(addr)
+				gv, gok := s.GetOne(addr)
+				if ev != gv || eok != gok {
+					t.Errorf("GetOne(%s): expected %q, %t; got %q, %t", addr, ev, eok, gv, gok)
+				}
+				expected, _ := ref.Get(addr)
+				got, _ := s.Get(addr)
+				if !slices.Equal(got, expected) {
+					t.Errorf("Get(%s): expected %v; got %v", addr, expected, got)
+				}
+				if got := s.GetInto(addr, nil); !slices.Equal(got, expected) {
+					t.Errorf("GetInto(%s): expected %v; got %v", addr, expected, got)
+				}
+				ev, eok = ref.GetOneCIDR(prf)
+				gv, gok = s.GetOneCIDR(prf)
+				if ev != gv || eok != gok {
+					t.Errorf("GetOneCIDR(%s): expected %q, %t; got %q, %t", prf, ev, eok, gv, gok)
+				}
+				expected, _ = ref.GetCIDR(prf)
+				got, _ = s.GetCIDR(prf)
+				if !slices.Equal(got, expected) {
+					t.Errorf("GetCIDR(%s): expected %v; got %v", prf, expected, got)
+				}
+				if !slices.Equal(collect(s.Subnets(prf)), collect(ref.Subnets(prf))) {
+					t.Errorf("Subnets(%s): expected the same entries", prf)
+				}
+			}
+		})
+	}
+}
+
+func TestShardedStoreShortPrefixes(t *testing.T) {
+	s := ipstore.NewShardedStore[string](ipstore.WithShardBits(16))
+	for _, cidr := range []string{"0.0.0.0/0", "10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "::/0"} {
+		if err := s.AddIPOrCIDR(cidr, cidr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		ip       string
+		expected []string
+	}{
+		{"10.1.2.3", []string{"10.1.2.0/24", "10.1.0.0/16", "10.0.0.0/8", "0.0.0.0/0"}},
+		{"10.2.0.1", []string{"10.0.0.0/8", "0.0.0.0/0"}},
+		{"192.0.2.1", []string{"0.0.0.0/0"}},
+		{"2001:db8::1", []string{"::/0"}},
+	}
+	for _, tc := range tests {
+		got, err := s.Get(netip.MustParseAddr(tc.ip))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got, tc.expected) {
+			t.Errorf("Get(%s): expected %v; got %v", tc.ip, tc.expected, got)
+		}
+		if v, _ := s.GetOne(netip.MustParseAddr(tc.ip)); v != tc.expected[0] {
+			t.Errorf("GetOne(%s): expected %s; got %s", tc.ip, tc.expected[0], v)
+		}
+	}
+
+	n := 0
+	for range s.Subnets(netip.MustParsePrefix("10.0.0.0/8")) {
+		n++
+	}
+	if n != 3 {
+		t.Errorf("expected 3 subnets of 10.0.0.0/8; got %d", n)
+	}
+}
+
+func TestShardedStoreApply(t *testing.T) {
+	s := ipstore.NewShardedStore[string]()
+	if err := s.AddIPOrCIDR("192.0.2.0/24", "doc"); err != nil {
+		t.Fatal(err)
+	}
+
+	err := s.Apply(
+		ipstore.Mutation[string]{Op: ipstore.OpAdd, Prefix: netip.MustParsePrefix("10.0.0.0/8"), Value: "private"},
+		ipstore.Mutation[string]{Op: ipstore.OpRemove, Prefix: netip.MustParsePrefix("192.0.2.0/24")},
+		ipstore.Mutation[string]{Op: ipstore.OpAdd, Prefix: netip.MustParsePrefix("0.0.0.0/0"), Value: "default"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := s.GetOne(netip.MustParseAddr("192.0.2.1")); v != "default" {
+		t.Errorf("expected default; got %q", v)
+	}
+	if s.Len() != 2 {
+		t.Errorf("expected 2 entries; got %d", s.Len())
+	}
+
+	err = s.Apply(
+		ipstore.Mutation[string]{Op: ipstore.OpAdd, Prefix: netip.MustParsePrefix("172.16.0.0/12"), Value: "private"},
+		ipstore.Mutation[string]{Op: ipstore.OpAdd},
+	)
+	if !errors.Is(err, ipstore.ErrInvalidMutation) {
+		t.Errorf("expected ErrInvalidMutation; got %v", err)
+	}
+	if s.Len() != 2 {
+		t.Errorf("expected the store to be unchanged; got %d entries", s.Len())
+	}
+}
+
+func TestShardedStoreOptions(t *testing.T) {
+	s := ipstore.NewShardedStore[string](ipstore.WithUnmap(), ipstore.WithPrefixPolicy(ipstore.PrefixStrict))
+	if err := s.AddIPOrCIDR("::ffff:10.0.0.0/104", "private"); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := s.GetOne(netip.MustParseAddr("10.1.2.3")); v != "private" {
+		t.Errorf("expected private; got %q", v)
+	}
+
+	var nce *ipstore.NonCanonicalError
+	if err := s.AddIPOrCIDR("10.1.2.3/16", "x"); !errors.As(err, &nce) {
+		t.Errorf("expected NonCanonicalError; got %v", err)
+	}
+
+	k := ipstore.NewShardedStore[string](ipstore.WithZonePolicy(ipstore.ZoneKeep))
+	if err := k.AddIPOrCIDR("fe80::/64", "link-local"); err != nil {
+		t.Fatal(err)
+	}
+	zoned := netip.MustParseAddr("fe80::1%eth0")
+	if _, ok := k.GetOne(zoned); ok {
+		t.Errorf("expected no match for %s", zoned)
+	}
+	if vs, err := k.Get(zoned); len(vs) != 0 || err != nil {
+		t.Errorf("expected no match for %s; got %v, %v", zoned, vs, err)
+	}
+	if vs := k.GetInto(zoned, nil); len(vs) != 0 {
+		t.Errorf("expected no match for %s; got %v", zoned, vs)
+	}
+
+	r, err := ipstore.NewShardedStore[string]().AddCIDRReport(netip.MustParsePrefix("10.1.2.3/16"), "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Masked || r.Replaced || r.Prefix != netip.MustParsePrefix("10.1.0.0/16") {
+		t.Errorf("expected a masked 10.1.0.0/16; got %+v", r)
+	}
+}
+
+func TestShardedStoreClone(t *testing.T) {
+	s := ipstore.NewShardedStore[string]()
+	if err := s.AddIPOrCIDR("10.0.0.0/8", "private"); err != nil {
+		t.Fatal(err)
+	}
+
+	c := s.Clone()
+	if _, err := s.RemoveIPOrCIDR("10.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := c.GetOneIPOrCIDR("10.1.2.3"); v != "private" {
+		t.Errorf("expected the clone to be unchanged; got %q", v)
+	}
+	if s.Len() != 0 || c.Len() != 1 {
+		t.Errorf("expected 0 and 1 entries; got %d and %d", s.Len(), c.Len())
+	}
+}
+
+func TestShardedStoreConcurrent(t *testing.T) {
+	s := ipstore.NewShardedStore[int]()
+	if err := s.AddIPOrCIDR("0.0.0.0/0", -1); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for w := range 8 {
+		wg.Go(func() {
+			for i := range 1000 {
+				addr := netip.AddrFrom4([4]byte{byte(w), byte(i >> 8), byte(i), 1})
+				merge := func(old, new int) int { return old + new }
+				if err := s.AddMerge(netip.PrefixFrom(addr, 32), 1, merge); err != nil {
+					t.Error(err)
+				}
+				if v, ok := s.GetOne(addr); !ok || v < 1 {
+					t.Errorf("expected a counter for %s; got %d", addr, v)
+				}
+				for range s.Subnets(netip.MustParsePrefix("0.0.0.0/4")) {
+				}
+			}
+		})
+	}
+	wg.Wait()
+
+	if s.Len() != 8001 {
+		t.Errorf("expected 8001 entries; got %d", s.Len())
+	}
+}
+
+func BenchmarkShardedStoreWrites(b *testing.B) {
+	counters := map[string]interface {
+		AddMerge(netip.Prefix, int, func(int, int) int) error
+	}{
+		"Store":        ipstore.New[int](),
+		"ShardedStore": ipstore.NewShardedStore[int](),
+	}
+	for name, s := range counters {
+		b.Run(name, func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewPCG(rand.Uint64(), 0))
+				for pb.Next() {
+					addr := netip.AddrFrom4([4]byte{byte(r.IntN(256)), byte(r.IntN(256)), byte(r.IntN(16)), 1})
+					s.AddMerge(netip.PrefixFrom(addr, 32), 1, func(old, new int) int { return old + new })
+				}
+			})
+		})
+	}
+}
+
+func TestShardedStoreSnapshot(t *testing.T) {
+	s := ipstore.NewShardedStore[string](ipstore.WithShardBits(16))
+	for _, cidr := range []string{"0.0.0.0/0", "10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "2001:db8::/32"} {
+		if err := s.AddIPOrCIDR(cidr, cidr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := s.WriteSnapshot(&buf, ipstore.StringCodec{}); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := buf.Bytes()
+
+	ref := ipstore.New[string]()
+	if err := ref.ReadSnapshot(bytes.NewReader(snapshot), ipstore.StringCodec{}); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(collect(ref.All()), collect(s.All())) {
+		t.Errorf("expected the Store to hold the same entries")
+	}
+
+	r := ipstore.NewShardedStore[string](ipstore.WithShardBits(8))
+	if err := r.AddIPOrCIDR("192.0.2.0/24", "replaced"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.ReadSnapshot(bytes.NewReader(snapshot), ipstore.StringCodec{}); err != nil {
+		t.Fatal(err)
+	}
+	if r.Len() != 5 {
+		t.Errorf("expected 5 entries; got %d", r.Len())
+	}
+	if v, _ := r.GetOne(netip.MustParseAddr("10.1.2.3")); v != "10.1.2.0/24" {
+		t.Errorf("expected 10.1.2.0/24; got %q", v)
+	}
+	if v, _ := r.GetOne(netip.MustParseAddr("192.0.2.1")); v != "0.0.0.0/0" {
+		t.Errorf("expected 0.0.0.0/0; got %q", v)
+	}
+
+	if err := r.ReadSnapshot(bytes.NewReader(snapshot[:len(snapshot)-1]), ipstore.StringCodec{}); !errors.Is(err, ipstore.ErrInvalidSnapshot) {
+		t.Errorf("expected ErrInvalidSnapshot; got %v", err)
+	}
+	if r.Len() != 5 {
+		t.Errorf("expected the store to be unchanged; got %d entries", r.Len())
+	}
+
+	buf.Reset()
+	if err := s.Compile(&buf, ipstore.StringCodec{}); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "store.ipsm")
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := ipstore.OpenCompiled(path, ipstore.StringCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if v, _ := c.GetOneIPOrCIDR("10.1.2.3"); v != "10.1.2.0/24" {
+		t.Errorf("expected 10.1.2.0/24; got %q", v)
+	}
+}
+
+func TestShardedStoreLoadContext(t *testing.T) {
+	s := ipstore.NewShardedStore[int]()
+	if err := s.AddIPOrCIDR("192.0.2.0/24", -1); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err := s.LoadContext(ctx, entries(10000), ipstore.WithProgress(func(n int) {
+		cancel()
+	}))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled; got %v", err)
+	}
+	if s.Len() != 1 {
+		t.Errorf("expected the store to be unchanged; got %d entries", s.Len())
+	}
+
+	var reports []int
+	if err := s.LoadContext(context.Background(), entries(5000), ipstore.WithProgress(func(n int) {
+		reports = append(reports, n)
+	})); err != nil {
+		t.Fatal(err)
+	}
+	if s.Len() != 5001 {
+		t.Errorf("expected 5001 entries; got %d", s.Len())
+	}
+	if len(reports) == 0 || reports[len(reports)-1] != 5000 {
+		t.Errorf("expected final progress of 5000; got %v", reports)
+	}
+	if v, _ := s.GetOne(netip.MustParseAddr("10.0.1.2")); v != 258 {
+		t.Errorf("expected 258; got %d", v)
+	}
+
+	n := 0
+	for range s.AllContext(context.Background()) {
+		n++
+	}
+	if n != 5001 {
+		t.Errorf("expected 5001 entries; got %d", n)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	n = 0
+	for range s.AllContext(ctx, ipstore.WithProgress(func(int) { cancel() })) {
+		n++
+	}
+	if ctx.Err() == nil || n >= 5001 {
+		t.Errorf("expected iteration to stop early; got %d entries", n)
+	}
+}
+
+func TestShardedStoreLookupBatch(t *testing.T) {
+	r := rand.New(rand.NewPCG(7, 8))
+	s := ipstore.NewShardedStore[string](ipstore.WithShardBits(8))
+	for range 2000 {
+		prf := randomPrefix(r)
+		if r.IntN(10) == 0 {
+			prf = netip.PrefixFrom(prf.Addr(), r.IntN(9)).Masked()
+		}
+		if err := s.AddCIDR(prf, prf.String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	addrs := make([]netip.Addr, 10000)
+	for i := range addrs {
+		addrs[i] = randomPrefix(r).Addr().Next()
+	}
+	for _, opts := range [][]ipstore.BatchOption{nil, {ipstore.WithSort()}} {
+		out := make([]ipstore.Result[string], len(addrs))
+		s.LookupBatchParallel(addrs, out, 4, opts...)
+		for i, addr := range addrs {
+			v, ok := s.GetOne(addr)
+			if out[i] != (ipstore.Result[string]{Value: v, Found: ok}) {
+				t.Errorf("%s: expected %q, %t; got %+v", addr, v, ok, out[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,272 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/netip"
+)
+
+// Codec converts values stored in a [Store] to and from bytes.
+type Codec[T any] interface {
+	Marshal(v T) ([]byte, error)
+	Unmarshal(b []byte) (T, error)
+}
+
+// JSONCodec is a [Codec] encoding values as JSON.
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) Marshal(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec[T]) Unmarshal(b []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(b, &v)
+	return v, err
+}
+
+// StringCodec is a [Codec] for string values.
+type StringCodec struct{}
+
+func (StringCodec) Marshal(v string) ([]byte, error) {
+	return []byte(v), nil
+}
+
+func (StringCodec) Unmarshal(b []byte) (string, error) {
+	return string(b), nil
+}
+
+// BytesCodec is a [Codec] for byte slice values.
+type BytesCodec struct{}
+
+func (BytesCodec) Marshal(v []byte) ([]byte, error) {
+	return v, nil
+}
+
+func (BytesCodec) Unmarshal(b []byte) ([]byte, error) {
+	return append([]byte(nil), b...), nil
+}
+
+var snapshotMagic = [5]byte{'I', 'P', 'S', 'T', 1}
+
+// maxSnapshotValue limits the size of a single encoded value, so that a
+// corrupt length doesn't allocate arbitrary amounts of memory.
+const maxSnapshotValue = 16 << 20
+
+// ErrInvalidSnapshot is returned when reading a snapshot that is
+// malformed or corrupted.
+var ErrInvalidSnapshot = errors.New("invalid snapshot")
+
+// WriteSnapshot writes the entries in the [Store] to w in a compact binary
+// format, encoding values using the [Codec] provided. Entries are written
+// in sorted order from a copy of the [Store] taken when the snapshot
+// starts, so that writes to the [Store] aren't blocked while writing.
+// Encoded values are limited to 16 MiB.
+func (s *Store[T]) WriteSnapshot(w io.Writer, c Codec[T]) error {
+	s.mu.RLock()
+	table := s.table.Clone()
+	s.mu.RUnlock()
+
+	return writeSnapshot(w, c, table)
+}
+
+// writeSnapshot writes the entries in the table in the snapshot format.
+func writeSnapshot[T any](w io.Writer, c Codec[T], table Backend[T]) error {
+	h := crc32.NewIEEE()
+	bw := bufio.NewWriter(io.MultiWriter(w, h))
+	if _, err := bw.Write(snapshotMagic[:]); err != nil {
+		return err
+	}
+
+	var buf []byte
+	for prf, v := range table.AllSorted() {
+		b, err := c.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("failed encoding value for %s: %w", prf, err)
+		}
+		if len(b) > maxSnapshotValue {
+			return fmt.Errorf("value for %s of %d bytes exceeds the maximum of %d", prf, len(b), maxSnapshotValue)
+		}
+		buf = appendPrefix(buf[:0], prf)
+		buf = binary.AppendUvarint(buf, uint64(len(b)))
+		buf = append(buf, b...)
+		if _, err := bw.Write(buf); err != nil {
+			return err
+		}
+	}
+
+	// the end of the entries is marked by a zero family, followed by the
+	// checksum of everything written before it.
+	if err := bw.WriteByte(0); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	_, err := w.Write(binary.BigEndian.AppendUint32(nil, h.Sum32()))
+	return err
+}
+
+// ReadSnapshot replaces the entries in the [Store] with the entries in the
+// snapshot read from r, decoding values using the [Codec] provided. The
+// [Store] is only modified when the snapshot was read successfully. When r
+// implements [io.ByteReader], no bytes beyond the end of the snapshot are
+// read from it.
+func (s *Store[T]) ReadSnapshot(r io.Reader, c Codec[T]) error {
+	table, err := readSnapshot(r, c, s.newBackend())
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.table = table
+	s.ResetStats()
+	s.mu.Unlock()
+
+	return nil
+}
+
+func readSnapshot[T any](r io.Reader, c Codec[T], table Backend[T]) (Backend[T], error) {
+	br, ok := r.(byteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	cr := &checksumReader{r: br, h: crc32.NewIEEE()}
+
+	var magic [5]byte
+	if _, err := io.ReadFull(cr, magic[:]); err != nil || magic != snapshotMagic {
+		return nil, fmt.Errorf("%w: unknown format", ErrInvalidSnapshot)
+	}
+
+	for {
+		prf, ok, err := readPrefix(cr)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidSnapshot, err)
+		}
+		if !ok {
+			break
+		}
+
+		n, err := binary.ReadUvarint(cr)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidSnapshot, err)
+		}
+		if n > maxSnapshotValue {
+			return nil, fmt.Errorf("%w: value for %s too large", ErrInvalidSnapshot, prf)
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(cr, b); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidSnapshot, err)
+		}
+		v, err := c.Unmarshal(b)
+		if err != nil {
+			return nil, fmt.Errorf("failed decoding value for %s: %w", prf, err)
+		}
+		table.Insert(prf, v)
+	}
+
+	var sum [4]byte
+	if _, err := io.ReadFull(br, sum[:]); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidSnapshot, err)
+	}
+	if binary.BigEndian.Uint32(sum[:]) != cr.h.Sum32() {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrInvalidSnapshot)
+	}
+
+	return table, nil
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// checksumReader updates the checksum with every byte read.
+type checksumReader struct {
+	r byteReader
+	h hash.Hash32
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.h.Write(p[:n])
+	return n, err
+}
+
+func (c *checksumReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.h.Write([]byte{b})
+	}
+	return b, err
+}
+
+// appendPrefix appends the binary encoding of the prefix to b: its
+// family (4 or 6), address and number of bits.
+func appendPrefix(b []byte, prf netip.Prefix) []byte {
+	if prf.Addr().Is4() {
+		b = append(b, 4)
+	} else {
+		b = append(b, 6)
+	}
+	b = append(b, prf.Addr().AsSlice()...)
+
+	return append(b, byte(prf.Bits()))
+}
+
+// readPrefix reads a prefix encoded by appendPrefix. It returns false
+// when it reads the end marker instead.
+func readPrefix(r io.ByteReader) (netip.Prefix, bool, error) {
+	family, err := r.ReadByte()
+	if err != nil {
+		return netip.Prefix{}, false, err
+	}
+
+	var n int
+	switch family {
+	case 0:
+		return netip.Prefix{}, false, nil
+	case 4:
+		n = 4
+	case 6:
+		n = 16
+	default:
+		return netip.Prefix{}, false, fmt.Errorf("unknown address family %d", family)
+	}
+
+	b := make([]byte, n+1)
+	for i := range b {
+		if b[i], err = r.ReadByte(); err != nil {
+			return netip.Prefix{}, false, err
+		}
+	}
+
+	addr, _ := netip.AddrFromSlice(b[:n])
+	prf := netip.PrefixFrom(addr, int(b[n]))
+	if !prf.IsValid() {
+		return netip.Prefix{}, false, fmt.Errorf("invalid prefix length %d", b[n])
+	}
+
+	return prf, true, nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipstore_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"maps"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/hslatman/ipstore"
+)
+
+func TestSnapshot(t *testing.T) {
+	s := ipstore.New[string]()
+	for _, ipOrCIDR := range []string{"127.0.0.1", "10.0.0.0/8", "2001:db8::/32", "::1"} {
+		if err := s.AddIPOrCIDR(ipOrCIDR, ipOrCIDR); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := s.WriteSnapshot(&buf, ipstore.StringCodec{}); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+
+	r := ipstore.New[string]()
+	if err := r.AddIPOrCIDR("192.168.0.0/16", "replaced"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.ReadSnapshot(bytes.NewReader(b), ipstore.StringCodec{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Len() != 4 {
+		t.Errorf("expected 4 entries; got %d", r.Len())
+	}
+	if !maps.Equal(maps.Collect(s.All()), maps.Collect(r.All())) {
+		t.Errorf("expected %v; got %v", maps.Collect(s.All()), maps.Collect(r.All()))
+	}
+	if ok, _ := r.Contains(netip.MustParseAddr("192.168.0.1")); ok {
+		t.Error("expected existing entries to be replaced")
+	}
+
+	// a snapshot followed by other data is read up to its end
+	rd := bytes.NewReader(append(b, "trailer"...))
+	if err := r.ReadSnapshot(rd, ipstore.StringCodec{}); err != nil {
+		t.Fatal(err)
+	}
+	if rd.Len() != len("trailer") {
+		t.Errorf("expected %d bytes to remain; got %d", len("trailer"), rd.Len())
+	}
+}
+
+func TestSnapshotJSONCodec(t *testing.T) {
+	s := ipstore.New[ipstore.CloudRange]()
+	v := ipstore.CloudRange{Provider: ipstore.AWS, Region: "eu-west-1", Service: "EC2"}
+	if err := s.AddCIDR(netip.MustParsePrefix("3.248.0.0/13"), v); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := s.WriteSnapshot(&buf, ipstore.JSONCodec[ipstore.CloudRange]{}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := ipstore.New[ipstore.CloudRange]()
+	if err := r.ReadSnapshot(&buf, ipstore.JSONCodec[ipstore.CloudRange]{}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := r.GetOne(netip.MustParseAddr("3.248.0.1")); got != v {
+		t.Errorf("expected %#+v; got %#+v", v, got)
+	}
+}
+
+func TestSnapshotCorrupted(t *testing.T) {
+	s := ipstore.New[string]()
+	if err := s.AddIPOrCIDR("10.0.0.0/8", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := s.WriteSnapshot(&buf, ipstore.StringCodec{}); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+
+	for name, corrupt := range map[string][]byte{
+		"empty":     nil,
+		"magic":     append([]byte("XXXXX"), b[5:]...),
+		"truncated": b[:len(b)-3],
+		"value":     bytes.Replace(b, []byte("value"), []byte("vaLue"), 1),
+		// the length of the value, following the magic and the prefix.
+		"length": append(binary.AppendUvarint(slices.Clone(b[:11]), 1<<30), b[12:]...),
+	} {
+		r := ipstore.New[string]()
+		err := r.ReadSnapshot(bytes.NewReader(corrupt), ipstore.StringCodec{})
+		if !errors.Is(err, ipstore.ErrInvalidSnapshot) {
+			t.Errorf("%s: expected ErrInvalidSnapshot; got %v", name, err)
+		}
+		if r.Len() != 0 {
+			t.Errorf("%s: expected store not to be modified", name)
+		}
+	}
+
+	if err := s.AddIPOrCIDR("10.0.0.0/8", strings.Repeat("x", 16<<20+1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteSnapshot(io.Discard, ipstore.StringCodec{}); err == nil {
+		t.Error("expected error for oversized value")
+	}
+}
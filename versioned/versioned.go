@@ -0,0 +1,278 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package versioned records the history of an [ipstore.Store], so that
+// it can be queried as it was at any point in time.
+//
+// Every entry added to the store starts a [Version] of its prefix, which
+// ends when the entry is replaced or removed. Versions that ended longer
+// ago than the retention period are removed by [Store.Compact].
+package versioned
+
+import (
+	"iter"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/hslatman/ipstore"
+)
+
+var _ ipstore.Writer[any] = (*Store[any])(nil)
+
+// Version is the value of an entry during the interval from From up to,
+// but not including, To. To is zero while the version is current.
+type Version[T any] struct {
+	Value T
+	From  time.Time
+	To    time.Time
+}
+
+// ValidAt returns whether the [Version] was the value of its entry at t.
+func (v Version[T]) ValidAt(t time.Time) bool {
+	return !t.Before(v.From) && (v.To.IsZero() || t.Before(v.To))
+}
+
+// Option configures a [Store].
+type Option func(*options)
+
+type options struct {
+	retention time.Duration
+	now       func() time.Time
+}
+
+// WithRetention keeps versions for d after they ended. It defaults to
+// zero, which keeps versions forever.
+func WithRetention(d time.Duration) Option {
+	return func(o *options) {
+		o.retention = d
+	}
+}
+
+// WithClock sets the function returning the time mutations are recorded
+// at. It defaults to [time.Now].
+func WithClock(now func() time.Time) Option {
+	return func(o *options) {
+		o.now = now
+	}
+}
+
+// Store is an [ipstore.Store] recording the history of its entries. All
+// changes to the store must be made through the [Store].
+type Store[T any] struct {
+	opts    options
+	current *ipstore.Store[T]
+
+	mu      sync.RWMutex
+	history *ipstore.Store[[]Version[T]]
+}
+
+// New returns a new, empty [Store].
+func New[T any](opts ...Option) *Store[T] {
+	o := options{now: time.Now}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return &Store[T]{
+		opts:    o,
+		current: ipstore.New[T](),
+		history: ipstore.New[[]Version[T]](),
+	}
+}
+
+// Store returns the store holding the current entries. It must only be
+// read from.
+func (s *Store[T]) Store() *ipstore.Store[T] {
+	return s.current
+}
+
+// AddCIDR adds an entry to the store, ending the current version of the
+// prefix.
+func (s *Store[T]) AddCIDR(key netip.Prefix, value T) error {
+	return s.Apply(ipstore.Mutation[T]{Op: ipstore.OpAdd, Prefix: key, Value: value})
+}
+
+// RemoveCIDR removes an entry from the store, ending the current version
+// of the prefix. It returns the value of the entry removed.
+func (s *Store[T]) RemoveCIDR(key netip.Prefix) (T, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var old T
+	if vs, _ := s.history.GetExactCIDR(key); len(vs) > 0 && vs[len(vs)-1].To.IsZero() {
+		old = vs[len(vs)-1].Value
+	}
+	if err := s.apply([]ipstore.Mutation[T]{{Op: ipstore.OpRemove, Prefix: key}}); err != nil {
+		var zero T
+		return zero, err
+	}
+
+	return old, nil
+}
+
+// Apply applies the mutations atomically, recording them all at the same
+// time.
+func (s *Store[T]) Apply(ms ...ipstore.Mutation[T]) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.apply(ms)
+}
+
+func (s *Store[T]) apply(ms []ipstore.Mutation[T]) error {
+	for _, m := range ms {
+		if err := m.Validate(); err != nil {
+			return err
+		}
+	}
+
+	now := s.opts.now()
+	for _, m := range ms {
+		key := m.Prefix.Masked()
+		vs, _ := s.history.GetExactCIDR(key)
+		vs = s.expire(slices.Clone(vs), now)
+		if n := len(vs); n > 0 && vs[n-1].To.IsZero() {
+			vs[n-1].To = now
+			// a version replaced at the time it started never was
+			// the value of the entry.
+			if !vs[n-1].From.Before(now) {
+				vs = vs[:n-1]
+			}
+		}
+		if m.Op == ipstore.OpAdd {
+			vs = append(vs, Version[T]{Value: m.Value, From: now})
+		}
+
+		if len(vs) == 0 {
+			s.history.RemoveCIDR(key)
+		} else if err := s.history.AddCIDR(key, vs); err != nil {
+			return err
+		}
+	}
+
+	return s.current.Apply(ms...)
+}
+
+// GetAt returns the value of the most specific entry containing the
+// [netip.Addr] key at t.
+func (s *Store[T]) GetAt(key netip.Addr, t time.Time) (T, bool) {
+	prf, err := key.Prefix(key.BitLen())
+	if err != nil {
+		var zero T
+		return zero, false
+	}
+
+	return s.GetCIDRAt(prf, t)
+}
+
+// GetCIDRAt returns the value of the most specific entry containing the
+// [netip.Prefix] key at t.
+func (s *Store[T]) GetCIDRAt(key netip.Prefix, t time.Time) (T, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, vs := range s.history.Supernets(key) {
+		if v, ok := versionAt(vs, t); ok {
+			return v.Value, true
+		}
+	}
+
+	var zero T
+	return zero, false
+}
+
+// AllAt returns an iterator over all entries in the store at t. The
+// [Store] is read-locked while iterating, so it must not be modified in
+// the loop.
+func (s *Store[T]) AllAt(t time.Time) iter.Seq2[netip.Prefix, T] {
+	return func(yield func(netip.Prefix, T) bool) {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+
+		for prf, vs := range s.history.All() {
+			if v, ok := versionAt(vs, t); ok && !yield(prf, v.Value) {
+				return
+			}
+		}
+	}
+}
+
+// History returns the versions of the entry stored by exactly the
+// [netip.Prefix] key, oldest first.
+func (s *Store[T]) History(key netip.Prefix) []Version[T] {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	vs, _ := s.history.GetExactCIDR(key)
+
+	return slices.Clone(vs)
+}
+
+// Compact removes the versions that ended longer ago than the retention
+// period. It returns the number of versions removed.
+func (s *Store[T]) Compact() (int, error) {
+	if s.opts.retention <= 0 {
+		return 0, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.opts.now()
+	var expired []ipstore.Mutation[[]Version[T]]
+	n := 0
+	for prf, vs := range s.history.All() {
+		kept := s.expire(slices.Clone(vs), now)
+		if len(kept) == len(vs) {
+			continue
+		}
+		n += len(vs) - len(kept)
+		if len(kept) == 0 {
+			expired = append(expired, ipstore.Mutation[[]Version[T]]{Op: ipstore.OpRemove, Prefix: prf})
+		} else {
+			expired = append(expired, ipstore.Mutation[[]Version[T]]{Op: ipstore.OpAdd, Prefix: prf, Value: kept})
+		}
+	}
+	if err := s.history.Apply(expired...); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// expire removes the versions that ended longer ago than the retention
+// period from vs.
+func (s *Store[T]) expire(vs []Version[T], now time.Time) []Version[T] {
+	if s.opts.retention <= 0 {
+		return vs
+	}
+
+	cutoff := now.Add(-s.opts.retention)
+	return slices.DeleteFunc(vs, func(v Version[T]) bool {
+		return !v.To.IsZero() && !v.To.After(cutoff)
+	})
+}
+
+// versionAt returns the version valid at t.
+func versionAt[T any](vs []Version[T], t time.Time) (Version[T], bool) {
+	for i := len(vs) - 1; i >= 0; i-- {
+		if vs[i].ValidAt(t) {
+			return vs[i], true
+		}
+	}
+
+	return Version[T]{}, false
+}
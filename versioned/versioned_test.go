@@ -0,0 +1,174 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package versioned_test
+
+import (
+	"maps"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/hslatman/ipstore"
+	"github.com/hslatman/ipstore/ipstoretest"
+	"github.com/hslatman/ipstore/versioned"
+)
+
+var epoch = time.Date(2024, 3, 5, 14, 0, 0, 0, time.UTC)
+
+// clock returns a clock starting at epoch, and a function advancing it
+// by an hour.
+func clock() (func() time.Time, func()) {
+	now := epoch
+	return func() time.Time { return now }, func() { now = now.Add(time.Hour) }
+}
+
+func at(hours int) time.Time {
+	return epoch.Add(time.Duration(hours) * time.Hour)
+}
+
+func TestGetAt(t *testing.T) {
+	now, tick := clock()
+	s := versioned.New[string](versioned.WithClock(now))
+	prf := netip.MustParsePrefix("203.0.113.0/24")
+	ip := netip.MustParseAddr("203.0.113.7")
+
+	if err := s.AddCIDR(netip.MustParsePrefix("203.0.0.0/16"), "wide"); err != nil {
+		t.Fatal(err)
+	}
+	tick()
+	if err := s.AddCIDR(prf, "spam"); err != nil {
+		t.Fatal(err)
+	}
+	tick()
+	if err := s.AddCIDR(prf, "botnet"); err != nil {
+		t.Fatal(err)
+	}
+	tick()
+	if _, err := s.RemoveCIDR(prf); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		t        time.Time
+		expected string
+		ok       bool
+	}{
+		{at(-1), "", false},
+		{at(0), "wide", true},
+		{at(1), "spam", true},
+		{at(1).Add(30 * time.Minute), "spam", true},
+		{at(2), "botnet", true},
+		{at(3), "wide", true},
+	} {
+		v, ok := s.GetAt(ip, tc.t)
+		if v != tc.expected || ok != tc.ok {
+			t.Errorf("GetAt(%s): expected %q, %t; got %q, %t", tc.t, tc.expected, tc.ok, v, ok)
+		}
+	}
+
+	if v, _ := s.Store().GetOne(ip); v != "wide" {
+		t.Errorf("expected current value %q; got %q", "wide", v)
+	}
+
+	history := s.History(prf)
+	if len(history) != 2 {
+		t.Fatalf("expected 2 versions; got %d", len(history))
+	}
+	if v := history[0]; v.Value != "spam" || !v.From.Equal(at(1)) || !v.To.Equal(at(2)) {
+		t.Errorf("unexpected version %+v", v)
+	}
+	if v := history[1]; v.Value != "botnet" || !v.From.Equal(at(2)) || !v.To.Equal(at(3)) {
+		t.Errorf("unexpected version %+v", v)
+	}
+}
+
+func TestAllAt(t *testing.T) {
+	now, tick := clock()
+	s := versioned.New[string](versioned.WithClock(now))
+	a, b := netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("192.0.2.0/24")
+
+	if err := s.Apply(
+		ipstore.Mutation[string]{Op: ipstore.OpAdd, Prefix: a, Value: "a"},
+		ipstore.Mutation[string]{Op: ipstore.OpAdd, Prefix: b, Value: "b"},
+		// replacing an entry in the same batch doesn't leave an empty
+		// version behind.
+		ipstore.Mutation[string]{Op: ipstore.OpAdd, Prefix: b, Value: "c"},
+	); err != nil {
+		t.Fatal(err)
+	}
+	tick()
+	if _, err := s.RemoveCIDR(a); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, expected := maps.Collect(s.AllAt(at(0))), map[netip.Prefix]string{a: "a", b: "c"}; !maps.Equal(got, expected) {
+		t.Errorf("expected %v; got %v", expected, got)
+	}
+	if got, expected := maps.Collect(s.AllAt(at(1))), map[netip.Prefix]string{b: "c"}; !maps.Equal(got, expected) {
+		t.Errorf("expected %v; got %v", expected, got)
+	}
+	if n := len(s.History(b)); n != 1 {
+		t.Errorf("expected 1 version; got %d", n)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	now, tick := clock()
+	s := versioned.New[string](versioned.WithClock(now), versioned.WithRetention(2*time.Hour))
+	a, b := netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("192.0.2.0/24")
+
+	for _, v := range []string{"1", "2", "3"} {
+		if err := s.AddCIDR(a, v); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.AddCIDR(b, v); err != nil {
+			t.Fatal(err)
+		}
+		tick()
+	}
+	if _, err := s.RemoveCIDR(b); err != nil {
+		t.Fatal(err)
+	}
+	tick()
+	tick()
+
+	// at 5h, versions that ended at or before 3h are removed.
+	n, err := s.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Errorf("expected 4 versions removed; got %d", n)
+	}
+	if history := s.History(a); len(history) != 1 || history[0].Value != "3" {
+		t.Errorf("unexpected history %+v", history)
+	}
+	if history := s.History(b); len(history) != 0 {
+		t.Errorf("unexpected history %+v", history)
+	}
+	if _, ok := s.GetAt(netip.MustParseAddr("10.0.0.1"), at(0)); ok {
+		t.Error("expected no match for removed version")
+	}
+	if v, _ := s.GetAt(netip.MustParseAddr("10.0.0.1"), at(4)); v != "3" {
+		t.Errorf("expected %q; got %q", "3", v)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	ipstoretest.RunWriter(t, func(t *testing.T) (ipstore.Writer[string], ipstore.Reader[string]) {
+		s := versioned.New[string]()
+		return s, s.Store()
+	})
+}
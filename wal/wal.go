@@ -0,0 +1,621 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package wal makes changes to an [ipstore.Store] durable using a
+// write-ahead log.
+//
+// Every batch of mutations is appended to a checksummed log file before
+// it's applied to the store. A directory holds the most recent snapshot
+// of the store and the log files written since. On [Open], the log is
+// replayed over the snapshot; a partially written record at the end of
+// the log, left behind by a crash, is discarded. [Log.Compact] writes a
+// fresh snapshot and removes the log files it contains.
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hslatman/ipstore"
+)
+
+const (
+	logExt      = ".wal"
+	snapshotExt = ".snap"
+	tmpExt      = ".tmp"
+
+	// headerSize is the size of the length and checksum preceding
+	// every record.
+	headerSize = 8
+	// maxRecord limits the size of a single record.
+	maxRecord = 64 << 20
+)
+
+var _ ipstore.Writer[any] = (*Log[any])(nil)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	// ErrClosed is returned when using a [Log] after it has been closed.
+	ErrClosed = errors.New("wal: log closed")
+	// ErrCorrupt is returned by [Open] when a log file other than the
+	// last one holds an invalid record.
+	ErrCorrupt = errors.New("wal: corrupt log")
+)
+
+// SyncPolicy determines when the log is flushed to stable storage.
+type SyncPolicy int
+
+const (
+	// SyncAlways flushes the log after every write, before the write is
+	// acknowledged.
+	SyncAlways SyncPolicy = iota
+	// SyncInterval flushes the log periodically; writes made since the
+	// last flush may be lost when the system crashes.
+	SyncInterval
+	// SyncNever leaves flushing the log to the operating system.
+	SyncNever
+)
+
+// Option configures a [Log].
+type Option func(*options)
+
+type options struct {
+	sync            SyncPolicy
+	syncInterval    time.Duration
+	compactInterval time.Duration
+	onError         func(error)
+}
+
+// WithSyncPolicy sets when the log is flushed to stable storage. It
+// defaults to [SyncAlways].
+func WithSyncPolicy(p SyncPolicy) Option {
+	return func(o *options) {
+		o.sync = p
+	}
+}
+
+// WithSyncInterval flushes the log to stable storage every d, using
+// [SyncInterval].
+func WithSyncInterval(d time.Duration) Option {
+	return func(o *options) {
+		o.sync = SyncInterval
+		o.syncInterval = d
+	}
+}
+
+// WithCompactInterval compacts the log every d, when it holds records.
+func WithCompactInterval(d time.Duration) Option {
+	return func(o *options) {
+		o.compactInterval = d
+	}
+}
+
+// WithErrorHandler sets a function called with errors from flushing and
+// compacting the log in the background.
+func WithErrorHandler(fn func(error)) Option {
+	return func(o *options) {
+		o.onError = fn
+	}
+}
+
+// Log is an [ipstore.Store] backed by a write-ahead log. All changes to
+// the store must be made through the [Log].
+type Log[T any] struct {
+	dir   string
+	codec ipstore.Codec[T]
+	opts  options
+	store *ipstore.Store[T]
+
+	mu     sync.Mutex
+	gen    uint64 // generation of the current log file
+	f      *os.File
+	size   int64 // bytes in the current log file
+	dirty  bool  // written since the last flush
+	closed bool
+
+	compactMu sync.Mutex
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// Open opens the log in dir, creating it when it doesn't exist, and
+// recovers the store from the snapshot and log files in it.
+func Open[T any](dir string, codec ipstore.Codec[T], opts ...Option) (*Log[T], error) {
+	o := options{syncInterval: time.Second}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	l := &Log[T]{
+		dir:   dir,
+		codec: codec,
+		opts:  o,
+		store: ipstore.New[T](),
+		done:  make(chan struct{}),
+	}
+	if err := l.recover(); err != nil {
+		return nil, err
+	}
+
+	if o.sync == SyncInterval && o.syncInterval > 0 {
+		l.background(o.syncInterval, l.Sync)
+	}
+	if o.compactInterval > 0 {
+		l.background(o.compactInterval, l.compactIfNeeded)
+	}
+
+	return l, nil
+}
+
+// Store returns the store recovered from, and kept up to date by, the
+// [Log]. It must only be read from.
+func (l *Log[T]) Store() *ipstore.Store[T] {
+	return l.store
+}
+
+// AddCIDR durably adds an entry to the store.
+func (l *Log[T]) AddCIDR(key netip.Prefix, value T) error {
+	return l.Apply(ipstore.Mutation[T]{Op: ipstore.OpAdd, Prefix: key, Value: value})
+}
+
+// RemoveCIDR durably removes an entry from the store. It returns the
+// value of the entry removed.
+func (l *Log[T]) RemoveCIDR(key netip.Prefix) (T, error) {
+	var old T
+	ms := []ipstore.Mutation[T]{{Op: ipstore.OpRemove, Prefix: key}}
+	rec, err := l.encode(ms)
+	if err != nil {
+		return old, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	old, _ = l.store.GetExactCIDR(key)
+	if err := l.commit(rec, ms); err != nil {
+		var zero T
+		return zero, err
+	}
+
+	return old, nil
+}
+
+// Apply appends the mutations to the log as a single record, and then
+// applies them to the store atomically. Depending on the [SyncPolicy],
+// the log is flushed to stable storage before Apply returns.
+func (l *Log[T]) Apply(ms ...ipstore.Mutation[T]) error {
+	if len(ms) == 0 {
+		return nil
+	}
+
+	rec, err := l.encode(ms)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.commit(rec, ms)
+}
+
+// encode returns the record holding the mutations.
+func (l *Log[T]) encode(ms []ipstore.Mutation[T]) ([]byte, error) {
+	for _, m := range ms {
+		if err := m.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	rec := make([]byte, headerSize)
+	rec, err := ipstore.AppendMutations(rec, ms, l.codec)
+	if err != nil {
+		return nil, err
+	}
+	payload := rec[headerSize:]
+	if len(payload) > maxRecord {
+		return nil, fmt.Errorf("record of %d bytes exceeds the maximum of %d", len(payload), maxRecord)
+	}
+	binary.BigEndian.PutUint32(rec[0:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(rec[4:], crc32.Checksum(payload, crcTable))
+
+	return rec, nil
+}
+
+// commit appends the record to the log, and applies the mutations it
+// holds to the store. It must be called with l.mu held.
+func (l *Log[T]) commit(rec []byte, ms []ipstore.Mutation[T]) error {
+	if l.closed {
+		return ErrClosed
+	}
+
+	n, err := l.f.Write(rec)
+	if err != nil {
+		// don't leave a partial record behind for the next one to be
+		// appended to.
+		if n > 0 {
+			l.f.Truncate(l.size)
+			l.f.Seek(l.size, io.SeekStart)
+		}
+		return err
+	}
+	l.size += int64(n)
+	l.dirty = true
+
+	if l.opts.sync == SyncAlways {
+		if err := l.syncLocked(); err != nil {
+			return err
+		}
+	}
+
+	return l.store.Apply(ms...)
+}
+
+// Sync flushes the log to stable storage.
+func (l *Log[T]) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return ErrClosed
+	}
+
+	return l.syncLocked()
+}
+
+func (l *Log[T]) syncLocked() error {
+	if !l.dirty {
+		return nil
+	}
+	if err := l.f.Sync(); err != nil {
+		return err
+	}
+	l.dirty = false
+
+	return nil
+}
+
+// Compact writes a snapshot of the store and removes the log files it
+// contains. Writes can continue while the snapshot is written.
+func (l *Log[T]) Compact() error {
+	l.compactMu.Lock()
+	defer l.compactMu.Unlock()
+
+	// switch to a new log file, so that the snapshot contains exactly
+	// the records in the previous ones.
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return ErrClosed
+	}
+	gen := l.gen + 1
+	f, err := createFile(l.path(gen, logExt))
+	if err != nil {
+		l.mu.Unlock()
+		return err
+	}
+	old := l.f
+	err = old.Sync()
+	l.gen, l.f, l.size, l.dirty = gen, f, 0, false
+	snapshot := l.store.Clone()
+	l.mu.Unlock()
+
+	if err := errors.Join(err, old.Close()); err != nil {
+		return err
+	}
+
+	if err := l.writeSnapshot(gen, snapshot); err != nil {
+		return err
+	}
+
+	return l.removeBefore(gen)
+}
+
+func (l *Log[T]) compactIfNeeded() error {
+	l.mu.Lock()
+	empty := l.size == 0
+	l.mu.Unlock()
+	if empty {
+		return nil
+	}
+
+	return l.Compact()
+}
+
+// Close stops background flushing and compaction, flushes the log and
+// closes it.
+func (l *Log[T]) Close() error {
+	l.mu.Lock()
+	select {
+	case <-l.done:
+		l.mu.Unlock()
+		return nil
+	default:
+	}
+	close(l.done)
+	l.mu.Unlock()
+
+	// background compaction must finish before the log file is closed.
+	l.wg.Wait()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.closed = true
+
+	return errors.Join(l.syncLocked(), l.f.Close())
+}
+
+func (l *Log[T]) background(d time.Duration, fn func() error) {
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+
+		t := time.NewTicker(d)
+		defer t.Stop()
+		for {
+			select {
+			case <-l.done:
+				return
+			case <-t.C:
+				if err := fn(); err != nil && l.opts.onError != nil {
+					l.opts.onError(err)
+				}
+			}
+		}
+	}()
+}
+
+// recover loads the most recent snapshot and replays the log files
+// written after it.
+func (l *Log[T]) recover() error {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return err
+	}
+
+	var snapshots, logs []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasSuffix(name, tmpExt) {
+			// left behind by an interrupted compaction.
+			if err := os.Remove(filepath.Join(l.dir, name)); err != nil {
+				return err
+			}
+			continue
+		}
+		ext := filepath.Ext(name)
+		gen, err := strconv.ParseUint(strings.TrimSuffix(name, ext), 10, 64)
+		if err != nil {
+			continue
+		}
+		switch ext {
+		case snapshotExt:
+			snapshots = append(snapshots, gen)
+		case logExt:
+			logs = append(logs, gen)
+		}
+	}
+	slices.Sort(snapshots)
+	slices.Sort(logs)
+
+	// a snapshot of generation n contains all records in log files
+	// before generation n.
+	var first uint64
+	if len(snapshots) > 0 {
+		first = snapshots[len(snapshots)-1]
+		if err := l.readSnapshot(first); err != nil {
+			return err
+		}
+	}
+	logs = slices.DeleteFunc(logs, func(gen uint64) bool { return gen < first })
+
+	for i, gen := range logs {
+		if err := l.replay(gen, i == len(logs)-1); err != nil {
+			return err
+		}
+	}
+	if err := l.removeBefore(first); err != nil {
+		return err
+	}
+
+	if len(logs) > 0 {
+		// replaying the last log file left it open for appending.
+		return nil
+	}
+
+	l.gen = max(first, 1)
+	l.f, err = createFile(l.path(l.gen, logExt))
+
+	return err
+}
+
+func (l *Log[T]) readSnapshot(gen uint64) error {
+	f, err := os.Open(l.path(gen, snapshotExt))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := l.store.ReadSnapshot(f, l.codec); err != nil {
+		return fmt.Errorf("failed reading snapshot %s: %w", f.Name(), err)
+	}
+
+	return nil
+}
+
+// replay applies the records in a log file to the store. A partially
+// written or corrupted record at the end of the last log file is removed,
+// and the last log file is kept open for appending.
+func (l *Log[T]) replay(gen uint64, last bool) error {
+	f, err := os.OpenFile(l.path(gen, logExt), os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+
+	var offset int64
+	hdr := make([]byte, headerSize)
+	for {
+		payload, err := readRecord(f, hdr)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		var ms []ipstore.Mutation[T]
+		if err == nil {
+			ms, err = ipstore.DecodeMutations(payload, l.codec)
+		}
+		if err != nil {
+			if !last {
+				f.Close()
+				return fmt.Errorf("%w: %s at offset %d: %w", ErrCorrupt, f.Name(), offset, err)
+			}
+			if err := f.Truncate(offset); err != nil {
+				f.Close()
+				return err
+			}
+			break
+		}
+		if err := l.store.Apply(ms...); err != nil {
+			f.Close()
+			return err
+		}
+		offset += int64(headerSize + len(payload))
+	}
+
+	if !last {
+		return f.Close()
+	}
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	l.gen, l.f, l.size = gen, f, offset
+
+	return nil
+}
+
+// readRecord reads a single record, returning [io.EOF] only when there
+// are no more records at all.
+func readRecord(r io.Reader, hdr []byte) ([]byte, error) {
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+
+	n := binary.BigEndian.Uint32(hdr[0:])
+	if n > maxRecord {
+		return nil, fmt.Errorf("record of %d bytes too large", n)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(hdr[4:]) {
+		return nil, errors.New("checksum mismatch")
+	}
+
+	return payload, nil
+}
+
+func (l *Log[T]) writeSnapshot(gen uint64, s *ipstore.Store[T]) error {
+	path := l.path(gen, snapshotExt)
+	f, err := createFile(path + tmpExt)
+	if err != nil {
+		return err
+	}
+
+	err = s.WriteSnapshot(f, l.codec)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err := errors.Join(err, f.Close()); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+
+	return syncDir(l.dir)
+}
+
+// removeBefore removes the snapshots and log files of generations before
+// gen.
+func (l *Log[T]) removeBefore(gen uint64) error {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		ext := filepath.Ext(e.Name())
+		if ext != logExt && ext != snapshotExt {
+			continue
+		}
+		g, err := strconv.ParseUint(strings.TrimSuffix(e.Name(), ext), 10, 64)
+		if err != nil || g >= gen {
+			continue
+		}
+		if err := os.Remove(filepath.Join(l.dir, e.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (l *Log[T]) path(gen uint64, ext string) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%020d%s", gen, ext))
+}
+
+// createFile creates a file and makes its directory entry durable.
+func createFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
@@ -0,0 +1,286 @@
+// Copyright 2021 Herman Slatman
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal_test
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/hslatman/ipstore"
+	"github.com/hslatman/ipstore/ipstoretest"
+	"github.com/hslatman/ipstore/wal"
+)
+
+func open(t *testing.T, dir string, opts ...wal.Option) *wal.Log[string] {
+	t.Helper()
+
+	l, err := wal.Open(dir, ipstore.StringCodec{}, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	return l
+}
+
+func add(t *testing.T, l *wal.Log[string], cidrs ...string) {
+	t.Helper()
+
+	for _, cidr := range cidrs {
+		if err := l.AddCIDR(netip.MustParsePrefix(cidr), cidr); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func files(t *testing.T, dir string) []string {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+
+	return names
+}
+
+func TestRecover(t *testing.T) {
+	dir := t.TempDir()
+
+	l := open(t, dir)
+	add(t, l, "10.0.0.0/8", "192.0.2.0/24", "2001:db8::/32")
+	if _, err := l.RemoveCIDR(netip.MustParsePrefix("192.0.2.0/24")); err != nil {
+		t.Fatal(err)
+	}
+	err := l.Apply(
+		ipstore.Mutation[string]{Op: ipstore.OpAdd, Prefix: netip.MustParsePrefix("198.51.100.0/24"), Value: "batch"},
+		ipstore.Mutation[string]{Op: ipstore.OpRemove, Prefix: netip.MustParsePrefix("10.0.0.0/8")},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.AddCIDR(netip.MustParsePrefix("203.0.113.0/24"), ""); !errors.Is(err, wal.ErrClosed) {
+		t.Errorf("expected ErrClosed; got %v", err)
+	}
+
+	l = open(t, dir)
+	s := l.Store()
+	if s.Len() != 2 {
+		t.Errorf("expected 2 entries; got %d", s.Len())
+	}
+	if v, _ := s.GetOneIPOrCIDR("198.51.100.1"); v != "batch" {
+		t.Errorf("expected %q; got %q", "batch", v)
+	}
+	if _, ok := s.GetOneIPOrCIDR("10.0.0.1"); ok {
+		t.Error("expected 10.0.0.0/8 to be removed")
+	}
+}
+
+func TestRecoverTornWrite(t *testing.T) {
+	dir := t.TempDir()
+
+	l := open(t, dir)
+	add(t, l, "10.0.0.0/8", "192.0.2.0/24")
+	l.Close()
+
+	// simulate a crash halfway through writing a record.
+	path := filepath.Join(dir, files(t, dir)[0])
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, append(b, b[:len(b)/2-3]...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	l = open(t, dir)
+	if l.Store().Len() != 2 {
+		t.Errorf("expected 2 entries; got %d", l.Store().Len())
+	}
+	add(t, l, "2001:db8::/32")
+	l.Close()
+
+	l = open(t, dir)
+	if l.Store().Len() != 3 {
+		t.Errorf("expected 3 entries after appending to a recovered log; got %d", l.Store().Len())
+	}
+}
+
+func TestRecoverCorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+
+	l := open(t, dir)
+	add(t, l, "10.0.0.0/8", "192.0.2.0/24")
+	l.Close()
+
+	path := filepath.Join(dir, files(t, dir)[0])
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)-1] ^= 0xff
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// a corrupted record in the last log file is discarded...
+	l = open(t, dir)
+	if l.Store().Len() != 1 {
+		t.Errorf("expected 1 entry; got %d", l.Store().Len())
+	}
+	l.Close()
+
+	// ...but not in earlier ones.
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	next := filepath.Join(dir, "00000000000000000002.wal")
+	if err := os.WriteFile(next, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wal.Open(dir, ipstore.StringCodec{}); !errors.Is(err, wal.ErrCorrupt) {
+		t.Errorf("expected ErrCorrupt; got %v", err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	dir := t.TempDir()
+
+	l := open(t, dir)
+	add(t, l, "10.0.0.0/8", "192.0.2.0/24")
+	if err := l.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	add(t, l, "2001:db8::/32")
+	if _, err := l.RemoveCIDR(netip.MustParsePrefix("10.0.0.0/8")); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	add(t, l, "198.51.100.0/24")
+	l.Close()
+
+	expected := []string{"00000000000000000003.snap", "00000000000000000003.wal"}
+	if names := files(t, dir); !slices.Equal(names, expected) {
+		t.Errorf("expected files %v; got %v", expected, names)
+	}
+
+	l = open(t, dir)
+	if l.Store().Len() != 3 {
+		t.Errorf("expected 3 entries; got %d", l.Store().Len())
+	}
+}
+
+func TestRecoverInterruptedCompaction(t *testing.T) {
+	dir := t.TempDir()
+
+	l := open(t, dir)
+	add(t, l, "10.0.0.0/8")
+	if err := l.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	add(t, l, "192.0.2.0/24")
+	l.Close()
+
+	// a compaction that was interrupted after switching to a new log
+	// file, but before the snapshot was renamed.
+	if err := os.WriteFile(filepath.Join(dir, "00000000000000000003.wal"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "00000000000000000003.snap.tmp"), []byte("partial"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	l = open(t, dir)
+	add(t, l, "2001:db8::/32")
+	if l.Store().Len() != 3 {
+		t.Errorf("expected 3 entries; got %d", l.Store().Len())
+	}
+	expected := []string{"00000000000000000002.snap", "00000000000000000002.wal", "00000000000000000003.wal"}
+	if names := files(t, dir); !slices.Equal(names, expected) {
+		t.Errorf("expected files %v; got %v", expected, names)
+	}
+}
+
+func TestSyncPolicies(t *testing.T) {
+	for _, opt := range []wal.Option{
+		wal.WithSyncPolicy(wal.SyncAlways),
+		wal.WithSyncPolicy(wal.SyncNever),
+		wal.WithSyncInterval(time.Millisecond),
+	} {
+		dir := t.TempDir()
+		l := open(t, dir, opt)
+		add(t, l, "10.0.0.0/8")
+		if err := l.Sync(); err != nil {
+			t.Error(err)
+		}
+		l.Close()
+
+		l = open(t, dir, opt)
+		if l.Store().Len() != 1 {
+			t.Errorf("expected 1 entry; got %d", l.Store().Len())
+		}
+	}
+}
+
+func TestCompactInterval(t *testing.T) {
+	dir := t.TempDir()
+
+	l := open(t, dir, wal.WithCompactInterval(time.Millisecond), wal.WithErrorHandler(func(err error) {
+		t.Error(err)
+	}))
+	add(t, l, "10.0.0.0/8")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !slices.Contains(files(t, dir), "00000000000000000002.snap") {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected log to be compacted; got files %v", files(t, dir))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	l.Close()
+
+	l = open(t, dir)
+	if l.Store().Len() != 1 {
+		t.Errorf("expected 1 entry; got %d", l.Store().Len())
+	}
+}
+
+func TestInvalidMutation(t *testing.T) {
+	l := open(t, t.TempDir())
+	if err := l.Apply(ipstore.Mutation[string]{Op: ipstore.OpAdd}); !errors.Is(err, ipstore.ErrInvalidMutation) {
+		t.Errorf("expected ErrInvalidMutation; got %v", err)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	ipstoretest.RunWriter(t, func(t *testing.T) (ipstore.Writer[string], ipstore.Reader[string]) {
+		l := open(t, t.TempDir())
+		return l, l.Store()
+	})
+}